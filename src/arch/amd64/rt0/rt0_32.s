@@ -50,11 +50,15 @@ page_table_l4:		resb 4096
 page_table_l3:		resb 4096
 page_table_l2:		resb 4096
 
-; Reserve 16K for storing multiboot data and for the kernel stack
+; Reserve 16K for storing multiboot data and for the kernel stack. The page
+; between the two is reserved for a stack guard page; the kernel unmaps it once
+; it sets up its own page tables so that stack overflows trigger a page fault
+; instead of corrupting the multiboot data.
 global multiboot_data ; Make this available to the 64-bit entrypoint
 global stack_bottom
 global stack_top
 multiboot_data: resb 16384
+stack_guard:    resb 4096
 stack_bottom:   resb 16384
 stack_top:
 
@@ -30,12 +30,18 @@ _rt0_64_entry:
 	call _rt0_64_setup_go_runtime_structs
 
 	; Call the kernel entry point passing a pointer to the multiboot data
-	; copied by the 32-bit entry code
+	; copied by the 32-bit entry code and the bounds of the kernel stack
 	extern multiboot_data
 	extern _kernel_start
 	extern _kernel_end
+	extern stack_bottom
+	extern stack_top
 	extern kernel.Kmain
 
+	mov rax, stack_top
+	push rax
+	mov rax, stack_bottom
+	push rax
 	mov rax, PAGE_OFFSET
 	push rax
 	mov rax, _kernel_end - PAGE_OFFSET
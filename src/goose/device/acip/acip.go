@@ -6,7 +6,9 @@ import (
 	"goose/kernel"
 	"goose/kernel/kfmt"
 	"goose/kernel/mm"
+	"goose/kernel/mm/pmm"
 	"goose/kernel/mm/vmm"
+	"goose/multiboot"
 	"io"
 	"unsafe"
 )
@@ -24,6 +26,9 @@ var (
 	identityMapFn = vmm.IdentityMapRegion
 	unmapFn       = vmm.Unmap
 
+	reclaimRegionFn   = pmm.ReclaimRegion
+	visitMemRegionsFn = multiboot.VisitMemRegions
+
 	// RDSP must be located in the physical memory region 0xe0000 to 0xfffff
 	rsdpLocationLow uintptr = 0xe0000
 	rsdpLocationHi  uintptr = 0xfffff
@@ -33,8 +38,16 @@ var (
 	fadtSignature = "FACP"
 )
 
+// tableRegion describes a physical memory region that has been identity
+// mapped for accessing an ACPI table.
+type tableRegion struct {
+	addr   uintptr
+	length uintptr
+}
+
 type acpiDriver struct {
-	// rsdtAddr holds the address to the root system descriptor table.
+	// rsdtAddr holds the address to the root system descriptor table. It
+	// is cleared once the tables have been relocated.
 	rsdtAddr uintptr
 
 	// useXSDT specifies if the driver must use the XSDT or the RSDT table.
@@ -44,6 +57,11 @@ type acpiDriver struct {
 	// by the table name. All tables included in this map are mapped into
 	// memory.
 	tableMap map[string]*table.SDTHeader
+
+	// mappedTables tracks the identity mappings established by mapTable
+	// (including the ones for tables that were skipped due to a checksum
+	// mismatch) so they can be removed when the tables are relocated.
+	mappedTables []tableRegion
 }
 
 // DriverInit initializes this driver.
@@ -53,6 +71,8 @@ func (drv *acpiDriver) DriverInit(w io.Writer) *kernel.Error {
 	}
 
 	drv.printTableInfo(w)
+	drv.relocateTables()
+	drv.reclaimMemory(w)
 
 	return nil
 }
@@ -83,7 +103,7 @@ func (drv *acpiDriver) printTableInfo(w io.Writer) {
 // the table list defined by the RSDP, this method will also peek into the
 // FADT (if found) looking for the address of DSDT.
 func (drv *acpiDriver) enumerateTables(w io.Writer) *kernel.Error {
-	header, sizeofHeader, err := mapACPITable(drv.rsdtAddr)
+	header, sizeofHeader, err := drv.mapTable(drv.rsdtAddr)
 	if err != nil {
 		return err
 	}
@@ -111,7 +131,7 @@ func (drv *acpiDriver) enumerateTables(w io.Writer) *kernel.Error {
 	}
 
 	for _, addr := range sdtAddresses {
-		if header, _, err = mapACPITable(addr); err != nil {
+		if header, _, err = drv.mapTable(addr); err != nil {
 			switch err {
 			case errTableChecksumMismatch:
 				kfmt.Fprintf(w, "%s at 0x%16x %6x [checksum mismatch; skipping]\n",
@@ -137,7 +157,7 @@ func (drv *acpiDriver) enumerateTables(w io.Writer) *kernel.Error {
 				dsdtAddr = uintptr(fadt.Ext.Dsdt)
 			}
 
-			if header, _, err = mapACPITable(dsdtAddr); err != nil {
+			if header, _, err = drv.mapTable(dsdtAddr); err != nil {
 				switch err {
 				case errTableChecksumMismatch:
 					kfmt.Fprintf(w, "%s at 0x%16x %6x [checksum mismatch; skipping]\n",
@@ -159,6 +179,66 @@ func (drv *acpiDriver) enumerateTables(w io.Writer) *kernel.Error {
 	return nil
 }
 
+// relocateTables copies the contents of all discovered ACPI tables to
+// kernel-allocated memory and removes all identity mappings that were
+// established while enumerating the tables. Once relocateTables returns, the
+// driver no longer references the firmware-provided table memory.
+func (drv *acpiDriver) relocateTables() {
+	for name, header := range drv.tableMap {
+		tableAddr := uintptr(unsafe.Pointer(header))
+		tableCopy := make([]byte, header.Length)
+		kernel.Memcopy(tableAddr, uintptr(unsafe.Pointer(&tableCopy[0])), uintptr(header.Length))
+		drv.tableMap[name] = (*table.SDTHeader)(unsafe.Pointer(&tableCopy[0]))
+	}
+
+	// Tables may share pages so the identity mappings can only be removed
+	// after all tables have been copied
+	for _, region := range drv.mappedTables {
+		lastPage := mm.PageFromAddress(region.addr + region.length - 1)
+		for curPage := mm.PageFromAddress(region.addr); curPage <= lastPage; curPage++ {
+			_ = unmapFn(curPage)
+		}
+	}
+
+	drv.mappedTables = nil
+	drv.rsdtAddr = 0
+}
+
+// reclaimMemory hands the memory regions that the firmware flags as ACPI
+// reclaimable back to the physical frame allocator. This method must only be
+// invoked after the driver has relocated the ACPI tables.
+func (drv *acpiDriver) reclaimMemory(w io.Writer) {
+	visitMemRegionsFn(func(region *multiboot.MemoryMapEntry) bool {
+		if region.Type != multiboot.MemAcpiReclaimable {
+			return true
+		}
+
+		if err := reclaimRegionFn(uintptr(region.PhysAddress), uintptr(region.Length)); err != nil {
+			kfmt.Fprintf(w, "unable to reclaim region [0x%x - 0x%x]: %s\n",
+				region.PhysAddress,
+				region.PhysAddress+region.Length,
+				err.Message,
+			)
+		}
+		return true
+	})
+}
+
+// mapTable maps the ACPI table at the supplied address using mapACPITable and
+// records the established identity mapping so it can be removed by
+// relocateTables. The mapping is recorded even if mapACPITable fails.
+func (drv *acpiDriver) mapTable(tableAddr uintptr) (*table.SDTHeader, uintptr, *kernel.Error) {
+	header, sizeofHeader, err := mapACPITable(tableAddr)
+
+	mappedLen := sizeofHeader
+	if header != nil && uintptr(header.Length) > mappedLen {
+		mappedLen = uintptr(header.Length)
+	}
+	drv.mappedTables = append(drv.mappedTables, tableRegion{tableAddr, mappedLen})
+
+	return header, sizeofHeader, err
+}
+
 // mapACPITable attempts to map and parse the header for the ACPI table starting
 // at the given address. It then uses the length field for the header to expand
 // the mapping to cover the table contents and verifies the checksum before
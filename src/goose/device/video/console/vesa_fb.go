@@ -53,6 +53,13 @@ type VesaFbConsole struct {
 
 // NewVesaFbConsole returns a new instance of the vesa framebuffer driver.
 func NewVesaFbConsole(width, height uint32, bpp uint8, pitch uint32, colorInfo *multiboot.FramebufferRGBColorInfo, fbPhysAddr uintptr) *VesaFbConsole {
+	// Keep a private copy of the color info as it points to the multiboot
+	// payload which gets reclaimed once the kernel finishes booting.
+	if colorInfo != nil {
+		colorInfoCopy := *colorInfo
+		colorInfo = &colorInfoCopy
+	}
+
 	return &VesaFbConsole{
 		bpp:           uint32(bpp),
 		bytesPerPixel: uint32(bpp+1) >> 3,
@@ -558,12 +565,13 @@ func (cons *VesaFbConsole) DriverVersion() (uint16, uint16, uint16) {
 
 // DriverInit initializes this driver.
 func (cons *VesaFbConsole) DriverInit(w io.Writer) *kernel.Error {
-	// Map the framebuffer so we can write to it
+	// Map the framebuffer so we can write to it. Write-combining allows
+	// the CPU to batch the writes to the framebuffer memory.
 	fbSize := uintptr(cons.height * cons.pitch)
 	fbPage, err := mapRegionFn(
 		mm.Frame(cons.fbPhysAddr>>mm.PageShift),
 		fbSize,
-		vmm.FlagPresent|vmm.FlagRW,
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute|vmm.FlagMemWriteCombining,
 	)
 
 	if err != nil {
@@ -212,7 +212,7 @@ func (cons *VgaTextConsole) DriverInit(w io.Writer) *kernel.Error {
 	fbPage, err := mapRegionFn(
 		mm.Frame(cons.fbPhysAddr>>mm.PageShift),
 		fbSize,
-		vmm.FlagPresent|vmm.FlagRW,
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute,
 	)
 
 	if err != nil {
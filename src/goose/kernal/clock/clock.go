@@ -0,0 +1,151 @@
+// Package clock provides the monotonic and wall clocks used by the kernel and
+// the Go runtime.
+package clock
+
+import (
+	"goose/kernel"
+	"goose/kernel/cpu"
+	"goose/kernel/gate"
+	"goose/kernel/kfmt"
+)
+
+// Source describes the hardware used for keeping track of time.
+type Source uint8
+
+const (
+	// SourceNone indicates that the clock has not been initialized yet.
+	SourceNone Source = iota
+
+	// SourceTSC uses the CPU time stamp counter calibrated against the PIT.
+	SourceTSC
+
+	// SourcePIT counts the periodic interrupts raised by the PIT.
+	SourcePIT
+)
+
+// String implements fmt.Stringer for Source.
+func (s Source) String() string {
+	switch s {
+	case SourceTSC:
+		return "TSC"
+	case SourcePIT:
+		return "PIT"
+	default:
+		return "none"
+	}
+}
+
+const nsPerSecond = 1000000000
+
+var (
+	// activeSource is the clock source selected by Init.
+	activeSource Source
+
+	// tscFrequency is the calibrated TSC frequency in Hz and tscBase is the
+	// TSC value when the TSC clock source was selected.
+	tscFrequency uint64
+	tscBase      uint64
+
+	// bootWallTime is the number of nanoseconds elapsed since the Unix
+	// epoch when the clock was initialized.
+	bootWallTime int64
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	hasTSCFn           = cpu.HasTSC
+	hasInvariantTSCFn  = cpu.HasInvariantTSC
+	readTSCFn          = cpu.ReadTSC
+	portReadByteFn     = cpu.PortReadByte
+	portWriteByteFn    = cpu.PortWriteByte
+	enableInterruptsFn = cpu.EnableInterrupts
+	handleInterruptFn  = gate.HandleInterrupt
+)
+
+// Init selects a clock source and initializes the wall clock from the RTC.
+// The TSC is preferred if it runs at a constant rate and can be calibrated
+// against the PIT. Otherwise, the PIT is programmed to raise periodic
+// interrupts which are counted to keep track of time.
+func Init() *kernel.Error {
+	remapPIC()
+
+	switch {
+	case !hasTSCFn():
+		kfmt.Printf("[clock] CPU does not provide a TSC\n")
+	case !hasInvariantTSCFn():
+		kfmt.Printf("[clock] TSC rate is not invariant\n")
+	default:
+		freq, err := calibrateTSC()
+		if err != nil {
+			kfmt.Printf("[clock] TSC calibration failed: %s\n", err.Message)
+			break
+		}
+
+		kfmt.Printf("[clock] TSC frequency calibrated against the PIT: %d kHz\n", freq/1000)
+		tscFrequency, tscBase = freq, readTSCFn()
+		activeSource = SourceTSC
+	}
+
+	if activeSource == SourceNone {
+		startPITTicks()
+		activeSource = SourcePIT
+		kfmt.Printf("[clock] PIT tick period: %d ns\n", uint64(pitTickPeriod))
+	}
+
+	bootWallTime = readRTC()
+	kfmt.Printf("[clock] using %s clock source; wall time: %d s since the Unix epoch\n", activeSource.String(), bootWallTime/nsPerSecond)
+
+	return nil
+}
+
+// EnableTicks programs the PIT to raise periodic interrupts if it does not do
+// so already. The interrupts do not affect the clock value when the TSC is
+// used as the clock source; they ensure that a halted CPU wakes up regularly
+// so that the kernel can check for expired timers.
+func EnableTicks() {
+	if !ticksEnabled {
+		startPITTicks()
+	}
+}
+
+// TickPeriod returns the time between two PIT interrupts in nanoseconds or 0
+// if the PIT does not raise periodic interrupts.
+//
+//go:nosplit
+func TickPeriod() uint64 {
+	if !ticksEnabled {
+		return 0
+	}
+
+	return pitTickPeriod
+}
+
+// ActiveSource returns the clock source selected by Init.
+func ActiveSource() Source {
+	return activeSource
+}
+
+// Nanotime returns a monotonically increasing clock value in nanoseconds. The
+// clock starts at 1 and only starts advancing once Init has been invoked.
+//
+//go:nosplit
+func Nanotime() uint64 {
+	switch activeSource {
+	case SourceTSC:
+		// Split the conversion to avoid overflowing the multiplication
+		delta := readTSCFn() - tscBase
+		return 1 + (delta/tscFrequency)*nsPerSecond + (delta%tscFrequency)*nsPerSecond/tscFrequency
+	case SourcePIT:
+		return 1 + pitTicks*pitTickPeriod
+	default:
+		return 1
+	}
+}
+
+// Walltime returns the number of seconds and nanoseconds elapsed since the
+// Unix epoch.
+//
+//go:nosplit
+func Walltime() (int64, int32) {
+	now := bootWallTime + int64(Nanotime()-1)
+	return now / nsPerSecond, int32(now % nsPerSecond)
+}
@@ -0,0 +1,63 @@
+package clock
+
+import "goose/kernel/gate"
+
+const (
+	picMasterCommand = 0x20
+	picMasterData    = 0x21
+	picSlaveCommand  = 0xa0
+	picSlaveData     = 0xa1
+
+	// picInit starts the PIC initialization sequence and indicates that
+	// ICW4 will be sent.
+	picInit = 0x11
+
+	// picMode8086 selects the 8086/88 mode (ICW4).
+	picMode8086 = 0x01
+
+	// picEOI signals the end of an interrupt.
+	picEOI = 0x20
+
+	// picCascadeIRQ is the master IRQ line that the slave PIC is attached to.
+	picCascadeIRQ = 2
+
+	// irqBaseVector is the interrupt number that IRQ 0 is mapped to. The
+	// BIOS maps the master PIC to vectors 8-15 which collide with the CPU
+	// exception vectors so the PICs are remapped to vectors 32-47.
+	irqBaseVector = gate.InterruptNumber(0x20)
+)
+
+// remapPIC initializes both 8259 PICs so that they raise IRQs using the
+// vectors starting at irqBaseVector and masks all IRQ lines.
+func remapPIC() {
+	portWriteByteFn(picMasterCommand, picInit)
+	portWriteByteFn(picSlaveCommand, picInit)
+	portWriteByteFn(picMasterData, uint8(irqBaseVector))
+	portWriteByteFn(picSlaveData, uint8(irqBaseVector)+8)
+	portWriteByteFn(picMasterData, 1<<picCascadeIRQ)
+	portWriteByteFn(picSlaveData, picCascadeIRQ)
+	portWriteByteFn(picMasterData, picMode8086)
+	portWriteByteFn(picSlaveData, picMode8086)
+
+	portWriteByteFn(picMasterData, 0xff)
+	portWriteByteFn(picSlaveData, 0xff)
+}
+
+// unmaskIRQ enables the delivery of the specified IRQ line.
+func unmaskIRQ(irq uint8) {
+	if irq >= 8 {
+		portWriteByteFn(picSlaveData, portReadByteFn(picSlaveData)&^(1<<(irq-8)))
+		irq = picCascadeIRQ
+	}
+
+	portWriteByteFn(picMasterData, portReadByteFn(picMasterData)&^(1<<irq))
+}
+
+// ackIRQ signals the end of the specified IRQ to the PICs.
+func ackIRQ(irq uint8) {
+	if irq >= 8 {
+		portWriteByteFn(picSlaveCommand, picEOI)
+	}
+
+	portWriteByteFn(picMasterCommand, picEOI)
+}
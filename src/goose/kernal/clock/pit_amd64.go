@@ -0,0 +1,138 @@
+package clock
+
+import (
+	"goose/kernel"
+	"goose/kernel/gate"
+)
+
+const (
+	// pitFrequency is the frequency (in Hz) of the PIT input clock.
+	pitFrequency = 1193182
+
+	pitChannel0Data = 0x40
+	pitChannel2Data = 0x42
+	pitCommand      = 0x43
+
+	// pitChannel0RateGenerator selects channel 0, lo/hi byte access and
+	// mode 2 (rate generator).
+	pitChannel0RateGenerator = 0x34
+
+	// pitChannel2OneShot selects channel 2, lo/hi byte access and mode 0
+	// (interrupt on terminal count).
+	pitChannel2OneShot = 0xb0
+
+	// pitChannel2Control is the port that controls the channel 2 gate and
+	// reports the state of the channel 2 output.
+	pitChannel2Control = 0x61
+	pitChannel2Gate    = 1 << 0
+	pitSpeakerEnable   = 1 << 1
+	pitChannel2Out     = 1 << 5
+
+	// pitIRQ is the IRQ line the PIT channel 0 is connected to.
+	pitIRQ = 0
+
+	// pitTickDivisor configures the PIT to raise interrupts at ~1 kHz.
+	pitTickDivisor = pitFrequency / 1000
+
+	// pitTickPeriod is the time between two PIT interrupts in nanoseconds.
+	pitTickPeriod = pitTickDivisor * nsPerSecond / pitFrequency
+
+	// The TSC is calibrated by measuring the number of TSC ticks that
+	// elapse while the PIT counts down for 10ms. The measurement is
+	// repeated and the smallest sample is used as it is the one least
+	// affected by SMIs and emulator scheduling.
+	pitCalibrationCount = pitFrequency / 100
+	pitCalibrationRuns  = 3
+
+	// pitMaxPolls bounds the number of polls of the channel 2 output so
+	// that a missing PIT does not hang the calibration.
+	pitMaxPolls = 1 << 22
+)
+
+var (
+	errPITTimeout         = &kernel.Error{Module: "clock", Message: "timed out waiting for the PIT"}
+	errTSCNotIncrementing = &kernel.Error{Module: "clock", Message: "TSC does not increment"}
+
+	// pitTicks counts the number of PIT interrupts.
+	pitTicks uint64
+
+	// ticksEnabled is set to true once the PIT raises periodic interrupts.
+	ticksEnabled bool
+
+	// tickHook is invoked by pitTickHandler for each PIT interrupt.
+	tickHook func()
+)
+
+// SetTickHook registers a function that is invoked for each PIT interrupt
+// once periodic interrupts have been enabled via EnableTicks. The hook runs in
+// the interrupt context with interrupts disabled and must not block.
+func SetTickHook(hook func()) {
+	tickHook = hook
+}
+
+// calibrateTSC returns the TSC frequency in Hz as measured using the PIT
+// channel 2.
+func calibrateTSC() (uint64, *kernel.Error) {
+	minDelta := ^uint64(0)
+	for run := 0; run < pitCalibrationRuns; run++ {
+		delta, err := measureTSCDelta()
+		if err != nil {
+			return 0, err
+		}
+
+		if delta < minDelta {
+			minDelta = delta
+		}
+	}
+
+	if minDelta == 0 {
+		return 0, errTSCNotIncrementing
+	}
+
+	return minDelta * pitFrequency / pitCalibrationCount, nil
+}
+
+// measureTSCDelta programs the PIT channel 2 in one-shot mode and returns the
+// number of TSC ticks that elapse until the channel output goes high.
+func measureTSCDelta() (uint64, *kernel.Error) {
+	// Enable the channel 2 gate while keeping the speaker disconnected
+	control := portReadByteFn(pitChannel2Control)
+	portWriteByteFn(pitChannel2Control, control&^pitSpeakerEnable|pitChannel2Gate)
+
+	portWriteByteFn(pitCommand, pitChannel2OneShot)
+	portWriteByteFn(pitChannel2Data, uint8(pitCalibrationCount&0xff))
+	portWriteByteFn(pitChannel2Data, uint8(pitCalibrationCount>>8))
+
+	start := readTSCFn()
+	for polls := 0; portReadByteFn(pitChannel2Control)&pitChannel2Out == 0; polls++ {
+		if polls == pitMaxPolls {
+			return 0, errPITTimeout
+		}
+	}
+
+	return readTSCFn() - start, nil
+}
+
+// startPITTicks programs the PIT channel 0 to raise periodic interrupts,
+// installs the interrupt handler that counts them and enables interrupts.
+func startPITTicks() {
+	handleInterruptFn(irqBaseVector+pitIRQ, 0, pitTickHandler)
+
+	portWriteByteFn(pitCommand, pitChannel0RateGenerator)
+	portWriteByteFn(pitChannel0Data, uint8(pitTickDivisor&0xff))
+	portWriteByteFn(pitChannel0Data, uint8(pitTickDivisor>>8))
+
+	unmaskIRQ(pitIRQ)
+	ticksEnabled = true
+	enableInterruptsFn()
+}
+
+// pitTickHandler is invoked for each PIT interrupt.
+func pitTickHandler(_ *gate.Registers) {
+	pitTicks++
+	ackIRQ(pitIRQ)
+
+	if tickHook != nil {
+		tickHook()
+	}
+}
@@ -0,0 +1,130 @@
+package clock
+
+const (
+	cmosAddress = 0x70
+	cmosData    = 0x71
+
+	// cmosNMIDisable keeps NMIs disabled while the CMOS is accessed.
+	cmosNMIDisable = 0x80
+
+	rtcSeconds = 0x00
+	rtcMinutes = 0x02
+	rtcHours   = 0x04
+	rtcDay     = 0x07
+	rtcMonth   = 0x08
+	rtcYear    = 0x09
+	rtcStatusA = 0x0a
+	rtcStatusB = 0x0b
+	rtcStatusD = 0x0d
+
+	// rtcUpdateInProgress is set in status register A while the RTC
+	// updates its registers.
+	rtcUpdateInProgress = 1 << 7
+
+	// rtcBinaryMode and rtc24HourMode are set in status register B when
+	// the RTC reports binary (instead of BCD) values and 24-hour time.
+	rtcBinaryMode = 1 << 2
+	rtc24HourMode = 1 << 1
+
+	// rtcHourPM is set in the hours register for PM times in 12-hour mode.
+	rtcHourPM = 0x80
+
+	// rtcMaxReads bounds the attempts to obtain a consistent RTC reading.
+	rtcMaxReads = 1 << 16
+)
+
+// rtcTime contains the raw values of the RTC date and time registers.
+type rtcTime struct {
+	seconds, minutes, hours, day, month, year uint8
+}
+
+// readCMOS returns the value of a CMOS register. NMIs remain disabled after
+// the call; enableNMI must be invoked once all registers have been read.
+func readCMOS(reg uint8) uint8 {
+	portWriteByteFn(cmosAddress, cmosNMIDisable|reg)
+	return portReadByteFn(cmosData)
+}
+
+// enableNMI re-enables NMIs by clearing the NMI disable bit of the CMOS
+// address port. The read-only status register D is selected so that the
+// CMOS access sequence is completed without modifying any register.
+func enableNMI() {
+	portWriteByteFn(cmosAddress, rtcStatusD)
+	_ = portReadByteFn(cmosData)
+}
+
+// readRTCRegisters returns the contents of the RTC date and time registers
+// after waiting for any in-progress update to complete.
+func readRTCRegisters() rtcTime {
+	for reads := 0; readCMOS(rtcStatusA)&rtcUpdateInProgress != 0 && reads < rtcMaxReads; reads++ {
+	}
+
+	return rtcTime{
+		seconds: readCMOS(rtcSeconds),
+		minutes: readCMOS(rtcMinutes),
+		hours:   readCMOS(rtcHours),
+		day:     readCMOS(rtcDay),
+		month:   readCMOS(rtcMonth),
+		year:    readCMOS(rtcYear),
+	}
+}
+
+// readRTC returns the number of nanoseconds elapsed since the Unix epoch as
+// reported by the RTC. The RTC is assumed to hold the UTC time of a date in
+// the 21st century.
+func readRTC() int64 {
+	// The registers may change while being read; read them until two
+	// consecutive readings match.
+	t := readRTCRegisters()
+	for reads := 0; reads < rtcMaxReads; reads++ {
+		next := readRTCRegisters()
+		if next == t {
+			break
+		}
+		t = next
+	}
+
+	statusB := readCMOS(rtcStatusB)
+	enableNMI()
+
+	isPM := t.hours&rtcHourPM != 0
+	t.hours &^= rtcHourPM
+
+	if statusB&rtcBinaryMode == 0 {
+		t.seconds, t.minutes, t.hours = fromBCD(t.seconds), fromBCD(t.minutes), fromBCD(t.hours)
+		t.day, t.month, t.year = fromBCD(t.day), fromBCD(t.month), fromBCD(t.year)
+	}
+
+	if statusB&rtc24HourMode == 0 {
+		t.hours %= 12
+		if isPM {
+			t.hours += 12
+		}
+	}
+
+	days := daysSinceEpoch(2000+int64(t.year), int64(t.month), int64(t.day))
+	seconds := ((days*24+int64(t.hours))*60+int64(t.minutes))*60 + int64(t.seconds)
+	return seconds * nsPerSecond
+}
+
+// fromBCD converts a BCD-encoded value to binary.
+func fromBCD(v uint8) uint8 {
+	return (v>>4)*10 + v&0x0f
+}
+
+// daysSinceEpoch returns the number of days between the Unix epoch and the
+// specified date of the proleptic Gregorian calendar.
+func daysSinceEpoch(year, month, day int64) int64 {
+	// Count years from March so that leap days are at the end of the year
+	if month <= 2 {
+		year--
+	}
+
+	era := year / 400
+	yearOfEra := year - era*400
+	dayOfYear := (153*((month+9)%12)+2)/5 + day - 1
+	dayOfEra := yearOfEra*365 + yearOfEra/4 - yearOfEra/100 + dayOfYear
+
+	// 719468 is the number of days between 0000-03-01 and 1970-01-01
+	return era*146097 + dayOfEra - 719468
+}
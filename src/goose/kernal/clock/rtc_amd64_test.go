@@ -0,0 +1,107 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+// mockCMOS redirects the CMOS port accesses to the supplied register file.
+// The returned function restores the original port access functions.
+func mockCMOS(regs *[128]uint8) func() {
+	var (
+		origRead  = portReadByteFn
+		origWrite = portWriteByteFn
+		selected  uint8
+	)
+
+	portWriteByteFn = func(port uint16, value uint8) {
+		if port == cmosAddress {
+			selected = value &^ cmosNMIDisable
+		}
+	}
+	portReadByteFn = func(port uint16) uint8 {
+		if port == cmosData {
+			return regs[selected]
+		}
+		return 0
+	}
+
+	return func() {
+		portReadByteFn, portWriteByteFn = origRead, origWrite
+	}
+}
+
+func TestFromBCD(t *testing.T) {
+	specs := []struct {
+		in  uint8
+		exp uint8
+	}{
+		{0x00, 0},
+		{0x09, 9},
+		{0x10, 10},
+		{0x12, 12},
+		{0x59, 59},
+		{0x99, 99},
+	}
+
+	for specIndex, spec := range specs {
+		if got := fromBCD(spec.in); got != spec.exp {
+			t.Errorf("[spec %d] expected fromBCD(0x%x) to return %d; got %d", specIndex, spec.in, spec.exp, got)
+		}
+	}
+}
+
+func TestDaysSinceEpoch(t *testing.T) {
+	specs := []struct {
+		year, month, day int64
+		exp              int64
+	}{
+		{1970, 1, 1, 0},
+		{1969, 12, 31, -1},
+		{2000, 1, 1, 10957},
+		{2000, 2, 29, 11016},
+		{2000, 3, 1, 11017},
+		{2024, 2, 29, 19782},
+		{2038, 1, 19, 24855},
+		{2100, 3, 1, 47541},
+	}
+
+	for specIndex, spec := range specs {
+		if got := daysSinceEpoch(spec.year, spec.month, spec.day); got != spec.exp {
+			t.Errorf("[spec %d] expected %04d-%02d-%02d to be %d days after the epoch; got %d", specIndex, spec.year, spec.month, spec.day, spec.exp, got)
+		}
+	}
+}
+
+func TestReadRTC(t *testing.T) {
+	specs := []struct {
+		statusB                                   uint8
+		year, month, day, hours, minutes, seconds uint8
+		exp                                       time.Time
+	}{
+		// binary, 24-hour mode
+		{rtcBinaryMode | rtc24HourMode, 21, 7, 4, 13, 45, 30, time.Date(2021, 7, 4, 13, 45, 30, 0, time.UTC)},
+		// BCD, 24-hour mode
+		{rtc24HourMode, 0x21, 0x07, 0x04, 0x13, 0x45, 0x30, time.Date(2021, 7, 4, 13, 45, 30, 0, time.UTC)},
+		// BCD, 12-hour mode
+		{0, 0x24, 0x02, 0x29, rtcHourPM | 0x01, 0x45, 0x30, time.Date(2024, 2, 29, 13, 45, 30, 0, time.UTC)},
+		{0, 0x24, 0x02, 0x29, 0x12, 0x00, 0x00, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{0, 0x24, 0x02, 0x29, rtcHourPM | 0x12, 0x00, 0x00, time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{0, 0x24, 0x02, 0x29, 0x11, 0x59, 0x59, time.Date(2024, 2, 29, 11, 59, 59, 0, time.UTC)},
+		// binary, 12-hour mode
+		{rtcBinaryMode, 0, 1, 1, rtcHourPM | 11, 59, 59, time.Date(2000, 1, 1, 23, 59, 59, 0, time.UTC)},
+	}
+
+	var regs [128]uint8
+	defer mockCMOS(&regs)()
+
+	for specIndex, spec := range specs {
+		regs[rtcStatusB] = spec.statusB
+		regs[rtcYear], regs[rtcMonth], regs[rtcDay] = spec.year, spec.month, spec.day
+		regs[rtcHours], regs[rtcMinutes], regs[rtcSeconds] = spec.hours, spec.minutes, spec.seconds
+
+		if got, exp := readRTC(), spec.exp.UnixNano(); got != exp {
+			t.Errorf("[spec %d] expected readRTC to return %d (%s); got %d (%s)", specIndex, exp, spec.exp, got, time.Unix(0, got).UTC())
+		}
+	}
+}
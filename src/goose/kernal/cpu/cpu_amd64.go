@@ -13,6 +13,10 @@ func DisableInterrupts()
 // Halt stops instruction execution.
 func Halt()
 
+// WaitForInterrupt enables interrupt handling and stops instruction execution
+// until the next interrupt arrives.
+func WaitForInterrupt()
+
 // FlushTLBEntry flushes a TLB entry for a particular virtual address.
 func FlushTLBEntry(virtAddr uintptr)
 
@@ -20,9 +24,26 @@ func FlushTLBEntry(virtAddr uintptr)
 // physical address and flushes the TLB.
 func SwitchPDT(pdtPhysAddr uintptr)
 
+// FlushTLB reloads the CR3 register which flushes all TLB entries that are not
+// flagged as global and belong to the active process context identifier.
+func FlushTLB()
+
 // ActivePDT returns the physical address of the currently active page table.
+// The process context identifier bits of the CR3 register are masked out.
 func ActivePDT() uintptr
 
+// ReadCR0 returns the value stored in the CR0 register.
+func ReadCR0() uint64
+
+// WriteCR0 stores the supplied value to the CR0 register.
+func WriteCR0(value uint64)
+
+// ReadCR4 returns the value stored in the CR4 register.
+func ReadCR4() uint64
+
+// WriteCR4 stores the supplied value to the CR4 register.
+func WriteCR4(value uint64)
+
 // ReadCR2 returns the value stored in the CR2 register.
 func ReadCR2() uint64
 
@@ -39,6 +60,98 @@ func IsIntel() bool {
 		ecx == 0x6c65746e // "ntel"
 }
 
+// Has1GPages returns true if the CPU supports mapping 1Gb pages.
+func Has1GPages() bool {
+	if maxLeaf, _, _, _ := cpuidFn(0x80000000); maxLeaf < 0x80000001 {
+		return false
+	}
+
+	_, _, _, edx := cpuidFn(0x80000001)
+	return edx&(1<<26) != 0
+}
+
+// HasNX returns true if the CPU supports the no-execute page protection
+// feature.
+func HasNX() bool {
+	if maxLeaf, _, _, _ := cpuidFn(0x80000000); maxLeaf < 0x80000001 {
+		return false
+	}
+
+	_, _, _, edx := cpuidFn(0x80000001)
+	return edx&(1<<20) != 0
+}
+
+// HasPAT returns true if the CPU supports the page attribute table.
+func HasPAT() bool {
+	_, _, _, edx := cpuidFn(1)
+	return edx&(1<<16) != 0
+}
+
+// HasPCID returns true if the CPU supports process context identifiers.
+func HasPCID() bool {
+	_, _, ecx, _ := cpuidFn(1)
+	return ecx&(1<<17) != 0
+}
+
+// HasGlobalPages returns true if the CPU supports global pages.
+func HasGlobalPages() bool {
+	_, _, _, edx := cpuidFn(1)
+	return edx&(1<<13) != 0
+}
+
+// HasTSC returns true if the CPU provides a time stamp counter.
+func HasTSC() bool {
+	_, _, _, edx := cpuidFn(1)
+	return edx&(1<<4) != 0
+}
+
+// HasInvariantTSC returns true if the time stamp counter runs at a constant
+// rate regardless of the CPU power and frequency state.
+func HasInvariantTSC() bool {
+	if maxLeaf, _, _, _ := cpuidFn(0x80000000); maxLeaf < 0x80000007 {
+		return false
+	}
+
+	_, _, _, edx := cpuidFn(0x80000007)
+	return edx&(1<<8) != 0
+}
+
+// HasRDRAND returns true if the CPU supports the RDRAND instruction.
+func HasRDRAND() bool {
+	_, _, ecx, _ := cpuidFn(1)
+	return ecx&(1<<30) != 0
+}
+
+// HasRDSEED returns true if the CPU supports the RDSEED instruction.
+func HasRDSEED() bool {
+	if maxLeaf, _, _, _ := cpuidFn(0); maxLeaf < 7 {
+		return false
+	}
+
+	_, ebx, _, _ := cpuidFn(7)
+	return ebx&(1<<18) != 0
+}
+
+// ReadRandom returns a random value generated by the CPU's RDRAND
+// instruction. The returned bool is false if the CPU could not generate a
+// random value; callers should retry in that case.
+func ReadRandom() (uint64, bool)
+
+// ReadRandomSeed returns a random value generated by the CPU's RDSEED
+// instruction which is suitable for seeding a random number generator. The
+// returned bool is false if not enough entropy was available; callers should
+// retry in that case.
+func ReadRandomSeed() (uint64, bool)
+
+// ReadTSC returns the current value of the time stamp counter.
+func ReadTSC() uint64
+
+// ReadMSR returns the value of the specified model-specific register.
+func ReadMSR(msr uint32) uint64
+
+// WriteMSR writes a value to the specified model-specific register.
+func WriteMSR(msr uint32, value uint64)
+
 // PortWriteByte writes a uint8 value to the requested port.
 func PortWriteByte(port uint16, val uint8)
 
@@ -13,6 +13,13 @@ TEXT ·Halt(SB),NOSPLIT,$0
 	HLT
 	RET
 
+TEXT ·WaitForInterrupt(SB),NOSPLIT,$0
+	// STI delays the recognition of interrupts until after the next
+	// instruction so no interrupt can be lost between the two
+	STI
+	HLT
+	RET
+
 TEXT ·FlushTLBEntry(SB),NOSPLIT,$0
 	MOVQ virtAddr+0(FP), AX
 	INVLPG (AX)
@@ -24,23 +31,50 @@ TEXT ·SwitchPDT(SB),NOSPLIT,$0
 	MOVQ AX, CR3
 	RET
 
+TEXT ·FlushTLB(SB),NOSPLIT,$0
+	MOVQ CR3, AX
+	MOVQ AX, CR3
+	RET
+
 TEXT ·ActivePDT(SB),NOSPLIT,$0
 	MOVQ CR3, AX
+	ANDQ $~0xfff, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·ReadCR0(SB),NOSPLIT,$0
+	MOVQ CR0, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·WriteCR0(SB),NOSPLIT,$0
+	MOVQ value+0(FP), AX
+	MOVQ AX, CR0
+	RET
+
+TEXT ·ReadCR4(SB),NOSPLIT,$0
+	MOVQ CR4, AX
 	MOVQ AX, ret+0(FP)
 	RET
 
+TEXT ·WriteCR4(SB),NOSPLIT,$0
+	MOVQ value+0(FP), AX
+	MOVQ AX, CR4
+	RET
+
 TEXT ·ReadCR2(SB),NOSPLIT,$0
 	MOVQ CR2, AX
 	MOVQ AX, ret+0(FP)
 	RET
 
 TEXT ·ID(SB),NOSPLIT,$0
-	MOVQ leaf+0(FP), AX
+	MOVL leaf+0(FP), AX
+	XORL CX, CX
 	CPUID
-	MOVL AX, ret+0(FP)
-	MOVL BX, ret+4(FP)
-	MOVL CX, ret+8(FP)
-	MOVL DX, ret+12(FP)
+	MOVL AX, ret+8(FP)
+	MOVL BX, ret1+12(FP)
+	MOVL CX, ret2+16(FP)
+	MOVL DX, ret3+20(FP)
 	RET
 
 TEXT ·PortWriteByte(SB),NOSPLIT,$0
@@ -58,25 +92,64 @@ TEXT ·PortWriteWord(SB),NOSPLIT,$0
 
 TEXT ·PortWriteDword(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
-	MOVL val+2(FP), AX
+	MOVL val+4(FP), AX
 	BYTE $0xef  // out eax, dx
 	RET
 
 TEXT ·PortReadByte(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0xec  // in al, dx
-	MOVB AX, ret+0(FP)
+	MOVB AX, ret+8(FP)
 	RET
 
 TEXT ·PortReadWord(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0x66  
 	BYTE $0xed  // in ax, dx
-	MOVW AX, ret+0(FP)
+	MOVW AX, ret+8(FP)
 	RET
 
 TEXT ·PortReadDword(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0xed  // in eax, dx
-	MOVL AX, ret+0(FP)
+	MOVL AX, ret+8(FP)
+	RET
+
+TEXT ·ReadMSR(SB),NOSPLIT,$0
+	MOVL msr+0(FP), CX
+	RDMSR
+	SHLQ $32, DX
+	ORQ DX, AX
+	MOVQ AX, ret+8(FP)
+	RET
+
+TEXT ·WriteMSR(SB),NOSPLIT,$0
+	MOVL msr+0(FP), CX
+	MOVQ value+8(FP), AX
+	MOVQ AX, DX
+	SHRQ $32, DX
+	WRMSR
+	RET
+
+TEXT ·ReadTSC(SB),NOSPLIT,$0
+	// Prevent RDTSC from being executed before preceding instructions
+	LFENCE
+	RDTSC
+	SHLQ $32, DX
+	ORQ DX, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·ReadRandom(SB),NOSPLIT,$0
+	// rdrand rax
+	BYTE $0x48; BYTE $0x0f; BYTE $0xc7; BYTE $0xf0
+	MOVQ AX, ret+0(FP)
+	SETCS ret1+8(FP)
+	RET
+
+TEXT ·ReadRandomSeed(SB),NOSPLIT,$0
+	// rdseed rax
+	BYTE $0x48; BYTE $0x0f; BYTE $0xc7; BYTE $0xf8
+	MOVQ AX, ret+0(FP)
+	SETCS ret1+8(FP)
 	RET
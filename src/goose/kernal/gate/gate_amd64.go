@@ -3,6 +3,7 @@ package gate
 import (
 	"goose/kernel/kfmt"
 	"io"
+	"unsafe"
 )
 
 // Registers contains a snapshot of all register values when an exception,
@@ -129,9 +130,12 @@ const (
 )
 
 // Init runs the appropriate CPU-specific initialization code for enabling
-// support for interrupt handling.
+// support for interrupt handling. This includes loading a task state segment
+// so that interrupt handlers can be configured to run on a dedicated stack
+// via SetInterruptStack.
 func Init() {
 	installIDT()
+	installTSS()
 }
 
 // HandleInterrupt ensures that the provided handler will be invoked when a
@@ -140,6 +144,23 @@ func Init() {
 // used).
 func HandleInterrupt(intNumber InterruptNumber, istOffset uint8, handler func(*Registers))
 
+// SetInterruptContext registers the runtime g struct (gp) and the top address
+// of the stack that the interrupt handlers run on. Before invoking a handler,
+// the interrupt dispatcher stores gp in the TLS slot for the current g and
+// switches to the stack so that handlers never run on the stack of the code
+// they interrupted. The stack must be large enough for the handlers as it
+// cannot grow. Interrupts that occur while a handler runs (e.g. page faults)
+// keep using the same g and stack.
+//
+// Until SetInterruptContext is invoked, handlers run on the interrupted stack.
+func SetInterruptContext(gp unsafe.Pointer, stackTop uintptr)
+
+// InterruptedG returns the runtime g struct that was active when the CPU
+// started servicing the interrupt that is currently being handled. It must
+// only be invoked by interrupt handlers after SetInterruptContext has been
+// called.
+func InterruptedG() unsafe.Pointer
+
 // installIDT populates idtDescriptor with the address of IDT and loads it to
 // the CPU. All gate entries are initially marked as non-present and must be
 // explicitly enabled via a call to install{Trap,IRQ,Task}Handler.
@@ -28,6 +28,14 @@ GLOBL ·idt<>(SB), NOPTR, $NUM_IDT_ENTRIES*IDT_ENTRY_SIZE
 // serve as the jump targets for the trap/int/task dispatchers.
 GLOBL ·gateHandlers<>(SB), NOPTR, $NUM_IDT_ENTRIES*8
 
+// The g struct and the top of the stack that dispatchInterrupt switches to
+// before invoking a handler. Both are registered via SetInterruptContext.
+GLOBL ·interruptG<>(SB), NOPTR, $8
+GLOBL ·interruptStackTop<>(SB), NOPTR, $8
+
+// The g that was active when the CPU started servicing an interrupt. 
+GLOBL ·interruptedG<>(SB), NOPTR, $8
+
 // installIDT populates idtDescriptor with the address of IDT and loads it to 
 // the CPU. All gate entries are initially marked as non-present and must be 
 // explicitly enabled by invoking HandleInterrupt.
@@ -110,6 +118,27 @@ update_idt_entry:
 
 	RET
 
+// SetInterruptContext registers the g struct and the stack that are used for
+// running interrupt handlers. Both values are updated while interrupts are
+// disabled so that dispatchInterrupt never observes just one of them.
+TEXT ·SetInterruptContext(SB),NOSPLIT,$0-16
+	MOVQ gp+0(FP), AX
+	MOVQ stackTop+8(FP), BX
+
+	PUSHFQ
+	CLI
+	MOVQ AX, ·interruptG<>(SB)
+	MOVQ BX, ·interruptStackTop<>(SB)
+	POPFQ
+	RET
+
+// InterruptedG returns the g that was active when the CPU started servicing
+// the interrupt that is currently being handled.
+TEXT ·InterruptedG(SB),NOSPLIT,$0-8
+	MOVQ ·interruptedG<>(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
+
 // Emit interrupt dispatching code for traps where the CPU pushes an exception
 // code to the stack. The code below just pushes the handler's address to the
 // stack and jumps to dispatchInterrupt. 
@@ -170,7 +199,8 @@ update_idt_entry:
 //
 // Once the handler returns, the GP regs are restored and the stack is unwinded
 // so that the CPU can resume excecution of the code that triggered the
-// interrupt.
+// interrupt. The handler runs on the g and stack registered via
+// SetInterruptContext.
 //
 // Interrupts are automatically disabled by the CPU upon entry and re-enabled
 // when this function returns.
@@ -217,13 +247,46 @@ TEXT ·dispatchInterrupt(SB),NOSPLIT,$0
 	MOVOU X14, 14*16(SP)
 	MOVOU X15, 15*16(SP)
 
-	// Setup call stack and invoke handler 
+	// R14 points to the saved registers that are passed to the handler
 	MOVQ SP, R14
 	ADDQ $16*16, R14
+
+	// The handler is ordinary Go code that must not run on the (small and
+	// growable) stack of the interrupted goroutine as the runtime cannot
+	// unwind through the interrupt frame when it grows the stack. If an
+	// interrupt context has been registered, switch to its g and stack
+	// unless the interrupt occurred while already running on them (e.g. a
+	// page fault raised by another handler).
+	MOVQ ·interruptG<>(SB), BX
+	TESTQ BX, BX
+	JZ call_handler
+	MOVQ (TLS), AX
+	CMPQ AX, BX
+	JEQ call_handler
+
+	MOVQ AX, ·interruptedG<>(SB)
+	MOVQ BX, (TLS)
+	MOVQ SP, DX
+	MOVQ ·interruptStackTop<>(SB), SP
+	PUSHQ DX
+
 	PUSHQ R14
 	CALL R15
 	ADDQ $8, SP
 
+	// Switch back to the interrupted g and its stack
+	POPQ DX
+	MOVQ DX, SP
+	MOVQ ·interruptedG<>(SB), AX
+	MOVQ AX, (TLS)
+	JMP restore_xmm
+
+call_handler:
+	PUSHQ R14
+	CALL R15
+	ADDQ $8, SP
+
+restore_xmm:
 	// Restore XMM regs
 	MOVOU 0*16(SP), X0
 	MOVOU 1*16(SP), X1
@@ -298,3 +361,22 @@ TEXT ·interruptGateEntries(SB),NOSPLIT,$0
 	INT_ENTRY_WITHOUT_CODE(235) INT_ENTRY_WITHOUT_CODE(236) INT_ENTRY_WITHOUT_CODE(237) INT_ENTRY_WITHOUT_CODE(238) INT_ENTRY_WITHOUT_CODE(239) INT_ENTRY_WITHOUT_CODE(240) INT_ENTRY_WITHOUT_CODE(241) INT_ENTRY_WITHOUT_CODE(242) INT_ENTRY_WITHOUT_CODE(243) INT_ENTRY_WITHOUT_CODE(244) INT_ENTRY_WITHOUT_CODE(245) INT_ENTRY_WITHOUT_CODE(246)
 	INT_ENTRY_WITHOUT_CODE(247) INT_ENTRY_WITHOUT_CODE(248) INT_ENTRY_WITHOUT_CODE(249) INT_ENTRY_WITHOUT_CODE(250) INT_ENTRY_WITHOUT_CODE(251) INT_ENTRY_WITHOUT_CODE(252) INT_ENTRY_WITHOUT_CODE(253) INT_ENTRY_WITHOUT_CODE(254) INT_ENTRY_WITHOUT_CODE(255)
 	RET
+
+// The 64-bit GDT descriptor has the same layout as idtDescriptor.
+GLOBL ·gdtDescriptor<>(SB), NOPTR, $10
+
+// loadGDT loads the GDT located at gdtAddr into the CPU.
+TEXT ·loadGDT(SB),NOSPLIT,$0-10
+	LEAQ ·gdtDescriptor<>(SB), AX
+	MOVW limit+8(FP), BX
+	MOVW BX, 0(AX)
+	MOVQ gdtAddr+0(FP), BX
+	MOVQ BX, 2(AX)
+	MOVQ 0(AX), GDTR 	// LGDT[RAX]
+	RET
+
+// loadTaskRegister loads the supplied TSS selector into the task register.
+TEXT ·loadTaskRegister(SB),NOSPLIT,$0-2
+	MOVW selector+0(FP), AX
+	BYTE $0x0f; BYTE $0x00; BYTE $0xd8 // LTR AX
+	RET
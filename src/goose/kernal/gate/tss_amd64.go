@@ -0,0 +1,91 @@
+package gate
+
+import "unsafe"
+
+const (
+	// The GDT layout installed by installTSS. The code and data segments
+	// match the ones set up by the rt0 code so the selectors that are
+	// already loaded in the segment registers remain valid.
+	gdtNullSegIndex = iota
+	gdtCodeSegIndex
+	gdtDataSegIndex
+	gdtTSSLowIndex
+	gdtTSSHighIndex
+	gdtEntryCount
+
+	// tssSelector is the GDT selector for the TSS descriptor.
+	tssSelector = gdtTSSLowIndex << 3
+
+	// The byte offsets of the fields inside the 64-bit TSS that are
+	// populated by the kernel.
+	tssIST1Offset      = 0x24
+	tssIOMapBaseOffset = 0x66
+
+	// tssSize is the size of the 64-bit TSS in bytes.
+	tssSize = 0x68
+
+	// MaxInterruptStacks is the number of interrupt stack table slots
+	// supported by the CPU.
+	MaxInterruptStacks = 7
+)
+
+var (
+	// gdt contains the kernel segment descriptors and the 16-byte TSS
+	// descriptor.
+	gdt [gdtEntryCount]uint64
+
+	// tss is the 64-bit task state segment. It is used by the CPU for
+	// looking up the interrupt stack table (IST) entries. As the TSS
+	// layout contains unaligned 64-bit fields it is defined as an array
+	// of 32-bit words.
+	tss [tssSize / 4]uint32
+)
+
+// SetInterruptStack registers the top address of the stack that the CPU
+// should switch to when an interrupt handler that was installed with the
+// specified istOffset via HandleInterrupt gets invoked. Valid istOffset values
+// are in the range [1, MaxInterruptStacks]; calls with any other value are
+// ignored.
+func SetInterruptStack(istOffset uint8, stackTop uintptr) {
+	if istOffset == 0 || istOffset > MaxInterruptStacks {
+		return
+	}
+
+	// The CPU expects the stack pointer to be 16-byte aligned
+	stackTop &^= 15
+	index := (tssIST1Offset + uintptr(istOffset-1)*8) >> 2
+	tss[index] = uint32(stackTop)
+	tss[index+1] = uint32(stackTop >> 32)
+}
+
+// installTSS installs a new GDT that contains a descriptor for the kernel TSS
+// and loads the TSS selector into the task register.
+func installTSS() {
+	tssAddr := uint64(uintptr(unsafe.Pointer(&tss[0])))
+	tssLimit := uint64(tssSize - 1)
+
+	// Setting the I/O map base past the end of the TSS disables the I/O
+	// permission bitmap.
+	tss[tssIOMapBaseOffset>>2] = tssSize << 16
+
+	gdt[gdtNullSegIndex] = 0
+	gdt[gdtCodeSegIndex] = 0x9a<<40 | 0x20<<48 // present, exec/read, long mode
+	gdt[gdtDataSegIndex] = 0x92 << 40          // present, read/write
+
+	// A 64-bit TSS descriptor occupies two GDT slots
+	gdt[gdtTSSLowIndex] = tssLimit&0xffff |
+		(tssAddr&0xffffff)<<16 |
+		0x89<<40 | // present, available 64-bit TSS
+		(tssLimit>>16&0xf)<<48 |
+		(tssAddr>>24&0xff)<<56
+	gdt[gdtTSSHighIndex] = tssAddr >> 32
+
+	loadGDT(uintptr(unsafe.Pointer(&gdt[0])), uint16(gdtEntryCount*8-1))
+	loadTaskRegister(tssSelector)
+}
+
+// loadGDT loads the GDT located at gdtAddr into the CPU.
+func loadGDT(gdtAddr uintptr, limit uint16)
+
+// loadTaskRegister loads the supplied TSS selector into the task register.
+func loadTaskRegister(selector uint16)
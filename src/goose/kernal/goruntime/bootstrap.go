@@ -4,25 +4,27 @@ package goruntime
 
 import (
 	"goose/kernel"
+	"goose/kernel/clock"
 	"goose/kernel/mm"
 	"goose/kernel/mm/vmm"
+	"goose/kernel/rand"
 	"unsafe"
 )
 
 var (
-	mapFn                = vmm.Map
-	earlyReserveRegionFn = vmm.EarlyReserveRegion
-	memsetFn             = kernel.Memset
-	mallocInitFn         = mallocInit
-	algInitFn            = algInit
-	modulesInitFn        = modulesInit
-	typeLinksInitFn      = typeLinksInit
-	itabsInitFn          = itabsInit
-	initGoPackagesFn     = initGoPackages
-	procResizeFn         = procResize
-
-	// A seed for the pseudo-random number generator used by getRandomData
-	prngSeed = 0x0badc0de
+	errUnsupportedGoVersion = &kernel.Error{Module: "goruntime", Message: "the kernel must be built using Go 1.9 or Go 1.10"}
+
+	mapFn            = vmm.Map
+	reserveRegionFn  = vmm.ReserveRegion
+	memsetFn         = kernel.Memset
+	mallocInitFn     = mallocInit
+	algInitFn        = algInit
+	modulesInitFn    = modulesInit
+	typeLinksInitFn  = typeLinksInit
+	itabsInitFn      = itabsInit
+	initGoPackagesFn = initGoPackages
+	procResizeFn     = procResize
+	randReadFn       = rand.Read
 )
 
 // initGoPackages is an alias to main.init which recursively calls the init()
@@ -52,7 +54,7 @@ func runtimeInit() {
 //go:nosplit
 func sysReserve(_ unsafe.Pointer, size uintptr, reserved *bool) unsafe.Pointer {
 	regionSize := (size + mm.PageSize - 1) & ^(mm.PageSize - 1)
-	regionStartAddr, err := earlyReserveRegionFn(regionSize)
+	regionStartAddr, err := reserveRegionFn(regionSize)
 	if err != nil {
 		panic(err)
 	}
@@ -101,7 +103,7 @@ func sysMap(virtAddr unsafe.Pointer, size uintptr, reserved bool, sysStat *uint6
 //go:nosplit
 func sysAlloc(size uintptr, sysStat *uint64) unsafe.Pointer {
 	regionSize := (size + mm.PageSize - 1) & ^(mm.PageSize - 1)
-	regionStartAddr, err := earlyReserveRegionFn(regionSize)
+	regionStartAddr, err := reserveRegionFn(regionSize)
 	if err != nil {
 		return unsafe.Pointer(uintptr(0))
 	}
@@ -125,32 +127,41 @@ func sysAlloc(size uintptr, sysStat *uint64) unsafe.Pointer {
 	return unsafe.Pointer(regionStartAddr)
 }
 
-// nanotime returns a monotonically increasing clock value. This is a dummy
-// implementation and will be replaced when the timekeeper package is
-// implemented.
+// nanotime returns a monotonically increasing clock value in nanoseconds.
 //
 // This function replaces runtime.nanotime and is invoked by the Go allocator
 // when a span allocation is performed.
 //
 //go:redirect-from runtime.nanotime
+//go:noinline
 //go:nosplit
 func nanotime() uint64 {
-	// Use a dummy loop to prevent the compiler from inlining this function.
-	for i := 0; i < 100; i++ {
-	}
-	return 1
+	return clock.Nanotime()
+}
+
+// walltime returns the number of seconds and nanoseconds elapsed since the
+// Unix epoch.
+//
+// This function replaces runtime.walltime which is used by the time package
+// for obtaining the current time.
+//
+//go:redirect-from runtime.walltime
+//go:noinline
+//go:nosplit
+func walltime() (int64, int32) {
+	return clock.Walltime()
 }
 
-// getRandomData populates the given slice with random data. The implementation
-// is the runtime package reads a random stream from /dev/random but since this
-// is not available, we use a prng instead.
+// getRandomData populates the given slice with random data. The runtime
+// implementation reads a random stream from /dev/urandom; the kernel uses its
+// own random number generator instead.
+//
+// This function replaces runtime.getRandomData and is invoked by the Go
+// runtime when seeding its hash functions.
 //
 //go:redirect-from runtime.getRandomData
 func getRandomData(r []byte) {
-	for i := 0; i < len(r); i++ {
-		prngSeed = (prngSeed * 58321) + 11113
-		r[i] = byte((prngSeed >> 16) & 255)
-	}
+	randReadFn(r)
 }
 
 // Init enables support for various Go runtime features. After a call to init
@@ -159,6 +170,12 @@ func getRandomData(r []byte) {
 //  - map primitives
 //  - interfaces
 func Init() *kernel.Error {
+	// The redirected runtime functions mirror the internals of specific
+	// Go runtime versions
+	if !goVersionSupported {
+		return errUnsupportedGoVersion
+	}
+
 	mallocInitFn()
 	algInitFn()       // setup hash implementation for map keys
 	modulesInitFn()   // provides activeModules (go 1.8+)
@@ -194,4 +211,5 @@ func init() {
 	sysAlloc(0, &stat)
 	getRandomData(nil)
 	stat = nanotime()
+	walltime()
 }
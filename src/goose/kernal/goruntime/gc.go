@@ -0,0 +1,245 @@
+package goruntime
+
+import (
+	"goose/kernel"
+	"goose/kernel/kfmt"
+	"goose/kernel/mm"
+	"goose/kernel/mm/pmm"
+	"goose/kernel/mm/vmm"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	// The GC self-test allocates gcSelfTestBlocks blocks of
+	// gcSelfTestBlockSize bytes each.
+	gcSelfTestBlocks    = 32
+	gcSelfTestBlockSize = 1 << 20
+
+	// gcSelfTestMaxRegrowPercent is the maximum percentage of the frames
+	// allocated by the GC self-test that may be requested from pmm again
+	// when the allocations are repeated after a call to runtime.GC.
+	gcSelfTestMaxRegrowPercent = 10
+
+	// gcSelfTestMinReturnPercent is the minimum percentage of the frames
+	// allocated by the GC self-test that must be returned to pmm.
+	gcSelfTestMinReturnPercent = 90
+)
+
+var (
+	errGCSelfTestNoAlloc  = &kernel.Error{Module: "goruntime", Message: "GC self-test allocations did not consume any physical frames"}
+	errGCSelfTestNoReuse  = &kernel.Error{Module: "goruntime", Message: "GC self-test: the Go heap did not reuse the memory released by runtime.GC"}
+	errGCSelfTestNoReturn = &kernel.Error{Module: "goruntime", Message: "GC self-test: the Go heap did not return enough frames to pmm"}
+
+	unmapAndFreeFn = vmm.UnmapAndFree
+	remapFn        = vmm.Remap
+	freeFrameFn    = mm.FreeFrame
+	translateFn    = vmm.Translate
+	beginMapTxFn   = vmm.BeginMapTransaction
+	commitMapTxFn  = vmm.CommitMapTransaction
+	gcenableFn     = gcenable
+	gcFn           = runtime.GC
+	freeOSMemoryFn = freeOSMemory
+	memStatsFn     = pmm.Stats
+
+	// gcSelfTestData holds the blocks allocated by the GC self-test. It is
+	// a global so that the compiler cannot prove that the blocks are
+	// unused and optimize the allocations away.
+	gcSelfTestData [][]byte
+)
+
+// gcenable is an alias to runtime.gcenable which starts the background
+// sweeper goroutine and enables the garbage collector. It must be invoked by
+// a goroutine as it blocks until the sweeper is running.
+//go:linkname gcenable runtime.gcenable
+func gcenable()
+
+// freeOSMemory is an alias to runtime/debug.FreeOSMemory which forces a
+// garbage collection and returns as much memory as possible to the OS.
+//go:linkname freeOSMemory runtime/debug.freeOSMemory
+func freeOSMemory()
+
+// mSysStatDec is an alias to runtime.mSysStatDec which updates the runtime
+// memory statistics after memory is released.
+//go:linkname mSysStatDec runtime.mSysStatDec
+func mSysStatDec(sysStat *uint64, n uintptr)
+
+// sysUnused notifies the kernel that the contents of the supplied memory
+// region are no longer needed. The physical frames backing the region are
+// returned to the frame allocator and the region is mapped to the reserved
+// zeroed frame using copy-on-write, mirroring the mappings set up by sysMap.
+// The region remains accessible; a new frame is allocated on the next write.
+// Each page is switched to the zeroed frame before its frame is released so
+// pages that cannot be switched keep their original frame.
+//
+// This function replaces runtime.sysUnused and is invoked when the Go
+// allocator scavenges free spans.
+//
+//go:redirect-from runtime.sysUnused
+//go:nosplit
+func sysUnused(virtAddr unsafe.Pointer, size uintptr) {
+	mapFlags := vmm.FlagPresent | vmm.FlagNoExecute | vmm.FlagCopyOnWrite
+	startPage, endPage := regionPages(virtAddr, size)
+
+	for page := startPage; page < endPage; page++ {
+		physAddr, err := translateFn(page.Address())
+		if err != nil || physAddr == vmm.ReservedZeroedFrame.Address() {
+			continue
+		}
+
+		// Remap flushes the stale TLB entry so the frame can be
+		// released right away
+		if remapFn(page, vmm.ReservedZeroedFrame, mapFlags) != nil {
+			continue
+		}
+		_ = freeFrameFn(mm.FrameFromAddress(physAddr))
+	}
+}
+
+// sysUsed notifies the kernel that a memory region previously released via
+// sysUnused is about to be used again. As sysUnused keeps the region mapped
+// using copy-on-write, frames are allocated on demand and no action is
+// required.
+//
+// This function replaces runtime.sysUsed.
+//
+//go:redirect-from runtime.sysUsed
+//go:nosplit
+func sysUsed(_ unsafe.Pointer, _ uintptr) {
+}
+
+// sysFree unmaps the supplied memory region and returns the physical frames
+// that back it to the frame allocator. The virtual address range remains
+// reserved as the runtime may release a subset of a region returned by
+// sysAlloc.
+//
+// This function replaces runtime.sysFree.
+//
+//go:redirect-from runtime.sysFree
+//go:nosplit
+func sysFree(virtAddr unsafe.Pointer, size uintptr, sysStat *uint64) {
+	unmapRegionPages(virtAddr, size)
+	mSysStatDec(sysStat, size)
+}
+
+// sysFault unmaps the supplied memory region and returns the physical frames
+// that back it to the frame allocator so that any further access to the
+// region triggers a page fault. The runtime only uses it for debugging.
+//
+// This function replaces runtime.sysFault.
+//
+//go:redirect-from runtime.sysFault
+//go:nosplit
+func sysFault(virtAddr unsafe.Pointer, size uintptr) {
+	unmapRegionPages(virtAddr, size)
+}
+
+// unmapRegionPages unmaps all mapped pages in the supplied region and
+// releases the frames that back them.
+//
+//go:nosplit
+func unmapRegionPages(virtAddr unsafe.Pointer, size uintptr) {
+	startPage, endPage := regionPages(virtAddr, size)
+
+	beginMapTxFn()
+	for page := startPage; page < endPage; page++ {
+		if _, err := translateFn(page.Address()); err == nil {
+			_ = unmapAndFreeFn(page)
+		}
+	}
+	_ = commitMapTxFn()
+}
+
+// regionPages returns the range of pages that are fully covered by the
+// supplied memory region.
+//
+//go:nosplit
+func regionPages(virtAddr unsafe.Pointer, size uintptr) (mm.Page, mm.Page) {
+	startAddr := (uintptr(virtAddr) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+	endAddr := (uintptr(virtAddr) + size) &^ (mm.PageSize - 1)
+	if endAddr < startAddr {
+		endAddr = startAddr
+	}
+
+	return mm.PageFromAddress(startAddr), mm.PageFromAddress(endAddr)
+}
+
+// GCSelfTest verifies that the memory released by the garbage collector is
+// reused by the Go heap and can be returned to the physical frame allocator.
+// It allocates and touches a large number of heap blocks, drops all
+// references to them and then checks both GC paths:
+//  - after a call to runtime.GC, repeating the allocations must not request
+//    more than gcSelfTestMaxRegrowPercent percent of the frames from pmm
+//    again as the heap reuses the released blocks.
+//  - after a call to runtime/debug.FreeOSMemory which also scavenges the Go
+//    heap, at least gcSelfTestMinReturnPercent percent of the frames consumed
+//    by the allocations must be returned to pmm.
+func GCSelfTest() *kernel.Error {
+	freeOSMemoryFn()
+	freeBefore := memStatsFn().FreeFrames
+
+	gcSelfTestAlloc()
+	freeAllocated := memStatsFn().FreeFrames
+	if freeAllocated >= freeBefore {
+		gcSelfTestData = nil
+		return errGCSelfTestNoAlloc
+	}
+	allocated := freeBefore - freeAllocated
+
+	gcSelfTestData = nil
+	gcFn()
+	gcSelfTestAlloc()
+	freeReallocated := memStatsFn().FreeFrames
+
+	var regrown uint32
+	if freeReallocated < freeAllocated {
+		regrown = freeAllocated - freeReallocated
+	}
+
+	gcSelfTestData = nil
+	freeOSMemoryFn()
+	freeAfter := memStatsFn().FreeFrames
+
+	var returned uint32
+	if freeAfter > freeReallocated {
+		returned = freeAfter - freeReallocated
+	}
+
+	kfmt.Printf("[goruntime] GC self-test: %d frames allocated, %d frames reallocated after GC, %d frames returned\n", allocated, regrown, returned)
+	if uint64(regrown)*100 > uint64(allocated)*gcSelfTestMaxRegrowPercent {
+		return errGCSelfTestNoReuse
+	}
+
+	if uint64(returned)*100 < uint64(allocated+regrown)*gcSelfTestMinReturnPercent {
+		return errGCSelfTestNoReturn
+	}
+
+	return nil
+}
+
+// gcSelfTestAlloc populates gcSelfTestData with gcSelfTestBlocks blocks and
+// touches each of their pages so that they are backed by physical frames.
+func gcSelfTestAlloc() {
+	gcSelfTestData = make([][]byte, gcSelfTestBlocks)
+	for index := range gcSelfTestData {
+		block := make([]byte, gcSelfTestBlockSize)
+
+		// Force the allocation of a frame for each page
+		for offset := 0; offset < len(block); offset += int(mm.PageSize) {
+			block[offset] = 1
+		}
+		gcSelfTestData[index] = block
+	}
+}
+
+func init() {
+	// Dummy calls so the compiler does not optimize away the functions in
+	// this file.
+	var stat uint64
+
+	zeroPtr := unsafe.Pointer(uintptr(0))
+	sysUnused(zeroPtr, 0)
+	sysUsed(zeroPtr, 0)
+	sysFree(zeroPtr, 0, &stat)
+	sysFault(zeroPtr, 0)
+}
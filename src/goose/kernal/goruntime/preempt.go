@@ -0,0 +1,85 @@
+package goruntime
+
+import (
+	"goose/kernel/gate"
+	_ "unsafe" // required by go:linkname
+)
+
+// stackPreempt mirrors the runtime constant which, when stored to the
+// stackguard0 field of a g, causes the next function prologue executed by the
+// goroutine to enter the runtime which then deschedules the goroutine.
+const stackPreempt = ^uintptr(1313)
+
+// g mirrors the layout of the leading fields of the runtime g struct
+// (runtime.g) up to the m field.
+type g struct {
+	stack       stack
+	stackguard0 uintptr
+	stackguard1 uintptr
+	_panic      uintptr
+	_defer      uintptr
+	m           *m
+}
+
+// m mirrors the layout of the leading fields of the runtime m struct
+// (runtime.m) up to the gsignal field.
+type m struct {
+	g0      *g
+	morebuf [7]uintptr
+	divmod  uint32
+	procid  uint64
+	gsignal *g
+}
+
+var interruptedGFn = gate.InterruptedG
+
+// getg returns the g of the running goroutine.
+func getg() *g
+
+// acquirem is an alias to runtime.acquirem which increments the lock count
+// of the current m. The runtime does not deschedule goroutines while the lock
+// count of their m is non-zero.
+//
+//go:linkname acquirem runtime.acquirem
+func acquirem() *m
+
+// releasem is an alias to runtime.releasem which decrements the lock count of
+// the current m.
+//
+//go:linkname releasem runtime.releasem
+func releasem(mp *m)
+
+// disablePreemption prevents the runtime from descheduling the running
+// goroutine until a matching call to enablePreemption. Calls may be nested.
+//
+// It is registered as a hook that is invoked when a spinlock is acquired.
+//
+//go:nosplit
+func disablePreemption() {
+	acquirem()
+}
+
+// enablePreemption reverts the effect of a call to disablePreemption.
+//
+//go:nosplit
+func enablePreemption() {
+	releasem(getg().m)
+}
+
+// requestPreemption asks the runtime to deschedule the goroutine that was
+// interrupted by the interrupt that is currently being handled the next time
+// it invokes a function. It must only be invoked by interrupt handlers. The
+// request is ignored if the interrupted code runs on the scheduler stack (g0).
+//
+// If preemption is disabled when the request is served, the runtime drops the
+// request and the goroutine keeps running until the next timer tick.
+//
+//go:nosplit
+func requestPreemption() {
+	gp := (*g)(interruptedGFn())
+	if gp == nil || gp == gp.m.g0 {
+		return
+	}
+
+	gp.stackguard0 = stackPreempt
+}
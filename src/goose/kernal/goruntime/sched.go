@@ -0,0 +1,224 @@
+package goruntime
+
+import (
+	"goose/kernel"
+	"goose/kernel/clock"
+	"goose/kernel/cpu"
+	"goose/kernel/gate"
+	"goose/kernel/kfmt"
+	"goose/kernel/sync"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+var (
+	errNoThreads = &kernel.Error{Module: "goruntime", Message: "the Go runtime requested a new OS thread; only a single thread is supported"}
+
+	setInterruptContextFn = gate.SetInterruptContext
+
+	mstart1Fn          = mstart1
+	goschedFn          = runtime.Gosched
+	nanotimeFn         = clock.Nanotime
+	waitForInterruptFn = cpu.WaitForInterrupt
+	setTickHookFn      = clock.SetTickHook
+)
+
+// interruptStackSize is the size of the stack that the interrupt handlers run
+// on. It matches the size of the signal stacks allocated by the runtime.
+const interruptStackSize = 32 * 1024
+
+// malg is an alias to runtime.malg which allocates a g struct together with a
+// stack of the requested size.
+//go:linkname malg runtime.malg
+func malg(stackSize int32) *g
+
+// mstart1 is an alias to runtime.mstart1 which saves the scheduling context
+// of g0 and enters the Go scheduler.
+//go:linkname mstart1 runtime.mstart1
+func mstart1()
+
+// StartScheduler starts the Go scheduler on the bootstrap (rt0) thread and
+// runs entry as the first goroutine. A goroutine runs until it blocks (e.g.
+// on a channel operation), invokes runtime.Gosched or gets preempted by the
+// PIT interrupt handler because a timer has expired. Preemption is disabled
+// while a goroutine holds a spinlock. The context switches are performed by
+// the runtime which saves and restores the goroutine registers in the g
+// structs set up by the rt0 code. Goroutine stacks are allocated by stackalloc
+// as vmm kernel stacks with guard pages while interrupt handlers run on a
+// dedicated g and stack (see setupInterruptContext).
+//
+// StartScheduler also starts the goroutine that services the runtime timers
+// (time.Sleep, time.Timer and time.Ticker) and enables the periodic timer
+// interrupts which wake up the CPU while it is halted and preempt the running
+// goroutine once a timer expires.
+//
+// StartScheduler must be invoked by the rt0 goroutine (g0) after a call to
+// Init and never returns. When no goroutine is runnable, the CPU is halted
+// until an interrupt occurs.
+func StartScheduler(entry func()) {
+	setupInterruptContext()
+	sync.SetPreemptionHooks(disablePreemption, enablePreemption)
+	setTickHookFn(timerTick)
+
+	go timerLoop()
+	go func() {
+		// gcenable starts the background sweeper goroutine and blocks
+		// until it is running so it needs to be invoked by a goroutine
+		gcenableFn()
+		entry()
+	}()
+
+	enableTicksFn()
+
+	// The runtime saves the g0 context and uses it for running the
+	// scheduler each time a goroutine blocks or yields. The kernel stack
+	// frames below this point are discarded.
+	mstart1Fn()
+}
+
+// setupInterruptContext allocates the g and the stack that the interrupt
+// handlers run on. The g is registered as the signal g of the bootstrap m; the
+// runtime treats code running on it like a signal handler. For example, the
+// runtime aborts instead of growing its stack and refuses to allocate memory
+// while it is active.
+func setupInterruptContext() {
+	gp := malg(interruptStackSize)
+	gp.m = getg().m
+	gp.m.gsignal = gp
+
+	setInterruptContextFn(unsafe.Pointer(gp), gp.stack.hi)
+}
+
+// minit initializes the OS-specific state of a new thread. The runtime
+// implementation sets up the signal stack and masks using system calls which
+// are not available to the kernel.
+//
+// This function replaces runtime.minit and is invoked by mstart1.
+//
+//go:redirect-from runtime.minit
+//go:nosplit
+func minit() {
+}
+
+// initsig installs the runtime signal handlers. As signals are not supported
+// by the kernel, this is a no-op.
+//
+// This function replaces runtime.initsig and is invoked by mstart1.
+//
+//go:redirect-from runtime.initsig
+//go:nosplit
+func initsig(_ bool) {
+}
+
+// newosproc is invoked by the runtime to start a new OS thread for running an
+// M. The kernel runs all goroutines on the bootstrap thread so this request
+// cannot be satisfied.
+//
+// This function replaces runtime.newosproc.
+//
+//go:redirect-from runtime.newosproc
+func newosproc(_, _ unsafe.Pointer) {
+	kfmt.Panic(errNoThreads)
+}
+
+// checkdead detects deadlocks by examining the number of running Ms. As the
+// kernel bypasses the runtime initialization code that registers the
+// bootstrap M, the runtime implementation would report an inconsistent M
+// count. Blocking all goroutines is not an error for the kernel; the CPU is
+// halted until an interrupt makes a goroutine runnable.
+//
+// This function replaces runtime.checkdead.
+//
+//go:redirect-from runtime.checkdead
+//go:nosplit
+func checkdead() {
+}
+
+// futexsleep blocks until the value at addr differs from val or until ns
+// nanoseconds elapse. A negative ns value blocks indefinitely. As there is
+// only a single thread, the value at addr can only be changed by an interrupt
+// handler so the CPU is halted until the next interrupt arrives. If a timeout
+// is specified, the CPU is only halted while the next timer interrupt is
+// guaranteed to arrive before the deadline.
+//
+// This function replaces runtime.futexsleep which is used for implementing
+// the runtime locks and notes.
+//
+//go:redirect-from runtime.futexsleep
+//go:nosplit
+func futexsleep(addr *uint32, val uint32, ns int64) {
+	if ns < 0 {
+		for atomic.LoadUint32(addr) == val {
+			waitForInterruptFn()
+		}
+		return
+	}
+
+	deadline := nanotimeFn() + uint64(ns)
+	for now := nanotimeFn(); atomic.LoadUint32(addr) == val && now < deadline; now = nanotimeFn() {
+		haltBefore(now, deadline)
+	}
+}
+
+// futexwakeup wakes up threads sleeping on addr. As futexsleep re-examines
+// the value at addr after each interrupt, no action is required.
+//
+// This function replaces runtime.futexwakeup.
+//
+//go:redirect-from runtime.futexwakeup
+//go:nosplit
+func futexwakeup(_ *uint32, _ uint32) {
+}
+
+// notetsleepg blocks the calling goroutine until the note is signaled or
+// until ns nanoseconds elapse. A negative ns value blocks indefinitely. It
+// returns true if the note was signaled.
+//
+// The runtime implementation hands the P over to another M while the calling
+// M sleeps. As there is only a single M, the calling goroutine yields to the
+// other goroutines until the note is signaled instead.
+//
+// This function replaces runtime.notetsleepg which is used, for example, when
+// starting the GC background mark workers.
+//
+//go:redirect-from runtime.notetsleepg
+func notetsleepg(note *uint32, ns int64) bool {
+	deadline := nanotimeFn() + uint64(ns)
+	for atomic.LoadUint32(note) == 0 {
+		if ns >= 0 && nanotimeFn() >= deadline {
+			return false
+		}
+
+		goschedFn()
+	}
+
+	return true
+}
+
+// osyield yields the CPU to another thread. As there is only a single
+// thread, this is a no-op.
+//
+// This function replaces runtime.osyield.
+//
+//go:redirect-from runtime.osyield
+//go:nosplit
+func osyield() {
+}
+
+func init() {
+	// Dummy calls so the compiler does not optimize away the functions in
+	// this file.
+	var futexVal uint32 = 1
+
+	minit()
+	initsig(false)
+	checkdead()
+	futexsleep(&futexVal, 0, 0)
+	futexwakeup(&futexVal, 0)
+	osyield()
+	notetsleepg(&futexVal, 0)
+	if futexVal == 0 {
+		newosproc(nil, nil)
+	}
+}
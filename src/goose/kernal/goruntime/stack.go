@@ -0,0 +1,60 @@
+package goruntime
+
+import (
+	"goose/kernel/kfmt"
+	"goose/kernel/mm"
+	"goose/kernel/mm/vmm"
+)
+
+var (
+	allocGuardedStackFn = vmm.AllocGuardedStack
+	freeGuardedStackFn  = vmm.FreeGuardedStack
+)
+
+// stack mirrors the layout of the runtime stack struct (runtime.stack) which
+// describes the memory range [lo, hi) of a goroutine stack.
+type stack struct {
+	lo, hi uintptr
+}
+
+// stackalloc allocates a goroutine stack of n bytes. Instead of carving the
+// stack out of the Go heap, the stack is allocated via vmm.AllocGuardedStack so
+// it is placed in its own region of the kernel address space with an unmapped
+// guard page below it. As stacks are rounded up to a page multiple, the
+// returned stack occupies the top n bytes of the allocated region.
+//
+// This function replaces runtime.stackalloc which is invoked on the system
+// stack when a goroutine is created and when its stack grows or shrinks.
+//
+//go:redirect-from runtime.stackalloc
+//go:nosplit
+func stackalloc(n uint32) stack {
+	kstack, err := allocGuardedStackFn(uintptr(n))
+	if err != nil {
+		kfmt.Panic(err)
+	}
+
+	return stack{lo: kstack.Top - uintptr(n), hi: kstack.Top}
+}
+
+// stackfree releases a goroutine stack that was allocated via stackalloc.
+//
+// This function replaces runtime.stackfree.
+//
+//go:redirect-from runtime.stackfree
+//go:nosplit
+func stackfree(stk stack) {
+	size := (stk.hi - stk.lo + mm.PageSize - 1) & ^(mm.PageSize - 1)
+	if err := freeGuardedStackFn(vmm.KernelStack{Bottom: stk.hi - size, Top: stk.hi}); err != nil {
+		kfmt.Panic(err)
+	}
+}
+
+func init() {
+	// Dummy calls so the compiler does not optimize away the functions in
+	// this file.
+	stk := stack{}
+	if stk.hi != 0 {
+		stackfree(stackalloc(uint32(stk.hi - stk.lo)))
+	}
+}
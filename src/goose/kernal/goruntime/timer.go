@@ -0,0 +1,299 @@
+package goruntime
+
+import (
+	"goose/kernel/clock"
+	"goose/kernel/sync"
+	"sync/atomic"
+)
+
+// idleYieldThreshold is the maximum time in nanoseconds that a call to
+// runtime.Gosched by the timer goroutine may take for the scheduler to be
+// considered idle. If no other goroutine ran in the meantime, the timer
+// goroutine halts the CPU until the next timer interrupt.
+const idleYieldThreshold = 20000
+
+// noPendingTimers is the value of nextTimerWhen while the timer queue is
+// empty.
+const noPendingTimers = int64(^uint64(0) >> 1)
+
+// timerQueue is a min-heap of timers ordered by their expiration time.
+//
+// Goroutines may be preempted while they access the queue so it is protected
+// by a spinlock; holding the lock also prevents the goroutine from being
+// preempted. The PIT interrupt handler does not access the queue; it only
+// reads nextTimerWhen.
+type timerQueue struct {
+	lock sync.Spinlock
+	heap []*timer
+
+	// wakeup is signaled when a timer is added to an empty queue while the
+	// timer goroutine is waiting for work.
+	wakeup chan struct{}
+}
+
+var (
+	timers = timerQueue{wakeup: make(chan struct{}, 1)}
+
+	// nextTimerWhen is the expiration time of the first timer in the queue
+	// or noPendingTimers if the queue is empty.
+	nextTimerWhen = noPendingTimers
+
+	enableTicksFn = clock.EnableTicks
+	tickPeriodFn  = clock.TickPeriod
+)
+
+// timerLoop runs expired timers. While timers are pending, it yields to the
+// other goroutines and halts the CPU until the next timer interrupt if no
+// other goroutine is runnable. When the queue is empty, the goroutine blocks
+// until a timer is added.
+//
+// Once a timer expires, the PIT interrupt handler preempts the running
+// goroutine (see timerTick) so that the timer goroutine gets to run even if
+// the other goroutines never yield.
+func timerLoop() {
+	for {
+		now := runExpiredTimers()
+		if atomic.LoadInt64(&nextTimerWhen) == noPendingTimers {
+			<-timers.wakeup
+			continue
+		}
+
+		goschedFn()
+
+		// If no other goroutine ran while yielding, wait for the next
+		// timer interrupt unless a timer is about to expire
+		yieldEnd := nanotimeFn()
+		if yieldEnd-uint64(now) >= idleYieldThreshold {
+			continue
+		}
+
+		if next := atomic.LoadInt64(&nextTimerWhen); next != noPendingTimers && uint64(next) > yieldEnd {
+			haltBefore(yieldEnd, uint64(next))
+		}
+	}
+}
+
+// timerTick is invoked by the PIT interrupt handler. If a timer has expired,
+// it requests the preemption of the interrupted goroutine so that the timer
+// goroutine can run.
+//
+//go:nosplit
+func timerTick() {
+	if atomic.LoadInt64(&nextTimerWhen) <= int64(nanotimeFn()) {
+		requestPreemption()
+	}
+}
+
+// runExpiredTimers invokes the callbacks of all expired timers and returns
+// the clock value that was used for checking the timer deadlines. Periodic
+// timers are re-armed before their callback is invoked. The callbacks are
+// invoked without holding the queue lock.
+func runExpiredTimers() int64 {
+	now := int64(nanotimeFn())
+	for {
+		timers.lock.Acquire()
+		if len(timers.heap) == 0 || timers.heap[0].when > now {
+			timers.lock.Release()
+			return now
+		}
+
+		t := timers.heap[0]
+		if t.period > 0 {
+			// Skip any periods that elapsed while the timer was pending
+			t.when += t.period * (1 + (now-t.when)/t.period)
+			timers.siftDown(0)
+		} else {
+			timers.remove(0)
+		}
+		timers.updateNextWhen()
+
+		f, arg, seq := t.f, t.arg, t.seq
+		timers.lock.Release()
+
+		f(arg, seq)
+	}
+}
+
+// addtimer adds t to the timer queue. Timers that have already expired fire
+// immediately.
+//
+// This function replaces runtime.addtimer which is used by the time package
+// for starting timers.
+//
+//go:redirect-from runtime.addtimer
+func addtimer(t *timer) {
+	timers.lock.Acquire()
+	t.i = len(timers.heap)
+	timers.heap = append(timers.heap, t)
+	timers.siftUp(t.i)
+	timers.updateNextWhen()
+	timers.lock.Release()
+
+	if t.when <= int64(nanotimeFn()) {
+		runExpiredTimers()
+	}
+
+	if atomic.LoadInt64(&nextTimerWhen) != noPendingTimers {
+		select {
+		case timers.wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deltimer removes t from the timer queue. It returns false if t was not
+// queued, i.e. the timer has already fired or was never started.
+//
+// This function replaces runtime.deltimer which is used by the time package
+// for stopping timers.
+//
+//go:redirect-from runtime.deltimer
+func deltimer(t *timer) bool {
+	timers.lock.Acquire()
+	if t.i < 0 || t.i >= len(timers.heap) || timers.heap[t.i] != t {
+		timers.lock.Release()
+		return false
+	}
+
+	timers.remove(t.i)
+	timers.updateNextWhen()
+	timers.lock.Release()
+	return true
+}
+
+// timeSleep blocks the calling goroutine for at least ns nanoseconds. Other
+// goroutines keep running while the caller sleeps; if none of them is
+// runnable, the CPU is halted until the timer expires.
+//
+// This function replaces runtime.timeSleep which implements time.Sleep.
+//
+//go:redirect-from runtime.timeSleep
+func timeSleep(ns int64) {
+	if ns <= 0 {
+		return
+	}
+
+	wakeup := make(chan struct{})
+	addtimer(&timer{
+		when: int64(nanotimeFn()) + ns,
+		f:    closeWakeupChan,
+		arg:  wakeup,
+	})
+	<-wakeup
+}
+
+// closeWakeupChan is the callback for the timers set up by timeSleep.
+func closeWakeupChan(arg interface{}, _ uintptr) {
+	close(arg.(chan struct{}))
+}
+
+// usleep blocks the calling thread for usec microseconds. The runtime invokes
+// usleep from contexts where it cannot be descheduled so the CPU is halted
+// while the next timer interrupt arrives before the deadline and the clock is
+// polled for the remaining time.
+//
+// This function replaces runtime.usleep.
+//
+//go:redirect-from runtime.usleep
+//go:nosplit
+func usleep(usec uint32) {
+	deadline := nanotimeFn() + uint64(usec)*1000
+	for now := nanotimeFn(); now < deadline; now = nanotimeFn() {
+		haltBefore(now, deadline)
+	}
+}
+
+// haltBefore halts the CPU until the next interrupt if periodic timer
+// interrupts are enabled and the next one is guaranteed to arrive before the
+// deadline. Otherwise, it returns immediately so the caller can keep polling
+// the clock.
+//
+//go:nosplit
+func haltBefore(now, deadline uint64) {
+	if period := tickPeriodFn(); period != 0 && deadline-now >= period {
+		waitForInterruptFn()
+	}
+}
+
+// updateNextWhen publishes the expiration time of the first timer in the queue
+// via nextTimerWhen. It must be invoked while holding the queue lock after the
+// queue is modified.
+func (q *timerQueue) updateNextWhen() {
+	next := noPendingTimers
+	if len(q.heap) != 0 {
+		next = q.heap[0].when
+	}
+
+	atomic.StoreInt64(&nextTimerWhen, next)
+}
+
+// remove removes the timer at the specified heap index and marks it as no
+// longer queued.
+func (q *timerQueue) remove(i int) {
+	t, last := q.heap[i], len(q.heap)-1
+	if i != last {
+		q.heap[i] = q.heap[last]
+		q.heap[i].i = i
+	}
+	q.heap[last] = nil
+	q.heap = q.heap[:last]
+	t.i = -1
+
+	if i != last {
+		q.siftUp(i)
+		q.siftDown(i)
+	}
+}
+
+// siftUp moves the timer at index i towards the root of the heap until its
+// parent expires before it.
+func (q *timerQueue) siftUp(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if q.heap[parent].when <= q.heap[i].when {
+			break
+		}
+
+		q.swap(i, parent)
+		i = parent
+	}
+}
+
+// siftDown moves the timer at index i towards the leaves of the heap until
+// it expires before all of its children.
+func (q *timerQueue) siftDown(i int) {
+	for {
+		min, left, right := i, 2*i+1, 2*i+2
+		if left < len(q.heap) && q.heap[left].when < q.heap[min].when {
+			min = left
+		}
+		if right < len(q.heap) && q.heap[right].when < q.heap[min].when {
+			min = right
+		}
+		if min == i {
+			return
+		}
+
+		q.swap(i, min)
+		i = min
+	}
+}
+
+func (q *timerQueue) swap(i, j int) {
+	q.heap[i], q.heap[j] = q.heap[j], q.heap[i]
+	q.heap[i].i = i
+	q.heap[j].i = j
+}
+
+func init() {
+	// Dummy calls so the compiler does not optimize away the functions in
+	// this file.
+	t := &timer{i: -1}
+
+	deltimer(t)
+	timeSleep(0)
+	usleep(0)
+	if t.seq != 0 {
+		addtimer(t)
+	}
+}
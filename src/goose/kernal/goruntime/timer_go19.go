@@ -0,0 +1,20 @@
+// +build !go1.10
+
+package goruntime
+
+// timer mirrors the layout of the runtime timer struct (runtime.timer) which
+// is also used by the time package for implementing time.Timer, time.Ticker
+// and time.After.
+type timer struct {
+	// i is the index of the timer in the timer heap.
+	i int
+
+	// The timer fires at when and, if period is greater than zero, every
+	// period nanoseconds after that. Each time the timer fires, f(arg, seq)
+	// is invoked by the timer goroutine; f must not block.
+	when   int64
+	period int64
+	f      func(interface{}, uintptr)
+	arg    interface{}
+	seq    uintptr
+}
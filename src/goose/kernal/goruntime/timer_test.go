@@ -0,0 +1,107 @@
+package goruntime
+
+import "testing"
+
+// push adds a timer that expires at when to the heap.
+func (q *timerQueue) push(when int64) *timer {
+	t := &timer{i: len(q.heap), when: when}
+	q.heap = append(q.heap, t)
+	q.siftUp(t.i)
+	return t
+}
+
+// checkHeap verifies the heap property and the heap index of each timer.
+func checkHeap(t *testing.T, q *timerQueue) {
+	for i, tm := range q.heap {
+		if tm.i != i {
+			t.Fatalf("expected timer at heap index %d to have index %d; got %d", i, i, tm.i)
+		}
+
+		if parent := (i - 1) / 2; i > 0 && q.heap[parent].when > tm.when {
+			t.Fatalf("heap property violated: parent %d expires at %d; child %d expires at %d", parent, q.heap[parent].when, i, tm.when)
+		}
+	}
+}
+
+func TestTimerQueueOrdering(t *testing.T) {
+	specs := [][]int64{
+		{},
+		{5},
+		{1, 2, 3, 4, 5},
+		{5, 4, 3, 2, 1},
+		{7, 3, 9, 3, 1, 8, 1, 0, 12, 5},
+	}
+
+	for specIndex, spec := range specs {
+		var q timerQueue
+		for _, when := range spec {
+			q.push(when)
+			checkHeap(t, &q)
+		}
+
+		last := int64(-1)
+		for len(q.heap) != 0 {
+			tm := q.heap[0]
+			q.remove(0)
+			checkHeap(t, &q)
+
+			if tm.when < last {
+				t.Errorf("[spec %d] expected timers to expire in order; got %d after %d", specIndex, tm.when, last)
+			}
+
+			if tm.i != -1 {
+				t.Errorf("[spec %d] expected removed timer index to be -1; got %d", specIndex, tm.i)
+			}
+			last = tm.when
+		}
+	}
+}
+
+func TestTimerQueueRemove(t *testing.T) {
+	whens := []int64{40, 10, 30, 20, 60, 50, 70, 0, 80, 90}
+
+	for removeIndex := range whens {
+		var (
+			q      timerQueue
+			queued []*timer
+		)
+		for _, when := range whens {
+			queued = append(queued, q.push(when))
+		}
+
+		target := queued[removeIndex]
+		q.remove(target.i)
+		checkHeap(t, &q)
+
+		if target.i != -1 {
+			t.Errorf("[timer %d] expected removed timer index to be -1; got %d", removeIndex, target.i)
+		}
+
+		if exp := len(whens) - 1; len(q.heap) != exp {
+			t.Errorf("[timer %d] expected heap to contain %d timers; got %d", removeIndex, exp, len(q.heap))
+		}
+
+		for _, tm := range q.heap {
+			if tm == target {
+				t.Errorf("[timer %d] expected removed timer not to be in the heap", removeIndex)
+			}
+		}
+	}
+}
+
+func TestTimerQueueSiftDown(t *testing.T) {
+	var q timerQueue
+	for _, when := range []int64{10, 20, 30, 40, 50} {
+		q.push(when)
+	}
+
+	// Re-arm the first timer as runExpiredTimers does for periodic timers
+	first := q.heap[0]
+	first.when = 45
+	q.siftDown(0)
+	checkHeap(t, &q)
+
+	if q.heap[0].when != 20 {
+		t.Errorf("expected first timer to expire at 20; got %d", q.heap[0].when)
+	}
+}
@@ -0,0 +1,9 @@
+// +build go1.9,!go1.11
+
+package goruntime
+
+// goVersionSupported is true when the kernel is built with a Go toolchain
+// whose runtime internals (e.g. the signatures of the redirected functions and
+// the layouts of the runtime.g and runtime.timer structs) match the
+// definitions in this package.
+const goVersionSupported = true
@@ -2,12 +2,16 @@ package kmain
 
 import (
 	"goose/kernel"
+	"goose/kernel/clock"
 	"goose/kernel/gate"
 	"goose/kernel/goruntime"
 	"goose/kernel/hal"
 	"goose/kernel/kfmt"
+	"goose/kernel/ksym"
+	"goose/kernel/mm"
 	"goose/kernel/mm/pmm"
 	"goose/kernel/mm/vmm"
+	"goose/kernel/rand"
 	"goose/multiboot"
 )
 
@@ -23,25 +27,50 @@ var (
 // The rt0 code passes the address of the multiboot info payload provided by the
 // bootloader as well as the physical addresses for the kernel start/end. In
 // addition, the start of the kernel virtual address space is passed to the
-// kernelPageOffset argument.
+// kernelPageOffset argument while the stackBottom and stackTop arguments
+// specify the virtual address range of the kernel stack set up by rt0.
 //
-// Kmain is not expected to return. If it does, the rt0 code will halt the CPU.
+// Kmain hands the CPU over to the Go scheduler once the Go runtime has been
+// initialized and is not expected to return. If it does, the rt0 code will
+// halt the CPU.
 //
 //go:noinline
-func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset uintptr) {
+func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset, stackBottom, stackTop uintptr) {
 	multiboot.SetInfoPtr(multibootInfoPtr)
 
 	var err *kernel.Error
 	gate.Init()
-	if err = pmm.Init(kernelStart, kernelEnd); err != nil {
+	if err = pmm.Init(kernelStart, kernelEnd, kernelPageOffset); err != nil {
 		panic(err)
 	} else if err = vmm.Init(kernelPageOffset); err != nil {
 		panic(err)
+	} else if err = vmm.ProtectKernelStack(vmm.KernelStack{Bottom: stackBottom, Top: stackTop}, "rt0 (g0)"); err != nil {
+		panic(err)
+	} else if err = clock.Init(); err != nil {
+		panic(err)
+	} else if err = rand.Init(); err != nil {
+		panic(err)
 	} else if err = goruntime.Init(); err != nil {
 		panic(err)
 	}
 
-	// After goruntime.Init returns we can safely use defer
+	// Run the remaining initialization steps as a goroutine so that the
+	// kernel can use goroutines and channels
+	goruntime.StartScheduler(kernelMain)
+}
+
+// kernelMain is the first goroutine started by Kmain. It completes the kernel
+// initialization once the Go runtime and the scheduler are available.
+func kernelMain() {
+	var err *kernel.Error
+
+	// The kernel symbols are optional; they are only used for symbolizing
+	// the backtraces displayed by the fault handlers
+	if err = ksym.Init(); err != nil {
+		kfmt.Printf("[kmain] unable to load kernel symbols: %s\n", err.Message)
+	}
+
+	// kernelMain is not expected to return
 	defer func() {
 		// Use kfmt.Panic instead of panic to prevent the compiler from
 		// treating kernel.Panic as dead-code and eliminating it.
@@ -50,4 +79,64 @@ func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset uintptr) {
 
 	// Detect and initialize hardware
 	hal.DetectHardware()
+
+	// All consumers of the multiboot payload have been initialized so
+	// its memory can now be handed back to the physical frame allocator
+	if err = reclaimMultibootPayload(); err != nil {
+		kfmt.Printf("[kmain] unable to reclaim multiboot payload memory: %s\n", err.Message)
+	}
+
+	// Report the physical memory state now that boot-time reclamation
+	// is complete
+	pmm.PrintStats()
+
+	// Report any mappings that violate the W^X policy
+	vmm.Audit()
+
+	// Verify that the memory released by the Go garbage collector is
+	// reused by the heap and returned to pmm
+	if err = goruntime.GCSelfTest(); err != nil {
+		kfmt.Printf("[kmain] GC self-test failed: %s\n", err.Message)
+	}
+
+	// The initialization is complete; park the goroutine so that the
+	// other goroutines keep running
+	select {}
+}
+
+// reclaimMultibootPayload releases the pages that hold the multiboot info
+// payload. The rt0 code copies the payload into a page-aligned buffer that is
+// part of the kernel image so its pages need to be unmapped before their
+// frames can be returned to the physical frame allocator.
+func reclaimMultibootPayload() *kernel.Error {
+	infoAddr, infoSize := multiboot.InfoRegion()
+	if infoSize == 0 {
+		return nil
+	}
+
+	// Copy the command line and the boot module descriptors out of the
+	// payload before detaching it so that they remain available via the
+	// multiboot package
+	multiboot.Detach()
+
+	startPage := mm.PageFromAddress(infoAddr + mm.PageSize - 1)
+	endPage := mm.PageFromAddress(infoAddr + infoSize + mm.PageSize - 1)
+	if endPage <= startPage {
+		return nil
+	}
+
+	// The kernel image is physically contiguous so the payload frames
+	// are contiguous too
+	physAddr, err := vmm.Translate(startPage.Address())
+	if err != nil {
+		return err
+	}
+
+	for page := startPage; page < endPage; page++ {
+		if err = vmm.Unmap(page); err != nil {
+			return err
+		}
+	}
+
+	return pmm.ReclaimRegion(physAddr, uintptr(endPage-startPage)<<mm.PageShift)
 }
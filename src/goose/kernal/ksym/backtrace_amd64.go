@@ -0,0 +1,68 @@
+package ksym
+
+import (
+	"goose/kernel/kfmt"
+	"goose/kernel/mm/vmm"
+	"io"
+	"unsafe"
+)
+
+// maxBacktraceDepth limits the number of frames displayed by PrintBacktrace.
+const maxBacktraceDepth = 32
+
+var (
+	// translateFn is used by tests and is automatically inlined by the compiler.
+	translateFn = vmm.Translate
+)
+
+// PrintBacktrace walks the chain of stack frames starting at the supplied
+// instruction pointer and frame pointer (RBP) and outputs the symbolized
+// address of each frame to w. The walk relies on the frame pointers that are
+// maintained by the Go compiler: each frame stores the frame pointer of its
+// caller at offset 0 and the return address at offset 8. The walk stops when
+// a frame pointer does not point to mapped memory or when the chain does not
+// move towards the stack top.
+func PrintBacktrace(w io.Writer, pc, fp uintptr) {
+	printFrame(w, pc, pc)
+
+	for depth := 1; depth < maxBacktraceDepth; depth++ {
+		if fp == 0 || fp&(unsafe.Sizeof(fp)-1) != 0 || !isMapped(fp) || !isMapped(fp+unsafe.Sizeof(fp)) {
+			return
+		}
+
+		callerFP := *(*uintptr)(unsafe.Pointer(fp))
+		retAddr := *(*uintptr)(unsafe.Pointer(fp + unsafe.Sizeof(fp)))
+		if retAddr == 0 {
+			return
+		}
+
+		// The return address points to the instruction after the call;
+		// use the previous byte for the lookup so that calls at the end
+		// of a function resolve to the right symbol.
+		printFrame(w, retAddr, retAddr-1)
+
+		if callerFP <= fp {
+			return
+		}
+		fp = callerFP
+	}
+
+	kfmt.Fprintf(w, "  ...\n")
+}
+
+// printFrame outputs a single backtrace entry for pc using lookupAddr to
+// resolve the symbol name.
+func printFrame(w io.Writer, pc, lookupAddr uintptr) {
+	if name, offset, ok := Lookup(lookupAddr); ok {
+		kfmt.Fprintf(w, "  [0x%16x] %s+0x%x\n", pc, name, offset+(pc-lookupAddr))
+		return
+	}
+
+	kfmt.Fprintf(w, "  [0x%16x] ?\n", pc)
+}
+
+// isMapped returns true if addr points to mapped memory.
+func isMapped(addr uintptr) bool {
+	_, err := translateFn(addr)
+	return err == nil
+}
@@ -0,0 +1,167 @@
+// Package ksym resolves kernel code addresses to symbol names using the ELF
+// symbol table that the bootloader loads together with the kernel image.
+package ksym
+
+import (
+	"goose/kernel"
+	"goose/kernel/kfmt"
+	"goose/kernel/mm"
+	"goose/kernel/mm/vmm"
+	"goose/multiboot"
+	"reflect"
+	"unsafe"
+)
+
+const (
+	// symbolTableSection and stringTableSection are the names of the ELF
+	// sections that contain the kernel symbols and their names.
+	symbolTableSection = ".symtab"
+	stringTableSection = ".strtab"
+
+	// elfSymbolTypeFunc is the ELF symbol type for functions.
+	elfSymbolTypeFunc = 2
+)
+
+var (
+	errMissingSymbolTable = &kernel.Error{Module: "ksym", Message: "kernel image does not contain a symbol table"}
+
+	// mapRegionFn is used by tests and is automatically inlined by the compiler.
+	mapRegionFn = vmm.MapRegion
+)
+
+// elfSymbol64 describes an entry of the ELF symbol table.
+type elfSymbol64 struct {
+	nameIndex    uint32
+	info         uint8
+	other        uint8
+	sectionIndex uint16
+	value        uint64
+	size         uint64
+}
+
+// symbolTable provides access to the kernel symbols.
+type symbolTable struct {
+	symbols    []elfSymbol64
+	symbolsHdr reflect.SliceHeader
+
+	strtabAddr uintptr
+	strtabSize uintptr
+}
+
+// ksymTable contains the symbol table loaded by Init.
+var ksymTable symbolTable
+
+// Init locates the kernel symbol and string tables using the ELF section
+// information provided by the bootloader and maps them into the kernel address
+// space. Init must be invoked before the multiboot info payload is released.
+// Once the symbol table is loaded, Init registers PrintBacktrace with the vmm
+// package so that the fault handlers can display symbolized call chains.
+func Init() *kernel.Error {
+	var (
+		symtabAddr, strtabAddr uintptr
+		symtabSize, strtabSize uint64
+	)
+
+	multiboot.VisitElfSections(func(name string, _ multiboot.ElfSectionFlag, address uintptr, size uint64) {
+		switch name {
+		case symbolTableSection:
+			symtabAddr, symtabSize = address, size
+		case stringTableSection:
+			strtabAddr, strtabSize = address, size
+		}
+	})
+
+	if symtabAddr == 0 || strtabAddr == 0 {
+		return errMissingSymbolTable
+	}
+
+	symtabVirtAddr, err := mapSection(symtabAddr, uintptr(symtabSize))
+	if err != nil {
+		return err
+	}
+
+	strtabVirtAddr, err := mapSection(strtabAddr, uintptr(strtabSize))
+	if err != nil {
+		return err
+	}
+
+	symbolCount := int(uintptr(symtabSize) / unsafe.Sizeof(elfSymbol64{}))
+	ksymTable.symbolsHdr.Data = symtabVirtAddr
+	ksymTable.symbolsHdr.Len = symbolCount
+	ksymTable.symbolsHdr.Cap = symbolCount
+	ksymTable.symbols = *(*[]elfSymbol64)(unsafe.Pointer(&ksymTable.symbolsHdr))
+	ksymTable.strtabAddr = strtabVirtAddr
+	ksymTable.strtabSize = uintptr(strtabSize)
+
+	kfmt.Printf("[ksym] loaded %d kernel symbols\n", symbolCount)
+
+	vmm.SetBacktracePrinter(PrintBacktrace)
+	return nil
+}
+
+// mapSection establishes a read-only mapping for the ELF section that is
+// loaded at the supplied physical address and returns its virtual address.
+func mapSection(physAddr, size uintptr) (uintptr, *kernel.Error) {
+	pageOffset := physAddr & (mm.PageSize - 1)
+	page, err := mapRegionFn(mm.FrameFromAddress(physAddr), size+pageOffset, vmm.FlagPresent|vmm.FlagNoExecute)
+	if err != nil {
+		return 0, err
+	}
+
+	return page.Address() + pageOffset, nil
+}
+
+// Lookup returns the name of the function that contains the supplied address
+// and the offset of the address from the function start. If the symbol table
+// is not loaded or the address does not belong to any known function then
+// Lookup returns false.
+func Lookup(addr uintptr) (string, uintptr, bool) {
+	var (
+		best      *elfSymbol64
+		addr64    = uint64(addr)
+		symbolPtr *elfSymbol64
+	)
+
+	for index := 0; index < len(ksymTable.symbols); index++ {
+		symbolPtr = &ksymTable.symbols[index]
+		if symbolPtr.info&0xf != elfSymbolTypeFunc || symbolPtr.value > addr64 {
+			continue
+		}
+
+		if addr64 < symbolPtr.value+symbolPtr.size {
+			best = symbolPtr
+			break
+		}
+
+		// Symbols defined in assembly files may not specify a size; use
+		// the closest preceding one as a fallback.
+		if symbolPtr.size == 0 && (best == nil || symbolPtr.value > best.value) {
+			best = symbolPtr
+		}
+	}
+
+	if best == nil {
+		return "", 0, false
+	}
+
+	return ksymTable.symbolName(best), uintptr(addr64 - best.value), true
+}
+
+// symbolName returns the name for the supplied symbol. The returned string
+// points directly to the string table contents.
+func (t *symbolTable) symbolName(symbol *elfSymbol64) string {
+	var (
+		name       string
+		nameHeader = (*reflect.StringHeader)(unsafe.Pointer(&name))
+		start      = uintptr(symbol.nameIndex)
+		end        = start
+	)
+
+	// String table entries are C-style NULL-terminated strings
+	for ; end < t.strtabSize && *(*byte)(unsafe.Pointer(t.strtabAddr + end)) != 0; end++ {
+	}
+
+	nameHeader.Data = t.strtabAddr + start
+	nameHeader.Len = int(end - start)
+	return name
+}
@@ -0,0 +1,196 @@
+package mm
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// FrameUsage describes what a physical frame is being used for.
+type FrameUsage uint8
+
+const (
+	// FrameUsageFree indicates that the frame is available for allocation.
+	FrameUsageFree FrameUsage = iota
+
+	// FrameUsageKernelImage indicates that the frame is occupied by the
+	// loaded kernel image.
+	FrameUsageKernelImage
+
+	// FrameUsagePageTable indicates that the frame holds a page table.
+	FrameUsagePageTable
+
+	// FrameUsageHeap indicates that the frame has been handed out by the
+	// physical frame allocator for general purpose use.
+	FrameUsageHeap
+
+	// FrameUsageDMA indicates that the frame is used as a DMA buffer.
+	FrameUsageDMA
+
+	// FrameUsageReserved indicates that the frame is not managed by the
+	// physical frame allocator (e.g. it belongs to a reserved memory region).
+	FrameUsageReserved
+)
+
+// FrameFlag describes a flag that can be applied to a frame descriptor.
+type FrameFlag uint8
+
+const (
+	// FrameFlagPinned prevents the frame from ever being released back to
+	// the physical frame allocator.
+	FrameFlagPinned FrameFlag = 1 << iota
+
+	// FrameFlagPoisoned indicates that the free frame has been filled with
+	// a poison pattern by the allocator debug mode. The pattern is verified
+	// when the frame gets allocated again.
+	FrameFlagPoisoned
+)
+
+// FrameDescriptor contains the metadata for a single physical frame.
+type FrameDescriptor struct {
+	// RefCount tracks the number of users (e.g. page mappings) that
+	// reference the frame. The frame is released when the count drops to 0.
+	RefCount uint32
+
+	// Usage describes what the frame is used for.
+	Usage FrameUsage
+
+	// Flags contains a combination of FrameFlag values.
+	Flags FrameFlag
+}
+
+// HasFlags returns true if all the supplied flags are set.
+func (desc *FrameDescriptor) HasFlags(flags FrameFlag) bool {
+	return desc.Flags&flags == flags
+}
+
+// maxFrameDescriptorRanges is the maximum number of distinct physical memory
+// ranges that can be covered by the frame descriptor table.
+const maxFrameDescriptorRanges = 64
+
+// frameDescriptorRange describes a range of frames [startFrame, endFrame]
+// whose descriptors are stored in the frame descriptor table starting at
+// firstIndex.
+type frameDescriptorRange struct {
+	startFrame, endFrame Frame
+	firstIndex           uintptr
+}
+
+var (
+	// frameDescriptors contains one descriptor for each frame that belongs
+	// to one of the registered frame descriptor ranges. Descriptors are
+	// stored back to back so that holes in the physical address space
+	// (e.g. MMIO regions) do not consume any memory.
+	frameDescriptors    []FrameDescriptor
+	frameDescriptorsHdr reflect.SliceHeader
+
+	// frameDescriptorRanges is sorted by start frame.
+	frameDescriptorRanges     [maxFrameDescriptorRanges]frameDescriptorRange
+	frameDescriptorRangeCount int
+)
+
+// AddFrameDescriptorRange registers the frame range [startFrame, endFrame] as
+// one that requires frame descriptors and returns the total number of
+// descriptors required for all registered ranges. Ranges must be registered
+// in ascending order before the descriptor table is installed. If the range
+// list is full, the last range is extended to cover the new range.
+func AddFrameDescriptorRange(startFrame, endFrame Frame) uintptr {
+	if frameDescriptorRangeCount == maxFrameDescriptorRanges {
+		frameDescriptorRanges[frameDescriptorRangeCount-1].endFrame = endFrame
+	} else {
+		var firstIndex uintptr
+		if frameDescriptorRangeCount != 0 {
+			last := &frameDescriptorRanges[frameDescriptorRangeCount-1]
+			firstIndex = last.firstIndex + uintptr(last.endFrame-last.startFrame) + 1
+		}
+
+		frameDescriptorRanges[frameDescriptorRangeCount] = frameDescriptorRange{
+			startFrame: startFrame,
+			endFrame:   endFrame,
+			firstIndex: firstIndex,
+		}
+		frameDescriptorRangeCount++
+	}
+
+	last := &frameDescriptorRanges[frameDescriptorRangeCount-1]
+	return last.firstIndex + uintptr(last.endFrame-last.startFrame) + 1
+}
+
+// SetFrameDescriptorTable installs the frame descriptor table that is located
+// at the supplied virtual address and contains descCount entries. The memory
+// for the table is allocated by the physical memory allocator when it is
+// initialized after registering the covered frame ranges via calls to
+// AddFrameDescriptorRange.
+func SetFrameDescriptorTable(tableAddr uintptr, descCount uintptr) {
+	frameDescriptorsHdr.Data = tableAddr
+	frameDescriptorsHdr.Len = int(descCount)
+	frameDescriptorsHdr.Cap = int(descCount)
+	frameDescriptors = *(*[]FrameDescriptor)(unsafe.Pointer(&frameDescriptorsHdr))
+}
+
+// FrameDescriptorRangeVisitor is a function that is invoked for each frame
+// range covered by the frame descriptor table. It receives the first frame in
+// the range and the descriptors for the frames in the range. If the visitor
+// returns false, no further ranges are visited.
+type FrameDescriptorRangeVisitor func(startFrame Frame, descs []FrameDescriptor) bool
+
+// VisitFrameDescriptorRanges invokes the supplied visitor for each frame range
+// covered by the installed frame descriptor table in ascending frame order.
+func VisitFrameDescriptorRanges(visitor FrameDescriptorRangeVisitor) {
+	for i := 0; i < frameDescriptorRangeCount; i++ {
+		r := &frameDescriptorRanges[i]
+		if r.firstIndex >= uintptr(len(frameDescriptors)) {
+			return
+		}
+
+		lastIndex := r.firstIndex + uintptr(r.endFrame-r.startFrame) + 1
+		if lastIndex > uintptr(len(frameDescriptors)) {
+			lastIndex = uintptr(len(frameDescriptors))
+		}
+
+		if !visitor(r.startFrame, frameDescriptors[r.firstIndex:lastIndex]) {
+			return
+		}
+	}
+}
+
+// FrameDescriptorSize returns the size in bytes of a single frame descriptor.
+func FrameDescriptorSize() uintptr {
+	return unsafe.Sizeof(FrameDescriptor{})
+}
+
+// Descriptor returns a pointer to the metadata for this frame or nil if the
+// frame descriptor table has not been set up yet or the frame lies outside
+// the ranges covered by the table.
+func (f Frame) Descriptor() *FrameDescriptor {
+	for i := 0; i < frameDescriptorRangeCount; i++ {
+		r := &frameDescriptorRanges[i]
+		if f < r.startFrame {
+			break
+		}
+
+		if f <= r.endFrame {
+			if index := r.firstIndex + uintptr(f-r.startFrame); index < uintptr(len(frameDescriptors)) {
+				return &frameDescriptors[index]
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// SetUsage updates the usage type for this frame. Calls to SetUsage are
+// ignored if the frame has no descriptor.
+func (f Frame) SetUsage(usage FrameUsage) {
+	if desc := f.Descriptor(); desc != nil {
+		desc.Usage = usage
+	}
+}
+
+// AddRef increments the reference count for this frame. Calls to AddRef are
+// ignored if the frame has no descriptor.
+func (f Frame) AddRef() {
+	if desc := f.Descriptor(); desc != nil {
+		desc.RefCount++
+	}
+}
@@ -12,6 +12,10 @@ const (
 	// InvalidFrame is returned by page allocators when
 	// they fail to reserve the requested frame.
 	InvalidFrame = Frame(math.MaxUint64)
+
+	// MaxFrameOrder defines the largest block order that can be requested
+	// via AllocFrames. A block of order n contains 2^n contiguous frames.
+	MaxFrameOrder = 10
 )
 
 // Valid returns true if this is a valid frame.
@@ -37,6 +41,18 @@ var (
 	// frameAllocator points to a frame allocator function registered using
 	// SetFrameAllocator.
 	frameAllocator FrameAllocatorFn
+
+	// framesAllocator points to a contiguous frame allocator function
+	// registered using SetFramesAllocator.
+	framesAllocator FramesAllocatorFn
+
+	// frameFreer points to a frame release function registered using
+	// SetFrameFreer.
+	frameFreer FrameFreerFn
+
+	// framesFreer points to a contiguous frame block release function
+	// registered using SetFramesFreer.
+	framesFreer FramesFreerFn
 )
 
 // FrameAllocatorFn is a function that can allocate physical frames.
@@ -50,6 +66,58 @@ func SetFrameAllocator(allocFn FrameAllocatorFn) { frameAllocator = allocFn }
 // physical frame allocator.
 func AllocFrame() (Frame, *kernel.Error) { return frameAllocator() }
 
+// FramesAllocatorFn is a function that can allocate a block of 2^order
+// physically contiguous frames.
+type FramesAllocatorFn func(order uint8) (Frame, *kernel.Error)
+
+// SetFramesAllocator registers a function that will be used for servicing
+// requests for physically contiguous frame blocks.
+func SetFramesAllocator(allocFn FramesAllocatorFn) { framesAllocator = allocFn }
+
+// AllocFrames allocates a block of 2^order physically contiguous frames using
+// the currently active physical frame allocator and returns the first frame in
+// the block. The returned frame is aligned to a 2^order frame boundary.
+func AllocFrames(order uint8) (Frame, *kernel.Error) { return framesAllocator(order) }
+
+// FrameFreerFn is a function that can release physical frames.
+type FrameFreerFn func(Frame) *kernel.Error
+
+// SetFrameFreer registers a function that will be used by the vmm code for
+// returning physical frames back to the active physical frame allocator.
+func SetFrameFreer(freeFn FrameFreerFn) { frameFreer = freeFn }
+
+// FreeFrame drops a reference to a physical frame previously obtained via a
+// call to AllocFrame. Once the frame reference count reaches zero, the frame is
+// released using the currently active physical frame allocator. Calls to
+// FreeFrame for pinned frames are ignored.
+func FreeFrame(frame Frame) *kernel.Error {
+	if desc := frame.Descriptor(); desc != nil {
+		if desc.HasFlags(FrameFlagPinned) {
+			return nil
+		}
+
+		if desc.RefCount > 1 {
+			desc.RefCount--
+			return nil
+		}
+	}
+
+	return frameFreer(frame)
+}
+
+// FramesFreerFn is a function that can release a block of 2^order physically
+// contiguous frames.
+type FramesFreerFn func(frame Frame, order uint8) *kernel.Error
+
+// SetFramesFreer registers a function that will be used for returning blocks
+// of physically contiguous frames back to the active physical frame allocator.
+func SetFramesFreer(freeFn FramesFreerFn) { framesFreer = freeFn }
+
+// FreeFrames releases a block of 2^order physically contiguous frames
+// previously obtained via a call to AllocFrames with the same order using the
+// currently active physical frame allocator.
+func FreeFrames(frame Frame, order uint8) *kernel.Error { return framesFreer(frame, order) }
+
 // Page describes a virtual memory page index.
 type Page uintptr
 
@@ -6,8 +6,6 @@ import (
 	"goose/kernel/mm"
 	"goose/kernel/mm/vmm"
 	"goose/kernel/sync"
-	"goose/multiboot"
-	"math"
 	"reflect"
 	"unsafe"
 )
@@ -16,13 +14,23 @@ var (
 	errBitmapAllocOutOfMemory     = &kernel.Error{Module: "bitmap_alloc", Message: "out of memory"}
 	errBitmapAllocFrameNotManaged = &kernel.Error{Module: "bitmap_alloc", Message: "frame not managed by this allocator"}
 	errBitmapAllocDoubleFree      = &kernel.Error{Module: "bitmap_alloc", Message: "frame is already free"}
+	errBitmapAllocInvalidOrder    = &kernel.Error{Module: "bitmap_alloc", Message: "requested block order exceeds mm.MaxFrameOrder"}
+	errBitmapAllocMisalignedBlock = &kernel.Error{Module: "bitmap_alloc", Message: "block address is not aligned to its order"}
+	errBitmapAllocInvalidZone     = &kernel.Error{Module: "bitmap_alloc", Message: "unknown memory zone"}
+	errBitmapAllocNoPoolSlots     = &kernel.Error{Module: "bitmap_alloc", Message: "no free pool slots for adding memory region"}
 
 	// The followning functions are used by tests to mock calls to the vmm package
 	// and are automatically inlined by the compiler.
-	reserveRegionFn = vmm.EarlyReserveRegion
+	reserveRegionFn = vmm.ReserveRegion
 	mapFn           = vmm.Map
+	remapFn         = vmm.Remap
 )
 
+// sparePoolSlots specifies the number of additional pool slots that are
+// reserved when the allocator is initialized. These slots are used for memory
+// regions that get added to the allocator at runtime via AddRegion.
+const sparePoolSlots = 16
+
 type markAs bool
 
 const (
@@ -36,9 +44,12 @@ type framePool struct {
 	startFrame mm.Frame
 
 	// endFrame tracks the last frame in the pool. The total number of
-	// frames is given by: (endFrame - startFrame) - 1
+	// frames is given by: (endFrame - startFrame) + 1
 	endFrame mm.Frame
 
+	// zone specifies the memory zone that contains all pool frames.
+	zone Zone
+
 	// freeCount tracks the available pages in this pool. The allocator
 	// can use this field to skip fully allocated pools without the need
 	// to scan the free bitmap.
@@ -47,6 +58,14 @@ type framePool struct {
 	// freeBitmap tracks used/free pages in the pool.
 	freeBitmap    []uint64
 	freeBitmapHdr reflect.SliceHeader
+
+	// freeAreas contains the buddy allocator state for each supported
+	// block order. See buddy.go for more details.
+	freeAreas [mm.MaxFrameOrder + 1]freeArea
+
+	// nextFitFrame is the frame following the most recent allocation
+	// from this pool; searches for free blocks start from it.
+	nextFitFrame mm.Frame
 }
 
 // BitmapAllocator implements a physical frame allocator that tracks frame
@@ -84,35 +103,24 @@ func (alloc *BitmapAllocator) setupPoolBitmaps() *kernel.Error {
 		err                 *kernel.Error
 		sizeofPool          = unsafe.Sizeof(framePool{})
 		pageSizeMinus1      = mm.PageSize - 1
-		requiredBitmapBytes uint64
+		requiredBitmapBytes uintptr
 	)
 
 	// Detect available memory regions and calculate their pool bitmap
 	// requirements.
-	multiboot.VisitMemRegions(func(region *multiboot.MemoryMapEntry) bool {
-		if region.Type != multiboot.MemAvailable {
-			return true
-		}
-
+	visitPoolRegions(func(regionStartFrame, regionEndFrame mm.Frame) bool {
 		alloc.poolsHdr.Len++
 		alloc.poolsHdr.Cap++
 
-		// Reported addresses may not be page-aligned; round up to get
-		// the start frame and round down to get the end frame
-		regionStartFrame := mm.Frame(((uintptr(region.PhysAddress) + pageSizeMinus1) & ^pageSizeMinus1) >> mm.PageShift)
-		regionEndFrame := mm.Frame((uintptr(region.PhysAddress+region.Length) & ^pageSizeMinus1)>>mm.PageShift) - 1
-		pageCount := uint32(regionEndFrame - regionStartFrame)
-		alloc.totalPages += pageCount
-
-		// To represent the free page bitmap we need pageCount bits. Since our
-		// slice uses uint64 for storing the bitmap we need to round up the
-		// required bits so they are a multiple of 64 bits
-		requiredBitmapBytes += uint64(((pageCount + 63) &^ 63) >> 3)
+		alloc.totalPages += uint32(regionEndFrame - regionStartFrame + 1)
+		requiredBitmapBytes += poolBitmapBytes(regionStartFrame, regionEndFrame)
 		return true
 	})
 
-	// Reserve enough pages to hold the allocator state
-	requiredBytes := (uintptr(alloc.poolsHdr.Len)*sizeofPool + uintptr(requiredBitmapBytes) + pageSizeMinus1) & ^pageSizeMinus1
+	// Reserve enough pages to hold the allocator state including the spare
+	// pool slots for regions added at runtime
+	alloc.poolsHdr.Cap += sparePoolSlots
+	requiredBytes := (uintptr(alloc.poolsHdr.Cap)*sizeofPool + requiredBitmapBytes + pageSizeMinus1) & ^pageSizeMinus1
 	requiredPages := requiredBytes >> mm.PageShift
 	alloc.poolsHdr.Data, err = reserveRegionFn(requiredBytes)
 	if err != nil {
@@ -135,55 +143,128 @@ func (alloc *BitmapAllocator) setupPoolBitmaps() *kernel.Error {
 	alloc.pools = *(*[]framePool)(unsafe.Pointer(&alloc.poolsHdr))
 
 	// Run a second pass to initialize the free bitmap slices for all pools
-	bitmapStartAddr := alloc.poolsHdr.Data + uintptr(alloc.poolsHdr.Len)*sizeofPool
+	bitmapStartAddr := alloc.poolsHdr.Data + uintptr(alloc.poolsHdr.Cap)*sizeofPool
 	poolIndex := 0
-	multiboot.VisitMemRegions(func(region *multiboot.MemoryMapEntry) bool {
-		if region.Type != multiboot.MemAvailable {
-			return true
-		}
+	visitPoolRegions(func(regionStartFrame, regionEndFrame mm.Frame) bool {
+		bitmapStartAddr = alloc.pools[poolIndex].init(regionStartFrame, regionEndFrame, bitmapStartAddr)
+		poolIndex++
+		return true
+	})
+
+	return nil
+}
 
-		regionStartFrame := mm.Frame(((uintptr(region.PhysAddress) + pageSizeMinus1) & ^pageSizeMinus1) >> mm.PageShift)
-		regionEndFrame := mm.Frame((uintptr(region.PhysAddress+region.Length) & ^pageSizeMinus1)>>mm.PageShift) - 1
-		bitmapBytes := ((uintptr(regionEndFrame-regionStartFrame) + 63) &^ 63) >> 3
+// init sets up a pool that manages the frames [startFrame, endFrame] using the
+// memory starting at bitmapStartAddr for storing its bitmaps. All pool frames
+// are initially flagged as free. The method returns the address right after
+// the last byte used by the pool bitmaps.
+func (pool *framePool) init(startFrame, endFrame mm.Frame, bitmapStartAddr uintptr) uintptr {
+	bitmapBytes := bitmapWords(uintptr(endFrame-startFrame+1)) << 3
+
+	pool.startFrame = startFrame
+	pool.endFrame = endFrame
+	pool.zone = zoneForFrame(startFrame)
+	pool.freeCount = uint32(endFrame - startFrame + 1)
+	pool.nextFitFrame = startFrame
+	pool.freeBitmapHdr.Len = int(bitmapBytes >> 3)
+	pool.freeBitmapHdr.Cap = pool.freeBitmapHdr.Len
+	pool.freeBitmapHdr.Data = bitmapStartAddr
+	pool.freeBitmap = *(*[]uint64)(unsafe.Pointer(&pool.freeBitmapHdr))
+	bitmapStartAddr += bitmapBytes
+
+	bitmapStartAddr = pool.setupFreeAreas(bitmapStartAddr)
+
+	for frame := startFrame; frame <= endFrame; frame++ {
+		resetFrameDescriptor(frame)
+	}
 
-		alloc.pools[poolIndex].startFrame = regionStartFrame
-		alloc.pools[poolIndex].endFrame = regionEndFrame
-		alloc.pools[poolIndex].freeCount = uint32(regionEndFrame - regionStartFrame + 1)
-		alloc.pools[poolIndex].freeBitmapHdr.Len = int(bitmapBytes >> 3)
-		alloc.pools[poolIndex].freeBitmapHdr.Cap = alloc.pools[poolIndex].freeBitmapHdr.Len
-		alloc.pools[poolIndex].freeBitmapHdr.Data = bitmapStartAddr
-		alloc.pools[poolIndex].freeBitmap = *(*[]uint64)(unsafe.Pointer(&alloc.pools[poolIndex].freeBitmapHdr))
+	return bitmapStartAddr
+}
+
+// visitPoolRegions invokes visitor with the first and last frame of each
+// region in the sanitized memory map. Regions that cross a zone boundary are
+// reported as multiple sub-regions.
+func visitPoolRegions(visitor func(startFrame, endFrame mm.Frame) bool) {
+	sanitizedMemMap.visit(func(regionStartFrame, regionEndFrame mm.Frame) bool {
+		// Split the region at zone boundaries so that each pool
+		// belongs to exactly one zone
+		for regionStartFrame <= regionEndFrame {
+			poolEndFrame := zoneLastFrame(zoneForFrame(regionStartFrame))
+			if poolEndFrame > regionEndFrame {
+				poolEndFrame = regionEndFrame
+			}
+
+			if !visitor(regionStartFrame, poolEndFrame) {
+				return false
+			}
+			regionStartFrame = poolEndFrame + 1
+		}
 
-		bitmapStartAddr += bitmapBytes
-		poolIndex++
 		return true
 	})
+}
 
-	return nil
+// bitmapWords returns the number of uint64 words required for a bitmap with
+// the requested number of bits.
+func bitmapWords(bits uintptr) uintptr {
+	return (bits + 63) >> 6
+}
+
+// poolBitmapBytes returns the number of bytes required for storing the free
+// bitmap and the buddy free area summary bitmaps for a pool spanning the frames
+// [startFrame, endFrame].
+func poolBitmapBytes(startFrame, endFrame mm.Frame) uintptr {
+	bytes := bitmapWords(uintptr(endFrame-startFrame+1)) << 3
+	for order := uint8(0); order <= mm.MaxFrameOrder; order++ {
+		bytes += summaryBitmapWords(freeAreaBits(startFrame, endFrame, order)) << 3
+	}
+
+	return bytes
 }
 
 // markFrame updates the reservation flag for the bitmap entry that corresponds
-// to the supplied frame.
-func (alloc *BitmapAllocator) markFrame(poolIndex int, frame mm.Frame, flag markAs) {
+// to the supplied frame. The buddy free areas for the pool are also updated so
+// that reserved frames can never be handed out by AllocFrames. The method
+// returns false if the frame is not managed by the pool or if it is already
+// flagged with the requested reservation flag.
+func (alloc *BitmapAllocator) markFrame(poolIndex int, frame mm.Frame, flag markAs) bool {
 	if poolIndex < 0 || frame > alloc.pools[poolIndex].endFrame {
-		return
+		return false
 	}
 
-	// The offset in the block is given by: frame % 64. As the bitmap uses a
-	// big-ending representation we need to set the bit at index: 63 - offset
-	relFrame := frame - alloc.pools[poolIndex].startFrame
-	block := relFrame >> 6
-	mask := uint64(1 << (63 - (relFrame - block<<6)))
+	pool := &alloc.pools[poolIndex]
+	block, mask := pool.bitmapBlockAndMask(frame)
 	switch flag {
 	case markFree:
-		alloc.pools[poolIndex].freeBitmap[block] &^= mask
-		alloc.pools[poolIndex].freeCount++
+		if pool.freeBitmap[block]&mask == 0 {
+			return false
+		}
+		pool.freeBitmap[block] &^= mask
+		pool.freeCount++
 		alloc.reservedPages--
+		pool.insertBlock(frame, 0)
+		resetFrameDescriptor(frame)
 	case markReserved:
-		alloc.pools[poolIndex].freeBitmap[block] |= mask
-		alloc.pools[poolIndex].freeCount--
+		if pool.freeBitmap[block]&mask != 0 {
+			return false
+		}
+		pool.freeBitmap[block] |= mask
+		pool.freeCount--
 		alloc.reservedPages++
+		pool.carveFrame(frame)
 	}
+
+	return true
+}
+
+// bitmapBlockAndMask returns the free bitmap block index and the bit mask
+// that correspond to the supplied frame.
+func (pool *framePool) bitmapBlockAndMask(frame mm.Frame) (uintptr, uint64) {
+	// The offset in the block is given by: frame % 64. As the bitmap uses a
+	// big-ending representation we need to set the bit at index: 63 - offset
+	relFrame := uintptr(frame - pool.startFrame)
+	block := relFrame >> 6
+	return block, uint64(1 << (63 - (relFrame - block<<6)))
 }
 
 // poolForFrame returns the index of the pool that contains frame or -1 if
@@ -199,15 +280,111 @@ func (alloc *BitmapAllocator) poolForFrame(frame mm.Frame) int {
 	return -1
 }
 
-// reserveKernelFrames makes as reserved the bitmap entries for the frames
-// occupied by the kernel image.
+// AddRegion hands the physical memory region [physAddr, physAddr+size) over to
+// the allocator. This allows the kernel to reuse memory regions that are no
+// longer needed after boot (e.g. ACPI-reclaimable memory). Only frames fully
+// contained in the region are added. Frames that belong to an existing pool are
+// flagged as free while the remaining frames are used to set up new pools. New
+// pools store their bitmaps in the first frames of the region that they manage.
+//
+// Callers must ensure that the region is not referenced by anything else once
+// AddRegion is invoked. AddRegion returns the number of frames that became
+// available for allocation.
+func (alloc *BitmapAllocator) AddRegion(physAddr, size uintptr) (uint32, *kernel.Error) {
+	startFrame := mm.Frame((physAddr + mm.PageSize - 1) >> mm.PageShift)
+	endFrame := mm.Frame((physAddr + size) >> mm.PageShift)
+	if endFrame <= startFrame {
+		return 0, nil
+	}
+
+	var addedFrames uint32
+	for frame, lastFrame := startFrame, endFrame-1; frame <= lastFrame; {
+		alloc.mutex.Acquire()
+		poolIndex := alloc.poolForFrame(frame)
+		if poolIndex >= 0 {
+			if alloc.markFrame(poolIndex, frame, markFree) {
+				addedFrames++
+			}
+			alloc.mutex.Release()
+			frame++
+			continue
+		}
+
+		// Find the longest run of unmanaged frames that does not cross a
+		// zone boundary and build a new pool for it
+		runEndFrame := zoneLastFrame(zoneForFrame(frame))
+		if runEndFrame > lastFrame {
+			runEndFrame = lastFrame
+		}
+		for poolIndex = 0; poolIndex < len(alloc.pools); poolIndex++ {
+			if poolStart := alloc.pools[poolIndex].startFrame; poolStart > frame && poolStart <= runEndFrame {
+				runEndFrame = poolStart - 1
+			}
+		}
+		alloc.mutex.Release()
+
+		poolFrames, err := alloc.addPool(frame, runEndFrame)
+		if err != nil {
+			return addedFrames, err
+		}
+
+		addedFrames += poolFrames
+		frame = runEndFrame + 1
+	}
+
+	return addedFrames, nil
+}
+
+// addPool sets up a new pool for the unmanaged frames [startFrame, endFrame].
+// The pool bitmaps are stored in the first frames of the range which are
+// excluded from the pool. The method returns the number of frames that the new
+// pool manages.
+func (alloc *BitmapAllocator) addPool(startFrame, endFrame mm.Frame) (uint32, *kernel.Error) {
+	if alloc.poolsHdr.Len == alloc.poolsHdr.Cap {
+		return 0, errBitmapAllocNoPoolSlots
+	}
+
+	bitmapPages := mm.Frame((poolBitmapBytes(startFrame, endFrame) + mm.PageSize - 1) >> mm.PageShift)
+	if endFrame-startFrame+1 <= bitmapPages {
+		// Region too small to be worth managing
+		return 0, nil
+	}
+
+	// Map the pool bitmaps without holding the allocator lock as mapFn
+	// may need to allocate frames for new page tables
+	bitmapStartAddr, err := reserveRegionFn(uintptr(bitmapPages) << mm.PageShift)
+	if err != nil {
+		return 0, err
+	}
+
+	for page, frame := mm.PageFromAddress(bitmapStartAddr), startFrame; frame < startFrame+bitmapPages; page, frame = page+1, frame+1 {
+		if err = mapFn(page, frame, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute); err != nil {
+			return 0, err
+		}
+
+		kernel.Memset(page.Address(), 0, mm.PageSize)
+	}
+
+	alloc.mutex.Acquire()
+	alloc.poolsHdr.Len++
+	alloc.pools = *(*[]framePool)(unsafe.Pointer(&alloc.poolsHdr))
+	pool := &alloc.pools[len(alloc.pools)-1]
+	pool.init(startFrame+bitmapPages, endFrame, bitmapStartAddr)
+	alloc.totalPages += pool.freeCount
+	alloc.mutex.Release()
+
+	return pool.freeCount, nil
+}
+
+// reserveKernelFrames marks as reserved the bitmap entries for the frames
+// occupied by the kernel image and updates their descriptors.
 func (alloc *BitmapAllocator) reserveKernelFrames() {
-	// Flag frames used by kernel image as reserved. Since the kernel must
-	// occupy a contiguous memory block we assume that all its frames will
-	// fall into one of the available memory pools
-	poolIndex := alloc.poolForFrame(bootMemAllocator.kernelStartFrame)
 	for frame := bootMemAllocator.kernelStartFrame; frame <= bootMemAllocator.kernelEndFrame; frame++ {
-		alloc.markFrame(poolIndex, frame, markReserved)
+		alloc.markFrame(alloc.poolForFrame(frame), frame, markReserved)
+
+		if desc := frame.Descriptor(); desc != nil {
+			*desc = mm.FrameDescriptor{RefCount: 1, Usage: mm.FrameUsageKernelImage, Flags: mm.FrameFlagPinned}
+		}
 	}
 }
 
@@ -228,6 +405,17 @@ func (alloc *BitmapAllocator) reserveEarlyAllocatorFrames() {
 			frame,
 			markReserved,
 		)
+
+		// Frames allocated by the early allocator are in use. Page
+		// table frames allocated after the descriptor table became
+		// available have been tagged by vmm.Map; the page tables that
+		// were allocated before that point are accounted as heap
+		// frames.
+		usage := mm.FrameUsageHeap
+		if desc := frame.Descriptor(); desc != nil && desc.Usage == mm.FrameUsagePageTable {
+			usage = mm.FrameUsagePageTable
+		}
+		claimFrameDescriptor(frame, usage)
 	}
 }
 
@@ -238,39 +426,118 @@ func (alloc *BitmapAllocator) printStats() {
 		alloc.totalPages,
 		alloc.reservedPages,
 	)
+
+	for zone := ZoneDMA; zone < zoneCount; zone++ {
+		var zoneTotal, zoneFree uint32
+		for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+			if alloc.pools[poolIndex].zone != zone {
+				continue
+			}
+
+			zoneTotal += uint32(alloc.pools[poolIndex].endFrame - alloc.pools[poolIndex].startFrame + 1)
+			zoneFree += alloc.pools[poolIndex].freeCount
+		}
+
+		kfmt.Printf(
+			"[bitmap_alloc] zone %6s: free: %d/%d (%d reserved)\n",
+			zone.String(),
+			zoneFree,
+			zoneTotal,
+			zoneTotal-zoneFree,
+		)
+	}
 }
 
-// AllocFrame reserves and returns a physical memory frame. An error will be
-// returned if no more memory can be allocated.
+// AllocFrame reserves and returns a physical memory frame. Frames are
+// allocated from ZoneNormal first so that the scarce low memory is preserved
+// for devices that need it. An error will be returned if no more memory can
+// be allocated.
 func (alloc *BitmapAllocator) AllocFrame() (mm.Frame, *kernel.Error) {
+	return alloc.allocFrames(ZoneNormal, 0, mm.FrameUsageHeap)
+}
+
+// AllocFrames reserves a block of 2^order physically contiguous frames and
+// returns the first frame in the block. The returned frame is always aligned
+// to a 2^order frame boundary. Like AllocFrame, AllocFrames prefers frames
+// from ZoneNormal. An error will be returned if order exceeds
+// mm.MaxFrameOrder or if no free block of the requested size is available.
+func (alloc *BitmapAllocator) AllocFrames(order uint8) (mm.Frame, *kernel.Error) {
+	return alloc.allocFrames(ZoneNormal, order, mm.FrameUsageHeap)
+}
+
+// AllocFrameInZone reserves and returns a physical memory frame that belongs
+// to the requested zone or, if the zone is exhausted, to one of the zones
+// below it. The frame usage is recorded as mm.FrameUsageDMA for allocations
+// targeting ZoneDMA or ZoneDMA32.
+func (alloc *BitmapAllocator) AllocFrameInZone(zone Zone) (mm.Frame, *kernel.Error) {
+	return alloc.AllocFramesInZone(zone, 0)
+}
+
+// AllocFramesInZone reserves a block of 2^order physically contiguous frames
+// that belongs to the requested zone or, if the zone is exhausted, to one of
+// the zones below it.
+func (alloc *BitmapAllocator) AllocFramesInZone(zone Zone, order uint8) (mm.Frame, *kernel.Error) {
+	usage := mm.FrameUsageHeap
+	if zone != ZoneNormal {
+		usage = mm.FrameUsageDMA
+	}
+
+	return alloc.allocFrames(zone, order, usage)
+}
+
+// allocFrames implements the block allocation logic for the AllocFrame* family
+// of functions. The pools for the requested zone are scanned first followed by
+// the pools of each lower zone.
+func (alloc *BitmapAllocator) allocFrames(zone Zone, order uint8, usage mm.FrameUsage) (mm.Frame, *kernel.Error) {
+	if zone >= zoneCount {
+		return mm.InvalidFrame, errBitmapAllocInvalidZone
+	}
+
+	if order > mm.MaxFrameOrder {
+		return mm.InvalidFrame, errBitmapAllocInvalidOrder
+	}
+
+	frameCount := uint32(1) << order
 	alloc.mutex.Acquire()
 
-	for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
-		if alloc.pools[poolIndex].freeCount == 0 {
-			continue
-		}
+	for curZone := int(zone); curZone >= int(ZoneDMA); curZone-- {
+		for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+			pool := &alloc.pools[poolIndex]
+			if pool.zone != Zone(curZone) || pool.freeCount < frameCount {
+				continue
+			}
 
-		fullBlock := uint64(math.MaxUint64)
-		for blockIndex, block := range alloc.pools[poolIndex].freeBitmap {
-			if block == fullBlock {
+			frame, ok := pool.allocBlock(order)
+			if !ok {
 				continue
 			}
 
-			// Block has at least one free slot; we need to scan its bits
-			for blockOffset, mask := 0, uint64(1<<63); mask > 0; blockOffset, mask = blockOffset+1, mask>>1 {
-				if block&mask != 0 {
-					continue
+			for curFrame := frame; curFrame < frame+mm.Frame(frameCount); curFrame++ {
+				if allocDebug.enabled {
+					allocDebug.checkPoison(curFrame)
 				}
 
-				alloc.pools[poolIndex].freeCount--
-				alloc.pools[poolIndex].freeBitmap[blockIndex] |= mask
-				alloc.reservedPages++
-				alloc.mutex.Release()
-				return alloc.pools[poolIndex].startFrame + mm.Frame((blockIndex<<6)+blockOffset), nil
+				block, mask := pool.bitmapBlockAndMask(curFrame)
+				pool.freeBitmap[block] |= mask
+				claimFrameDescriptor(curFrame, usage)
 			}
+			pool.freeCount -= frameCount
+			alloc.reservedPages += frameCount
+
+			if allocDebug.enabled {
+				allocDebug.recordAlloc(frame, order)
+			}
+
+			alloc.mutex.Release()
+			return frame, nil
 		}
 	}
 
+	if allocDebug.enabled {
+		kfmt.Printf("[pmm] unable to allocate block of order %d from zone %s\n", order, zone.String())
+		allocDebug.dumpRecentAllocs()
+	}
+
 	alloc.mutex.Release()
 	return mm.InvalidFrame, errBitmapAllocOutOfMemory
 }
@@ -279,26 +546,57 @@ func (alloc *BitmapAllocator) AllocFrame() (mm.Frame, *kernel.Error) {
 // Trying to release a frame not part of the allocator pools or a frame that
 // is already marked as free will cause an error to be returned.
 func (alloc *BitmapAllocator) FreeFrame(frame mm.Frame) *kernel.Error {
+	return alloc.FreeFrames(frame, 0)
+}
+
+// FreeFrames releases a block of 2^order frames previously allocated via a
+// call to AllocFrames. The released block is merged with its free buddies
+// into larger blocks whenever possible. Trying to release a block that is not
+// fully contained in one of the allocator pools or a block with frames that
+// are already marked as free will cause an error to be returned.
+func (alloc *BitmapAllocator) FreeFrames(frame mm.Frame, order uint8) *kernel.Error {
+	if order > mm.MaxFrameOrder {
+		return errBitmapAllocInvalidOrder
+	}
+
+	frameCount := mm.Frame(1) << order
+	if frame&(frameCount-1) != 0 {
+		return errBitmapAllocMisalignedBlock
+	}
+
 	alloc.mutex.Acquire()
 
 	poolIndex := alloc.poolForFrame(frame)
-	if poolIndex < 0 {
+	if poolIndex < 0 || !alloc.pools[poolIndex].blockInPool(frame, order) {
 		alloc.mutex.Release()
 		return errBitmapAllocFrameNotManaged
 	}
 
-	relFrame := frame - alloc.pools[poolIndex].startFrame
-	block := relFrame >> 6
-	mask := uint64(1 << (63 - (relFrame - block<<6)))
+	pool := &alloc.pools[poolIndex]
+	for curFrame := frame; curFrame < frame+frameCount; curFrame++ {
+		if block, mask := pool.bitmapBlockAndMask(curFrame); pool.freeBitmap[block]&mask == 0 {
+			if allocDebug.enabled {
+				allocDebug.printOwner(curFrame)
+			}
 
-	if alloc.pools[poolIndex].freeBitmap[block]&mask == 0 {
-		alloc.mutex.Release()
-		return errBitmapAllocDoubleFree
+			alloc.mutex.Release()
+			return errBitmapAllocDoubleFree
+		}
+	}
+
+	for curFrame := frame; curFrame < frame+frameCount; curFrame++ {
+		block, mask := pool.bitmapBlockAndMask(curFrame)
+		pool.freeBitmap[block] &^= mask
+		resetFrameDescriptor(curFrame)
+
+		if allocDebug.enabled {
+			allocDebug.poison(curFrame)
+		}
 	}
+	pool.freeCount += uint32(frameCount)
+	alloc.reservedPages -= uint32(frameCount)
+	pool.insertBlock(frame, order)
 
-	alloc.pools[poolIndex].freeBitmap[block] &^= mask
-	alloc.pools[poolIndex].freeCount++
-	alloc.reservedPages--
 	alloc.mutex.Release()
 	return nil
 }
@@ -8,16 +8,17 @@ import (
 )
 
 var (
-	errBootAllocOutOfMemory = &kernel.Error{Module: "boot_mem_alloc", Message: "out of memory"}
+	errBootAllocOutOfMemory      = &kernel.Error{Module: "boot_mem_alloc", Message: "out of memory"}
+	errBootAllocUnsupportedOrder = &kernel.Error{Module: "boot_mem_alloc", Message: "only single frame allocations are supported"}
+	errBootAllocFreeNotSupported = &kernel.Error{Module: "boot_mem_alloc", Message: "allocated frames cannot be released"}
 )
 
 // BootMemAllocator implements a rudimentary physical memory allocator which is
 // used to bootstrap the kernel.
 //
-// The allocator implementation uses the memory region information provided by
-// the bootloader to detect free memory blocks and return the next available
-// free frame.  Allocations are tracked via an internal counter that contains
-// the last allocated frame.
+// The allocator implementation uses the sanitized memory map to detect free
+// memory blocks and return the next available free frame. Allocations are
+// tracked via an internal counter that contains the last allocated frame.
 //
 // Due to the way that the allocator works, it is not possible to free
 // allocated pages. Once the kernel is properly initialized, the allocated
@@ -47,56 +48,37 @@ func (alloc *BootMemAllocator) init(kernelStart, kernelEnd uintptr) {
 
 }
 
-// AllocFrame scans the system memory regions reported by the bootloader and
-// reserves the next available free frame.
+// AllocFrame scans the sanitized memory map regions and reserves the next
+// available free frame. The frames occupied by the kernel image are part of
+// the memory map and are skipped.
 //
 // AllocFrame returns an error if no more memory can be allocated.
 func (alloc *BootMemAllocator) AllocFrame() (mm.Frame, *kernel.Error) {
 	var err = errBootAllocOutOfMemory
 
-	multiboot.VisitMemRegions(func(region *multiboot.MemoryMapEntry) bool {
-		// Ignore reserved regions and regions smaller than a single page
-		if region.Type != multiboot.MemAvailable || region.Length < uint64(mm.PageSize) {
+	sanitizedMemMap.visit(func(regionStartFrame, regionEndFrame mm.Frame) bool {
+		// Skip over already allocated regions
+		if alloc.allocCount != 0 && alloc.lastAllocFrame >= regionEndFrame {
 			return true
 		}
 
-		// Reported addresses may not be page-aligned; round up to get
-		// the start frame and round down to get the end frame
-		pageSizeMinus1 := uint64(mm.PageSize - 1)
-		regionStartFrame := mm.Frame(((region.PhysAddress + pageSizeMinus1) & ^pageSizeMinus1) >> mm.PageShift)
-		regionEndFrame := mm.Frame(((region.PhysAddress+region.Length) & ^pageSizeMinus1)>>mm.PageShift) - 1
-
-		// Skip over already allocated regions
-		if alloc.lastAllocFrame >= regionEndFrame {
-			return true
+		// Select the next frame in the region or, if this is the first
+		// allocation or we are in the previous region, jump to this one
+		nextFrame := alloc.lastAllocFrame + 1
+		if alloc.allocCount == 0 || alloc.lastAllocFrame < regionStartFrame {
+			nextFrame = regionStartFrame
 		}
 
-		// If last frame used a different region and the kernel image
-		// is located at the beginning of this region OR we are in
-		// current region but lastAllocFrame + 1 points to the kernel
-		// start we need to jump to the page following the kernel end
-		// frame
-		if (alloc.lastAllocFrame <= regionStartFrame && alloc.kernelStartFrame == regionStartFrame) ||
-			(alloc.lastAllocFrame <= regionEndFrame && alloc.lastAllocFrame+1 == alloc.kernelStartFrame) {
-			//fmt.Printf("last: %d, case: 1, set last: %d\n", alloc.lastAllocFrame, alloc.kernelEndFrame+1)
-			alloc.lastAllocFrame = alloc.kernelEndFrame + 1
-		} else if alloc.lastAllocFrame < regionStartFrame || alloc.allocCount == 0 {
-			// we are in the previous region and need to jump to this one OR
-			// this is the first allocation and the region begins at frame 0
-			//fmt.Printf("last: %d, case: 2, set last: %d\n", alloc.lastAllocFrame, regionStartFrame)
-			alloc.lastAllocFrame = regionStartFrame
-		} else {
-			// we are in the region and we can select the next frame
-			//fmt.Printf("last: %d, case: 3, set last: %d\n", alloc.lastAllocFrame, alloc.lastAllocFrame+1)
-			alloc.lastAllocFrame++
+		if nextFrame >= alloc.kernelStartFrame && nextFrame <= alloc.kernelEndFrame {
+			nextFrame = alloc.kernelEndFrame + 1
 		}
 
-		// The above adjustment might push lastAllocFrame outside of the
-		// region end (e.g kernel ends at last page in the region)
-		if alloc.lastAllocFrame > regionEndFrame {
+		// The kernel image may extend up to the region end
+		if nextFrame > regionEndFrame {
 			return true
 		}
 
+		alloc.lastAllocFrame = nextFrame
 		err = nil
 		return false
 	})
@@ -109,6 +91,27 @@ func (alloc *BootMemAllocator) AllocFrame() (mm.Frame, *kernel.Error) {
 	return alloc.lastAllocFrame, nil
 }
 
+// kernelFramesInMap returns the number of frames occupied by the kernel image
+// that are part of the sanitized memory map.
+func (alloc *BootMemAllocator) kernelFramesInMap() uint32 {
+	var count uint32
+
+	sanitizedMemMap.visit(func(regionStartFrame, regionEndFrame mm.Frame) bool {
+		if regionStartFrame < alloc.kernelStartFrame {
+			regionStartFrame = alloc.kernelStartFrame
+		}
+		if regionEndFrame > alloc.kernelEndFrame {
+			regionEndFrame = alloc.kernelEndFrame
+		}
+		if regionStartFrame <= regionEndFrame {
+			count += uint32(regionEndFrame - regionStartFrame + 1)
+		}
+		return true
+	})
+
+	return count
+}
+
 // printMemoryMap scans the memory region information provided by the
 // bootloader and prints out the system's memory map.
 func (alloc *BootMemAllocator) printMemoryMap() {
@@ -0,0 +1,48 @@
+package pmm
+
+import (
+	"goose/kernel/mm"
+	"goose/multiboot"
+	"testing"
+)
+
+func TestBootMemAllocatorSkipsKernelImage(t *testing.T) {
+	const mb = 0x100000
+
+	defer func(origMap memoryMap, origAlloc BootMemAllocator) {
+		sanitizedMemMap, bootMemAllocator = origMap, origAlloc
+	}(sanitizedMemMap, bootMemAllocator)
+
+	restore := mockMemMapSources([]multiboot.MemoryMapEntry{
+		{PhysAddress: 0, Length: 0x9fc00, Type: multiboot.MemAvailable},
+		// The kernel image occupies the first four frames of this region
+		{PhysAddress: mb, Length: 0x6000, Type: multiboot.MemAvailable},
+		{PhysAddress: 2 * mb, Length: 0x3000, Type: multiboot.MemAvailable},
+	}, 0, 0, nil)
+	defer restore()
+
+	var alloc BootMemAllocator
+	alloc.init(mb, mb+0x4000)
+	sanitizedMemMap.build(mb, mb+0x4000, 0)
+
+	expFrames := []mm.Frame{0x104, 0x105, 0x200, 0x201, 0x202}
+	for index, expFrame := range expFrames {
+		frame, err := alloc.AllocFrame()
+		if err != nil {
+			t.Fatalf("[alloc %d] unexpected error: %v", index, err)
+		}
+
+		if frame != expFrame {
+			t.Fatalf("[alloc %d] expected frame 0x%x; got 0x%x", index, expFrame, frame)
+		}
+	}
+
+	if _, err := alloc.AllocFrame(); err != errBootAllocOutOfMemory {
+		t.Fatalf("expected errBootAllocOutOfMemory; got %v", err)
+	}
+
+	// The kernel frames are part of the memory map
+	if got := alloc.kernelFramesInMap(); got != 4 {
+		t.Fatalf("expected 4 kernel frames in the memory map; got %d", got)
+	}
+}
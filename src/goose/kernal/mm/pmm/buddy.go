@@ -0,0 +1,190 @@
+package pmm
+
+import "goose/kernel/mm"
+
+// The bitmap allocator services multi-frame allocations using a binary buddy
+// scheme. Each pool maintains one free area per block order. A block of order
+// n contains 2^n contiguous frames and always starts at a frame number that is
+// a multiple of 2^n. Two blocks of order n whose first frames only differ in
+// bit n are buddies and are merged into a single block of order n+1 when both
+// become free.
+//
+// As the kernel does not maintain a direct mapping of physical memory, the
+// free frames themselves cannot be used for storing free-list links. Instead,
+// each free area tracks its free blocks using a summary bitmap that is
+// allocated together with the pool free bitmap. Bit i of the bitmap for order
+// n is set if the block starting at frame ((startFrame >> n) + i) << n is free.
+
+// freeArea tracks the free blocks of a particular order within a pool.
+type freeArea struct {
+	// freeCount tracks the number of free blocks in this area. It allows
+	// the allocator to skip empty areas without scanning the bitmap.
+	freeCount uint32
+
+	bitmap summaryBitmap
+}
+
+// test returns true if the block at the specified index is free.
+func (area *freeArea) test(index uintptr) bool {
+	return area.bitmap.test(index)
+}
+
+// set flags the block at the specified index as free.
+func (area *freeArea) set(index uintptr) {
+	area.bitmap.set(index)
+	area.freeCount++
+}
+
+// clear flags the block at the specified index as not free.
+func (area *freeArea) clear(index uintptr) {
+	area.bitmap.clear(index)
+	area.freeCount--
+}
+
+// nextFree returns the index of the first free block in this area that is
+// located at or after the supplied index, wrapping around to the beginning of
+// the area if required. The caller must ensure that freeCount is not zero
+// before invoking nextFree.
+func (area *freeArea) nextFree(start uintptr) uintptr {
+	index, ok := area.bitmap.find(start)
+	if !ok && start != 0 {
+		index, _ = area.bitmap.find(0)
+	}
+
+	return index
+}
+
+// freeAreaBits returns the number of bits required for tracking the blocks of
+// the specified order that overlap the frame range [startFrame, endFrame].
+func freeAreaBits(startFrame, endFrame mm.Frame, order uint8) uintptr {
+	return uintptr(endFrame>>order-startFrame>>order) + 1
+}
+
+// setupFreeAreas initializes the free area bitmaps for the pool using the
+// memory starting at bitmapStartAddr and returns the address right after the
+// last bitmap. All pool frames are initially inserted into the free areas
+// using the largest blocks that fit in the pool.
+func (pool *framePool) setupFreeAreas(bitmapStartAddr uintptr) uintptr {
+	for order := uint8(0); order <= mm.MaxFrameOrder; order++ {
+		pool.freeAreas[order].freeCount = 0
+		bitmapStartAddr = pool.freeAreas[order].bitmap.init(
+			freeAreaBits(pool.startFrame, pool.endFrame, order),
+			bitmapStartAddr,
+		)
+	}
+
+	for frame := pool.startFrame; frame <= pool.endFrame; {
+		order := uint8(mm.MaxFrameOrder)
+		for ; order > 0 && !pool.blockInPool(frame, order); order-- {
+		}
+
+		pool.freeAreas[order].set(pool.areaIndex(frame, order))
+		frame += mm.Frame(1) << order
+	}
+
+	return bitmapStartAddr
+}
+
+// blockInPool returns true if frame is aligned to the specified order and the
+// block of 2^order frames that starts at frame is fully contained in the pool.
+func (pool *framePool) blockInPool(frame mm.Frame, order uint8) bool {
+	blockSize := mm.Frame(1) << order
+	return frame&(blockSize-1) == 0 && frame >= pool.startFrame && frame+blockSize-1 <= pool.endFrame
+}
+
+// areaIndex returns the free area bitmap index for the block of the specified
+// order that starts at frame.
+func (pool *framePool) areaIndex(frame mm.Frame, order uint8) uintptr {
+	return uintptr(frame>>order - pool.startFrame>>order)
+}
+
+// nextFitIndex returns the free area index for the specified order where the
+// search for a free block should begin. Searches start at the frame following
+// the most recent allocation from the pool (next-fit) so that recently
+// exhausted regions are not re-scanned.
+func (pool *framePool) nextFitIndex(order uint8) uintptr {
+	if pool.nextFitFrame <= pool.startFrame || pool.nextFitFrame > pool.endFrame {
+		return 0
+	}
+
+	return pool.areaIndex(pool.nextFitFrame, order)
+}
+
+// allocBlock removes a free block of the requested order from the pool free
+// areas and returns its first frame. If no block of the requested order is
+// available, a larger block is split and the unused halves are returned to
+// the lower order free areas.
+func (pool *framePool) allocBlock(order uint8) (mm.Frame, bool) {
+	for curOrder := order; curOrder <= mm.MaxFrameOrder; curOrder++ {
+		area := &pool.freeAreas[curOrder]
+		if area.freeCount == 0 {
+			continue
+		}
+
+		index := area.nextFree(pool.nextFitIndex(curOrder))
+		area.clear(index)
+		frame := mm.Frame((uintptr(pool.startFrame>>curOrder) + index) << curOrder)
+		pool.nextFitFrame = frame + mm.Frame(1)<<order
+
+		for curOrder > order {
+			curOrder--
+			buddy := frame + mm.Frame(1)<<curOrder
+			pool.freeAreas[curOrder].set(pool.areaIndex(buddy, curOrder))
+		}
+
+		return frame, true
+	}
+
+	return mm.InvalidFrame, false
+}
+
+// insertBlock returns a block of the specified order to the pool free areas,
+// merging it with its buddy for as long as the buddy is also free.
+func (pool *framePool) insertBlock(frame mm.Frame, order uint8) {
+	for ; order < mm.MaxFrameOrder; order++ {
+		buddy := frame ^ mm.Frame(1)<<order
+		if !pool.blockInPool(buddy, order) || !pool.freeAreas[order].test(pool.areaIndex(buddy, order)) {
+			break
+		}
+
+		pool.freeAreas[order].clear(pool.areaIndex(buddy, order))
+		frame &^= mm.Frame(1) << order
+	}
+
+	pool.freeAreas[order].set(pool.areaIndex(frame, order))
+}
+
+// carveFrame removes a single frame from the pool free areas. The free block
+// that contains the frame is split and all parts not containing the frame are
+// returned to the lower order free areas. carveFrame returns false if the
+// frame is not part of any free block.
+func (pool *framePool) carveFrame(frame mm.Frame) bool {
+	for order := uint8(0); order <= mm.MaxFrameOrder; order++ {
+		blockFrame := frame &^ (mm.Frame(1)<<order - 1)
+		if !pool.blockInPool(blockFrame, order) {
+			// Larger blocks cannot fit in the pool either
+			break
+		}
+
+		index := pool.areaIndex(blockFrame, order)
+		if !pool.freeAreas[order].test(index) {
+			continue
+		}
+
+		pool.freeAreas[order].clear(index)
+		for order > 0 {
+			order--
+			half := mm.Frame(1) << order
+			if frame&half != 0 {
+				pool.freeAreas[order].set(pool.areaIndex(blockFrame, order))
+				blockFrame += half
+			} else {
+				pool.freeAreas[order].set(pool.areaIndex(blockFrame+half, order))
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
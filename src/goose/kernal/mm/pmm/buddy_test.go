@@ -0,0 +1,196 @@
+package pmm
+
+import (
+	"goose/kernel/mm"
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+// newTestPool returns a framePool for the frame range [startFrame, endFrame]
+// with its free areas set up together with the slice that backs the free area
+// bitmaps.
+func newTestPool(startFrame, endFrame mm.Frame) (*framePool, []uint64) {
+	var (
+		pool  = &framePool{startFrame: startFrame, endFrame: endFrame}
+		words uintptr
+	)
+
+	for order := uint8(0); order <= mm.MaxFrameOrder; order++ {
+		words += summaryBitmapWords(freeAreaBits(startFrame, endFrame, order))
+	}
+
+	backing := make([]uint64, words)
+	pool.setupFreeAreas(uintptr(unsafe.Pointer(&backing[0])))
+	return pool, backing
+}
+
+// freeCounts returns the number of free blocks for each order.
+func freeCounts(pool *framePool) [mm.MaxFrameOrder + 1]uint32 {
+	var counts [mm.MaxFrameOrder + 1]uint32
+	for order := range pool.freeAreas {
+		counts[order] = pool.freeAreas[order].freeCount
+	}
+	return counts
+}
+
+// freeFrameCount returns the number of frames in all free blocks.
+func freeFrameCount(pool *framePool) uint32 {
+	var count uint32
+	for order := range pool.freeAreas {
+		count += pool.freeAreas[order].freeCount << uint(order)
+	}
+	return count
+}
+
+func TestSetupFreeAreas(t *testing.T) {
+	specs := []struct {
+		startFrame, endFrame mm.Frame
+		expCounts            map[uint8]uint32
+	}{
+		{0, 1023, map[uint8]uint32{10: 1}},
+		{0, 2047, map[uint8]uint32{10: 2}},
+		{1024, 1024 + 1536 - 1, map[uint8]uint32{10: 1, 9: 1}},
+		// unaligned pool boundaries: 3, 4-7, 8-15, ..., 512-1023, 1024
+		{3, 1024, map[uint8]uint32{0: 2, 2: 1, 3: 1, 4: 1, 5: 1, 6: 1, 7: 1, 8: 1, 9: 1}},
+	}
+
+	for specIndex, spec := range specs {
+		pool, _ := newTestPool(spec.startFrame, spec.endFrame)
+
+		var expCounts [mm.MaxFrameOrder + 1]uint32
+		for order, count := range spec.expCounts {
+			expCounts[order] = count
+		}
+
+		if got := freeCounts(pool); got != expCounts {
+			t.Errorf("[spec %d] expected free block counts %v; got %v", specIndex, expCounts, got)
+		}
+
+		if exp, got := uint32(spec.endFrame-spec.startFrame+1), freeFrameCount(pool); got != exp {
+			t.Errorf("[spec %d] expected %d free frames; got %d", specIndex, exp, got)
+		}
+	}
+}
+
+func TestBuddySplitMerge(t *testing.T) {
+	for order := uint8(0); order <= mm.MaxFrameOrder; order++ {
+		pool, _ := newTestPool(0, 1023)
+		initial := freeCounts(pool)
+
+		frame, ok := pool.allocBlock(order)
+		if !ok || frame != 0 {
+			t.Fatalf("[order %d] expected to allocate block at frame 0; got %d, %t", order, frame, ok)
+		}
+
+		// Splitting the order-10 block leaves one free buddy in each
+		// order below it down to the requested order
+		for curOrder := uint8(0); curOrder <= mm.MaxFrameOrder; curOrder++ {
+			exp := uint32(0)
+			if curOrder >= order && curOrder < mm.MaxFrameOrder {
+				exp = 1
+			}
+
+			if got := pool.freeAreas[curOrder].freeCount; got != exp {
+				t.Errorf("[order %d] expected %d free blocks of order %d after split; got %d", order, exp, curOrder, got)
+			}
+		}
+
+		pool.insertBlock(frame, order)
+		if got := freeCounts(pool); got != initial {
+			t.Errorf("[order %d] expected free block counts %v after merge; got %v", order, initial, got)
+		}
+	}
+}
+
+func TestBuddyMergeStopsAtPoolBoundary(t *testing.T) {
+	// The buddy of the order-9 block [1024, 1535] lies outside the pool
+	pool, _ := newTestPool(1024, 1024+1536-1)
+	initial := freeCounts(pool)
+
+	frame, ok := pool.allocBlock(9)
+	if !ok {
+		t.Fatal("expected allocation to succeed")
+	}
+
+	pool.insertBlock(frame, 9)
+	if got := freeCounts(pool); got != initial {
+		t.Errorf("expected free block counts %v; got %v", initial, got)
+	}
+}
+
+func TestBuddyRandomRoundTrip(t *testing.T) {
+	type block struct {
+		frame mm.Frame
+		order uint8
+	}
+
+	var (
+		rng      = rand.New(rand.NewSource(42))
+		pool, _  = newTestPool(3, 4096+77)
+		initial  = freeCounts(pool)
+		used     = make(map[mm.Frame]bool)
+		blocks   []block
+		attempts int
+	)
+
+	for ; attempts < 10000; attempts++ {
+		order := uint8(rng.Intn(mm.MaxFrameOrder + 1))
+		frame, ok := pool.allocBlock(order)
+		if !ok {
+			if order == 0 {
+				break
+			}
+			continue
+		}
+
+		if frame&(mm.Frame(1)<<order-1) != 0 || !pool.blockInPool(frame, order) {
+			t.Fatalf("block at frame %d with order %d is misaligned or outside the pool", frame, order)
+		}
+
+		for curFrame := frame; curFrame < frame+mm.Frame(1)<<order; curFrame++ {
+			if used[curFrame] {
+				t.Fatalf("frame %d allocated twice", curFrame)
+			}
+			used[curFrame] = true
+		}
+
+		blocks = append(blocks, block{frame, order})
+	}
+
+	if freeFrameCount(pool) != 0 {
+		t.Fatalf("expected pool to be exhausted; %d frames are still free", freeFrameCount(pool))
+	}
+
+	for _, index := range rng.Perm(len(blocks)) {
+		pool.insertBlock(blocks[index].frame, blocks[index].order)
+	}
+
+	if got := freeCounts(pool); got != initial {
+		t.Errorf("expected free block counts %v after releasing all blocks; got %v", initial, got)
+	}
+}
+
+func TestCarveFrame(t *testing.T) {
+	pool, _ := newTestPool(0, 1023)
+	initial := freeCounts(pool)
+
+	for _, frame := range []mm.Frame{0, 5, 512, 1023} {
+		if !pool.carveFrame(frame) {
+			t.Fatalf("expected frame %d to be carved", frame)
+		}
+
+		if pool.carveFrame(frame) {
+			t.Fatalf("expected carving the already carved frame %d to fail", frame)
+		}
+
+		if exp, got := uint32(1023), freeFrameCount(pool); got != exp {
+			t.Errorf("[frame %d] expected %d free frames; got %d", frame, exp, got)
+		}
+
+		pool.insertBlock(frame, 0)
+		if got := freeCounts(pool); got != initial {
+			t.Errorf("[frame %d] expected free block counts %v; got %v", frame, initial, got)
+		}
+	}
+}
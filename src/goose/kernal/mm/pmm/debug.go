@@ -0,0 +1,215 @@
+package pmm
+
+import (
+	"goose/kernel"
+	"goose/kernel/kfmt"
+	"goose/kernel/mm"
+	"goose/kernel/mm/vmm"
+	"goose/multiboot"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	// debugCmdLineKey is the boot command line key that enables the
+	// allocator debug mode when set to "on".
+	debugCmdLineKey = "pmm.debug"
+
+	// debugPoisonPattern is written to each freed frame while the debug
+	// mode is enabled.
+	debugPoisonPattern = uint64(0xdeadbeefdeadbeef)
+
+	// debugAllocHistorySize is the number of recent allocations that are
+	// tracked by the debug mode for reporting frame owners.
+	debugAllocHistorySize = 1024
+
+	// debugRecentAllocCount is the number of recent allocations that are
+	// dumped when an allocation request fails.
+	debugRecentAllocCount = 32
+)
+
+var (
+	errBitmapAllocUseAfterFree = &kernel.Error{Module: "bitmap_alloc", Message: "free frame was modified after being released (use-after-free)"}
+
+	// lookupBootCmdLineFn is used by tests and is automatically inlined
+	// by the compiler.
+	lookupBootCmdLineFn = multiboot.LookupBootCmdLine
+)
+
+// allocRecord describes a block allocation.
+type allocRecord struct {
+	frame mm.Frame
+	order uint8
+	pc    uintptr
+}
+
+// allocDebugger implements the allocator debug mode which helps tracking down
+// memory corruption bugs. When enabled, the debugger poisons freed frames and
+// verifies the poison pattern when the frames get allocated again so that
+// writes to freed frames can be detected. It also keeps a fixed-size ring
+// buffer with the frames and PCs of the most recent allocations which is used
+// for reporting the owner of corrupted frames and is dumped when an allocation
+// request fails.
+type allocDebugger struct {
+	enabled bool
+
+	// scratchPage is a private page that is remapped to each frame that
+	// needs to be poisoned or checked. It is pre-mapped when the debugger
+	// is initialized so that remapping it never needs to allocate page
+	// tables while the allocator lock is held.
+	scratchPage mm.Page
+
+	recentAllocs     [debugAllocHistorySize]allocRecord
+	nextRecentAlloc  int
+	recentAllocCount int
+}
+
+// allocDebug is the debugger instance used by the bitmap allocator.
+var allocDebug allocDebugger
+
+// init enables the debug mode if requested via the boot command line. The
+// frame for the scratch page is obtained from the early allocator.
+func (dbg *allocDebugger) init() *kernel.Error {
+	if value, found := lookupBootCmdLineFn(debugCmdLineKey); !found || value != "on" {
+		return nil
+	}
+
+	// Mapping the scratch page here also allocates the page tables that
+	// are needed for remapping it later on.
+	regionAddr, err := reserveRegionFn(mm.PageSize)
+	if err != nil {
+		return err
+	}
+
+	frame, err := earlyAllocFrame()
+	if err != nil {
+		return err
+	}
+
+	dbg.scratchPage = mm.PageFromAddress(regionAddr)
+	if err = mapFn(dbg.scratchPage, frame, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute); err != nil {
+		return err
+	}
+
+	kernel.Memset(regionAddr, 0, mm.PageSize)
+	dbg.enabled = true
+
+	kfmt.Printf("[pmm] debug mode enabled: freed frames will be poisoned\n")
+	return nil
+}
+
+// mapScratch maps the scratch page to the supplied frame and returns a pointer
+// to the first word of the frame contents. As the scratch page is already
+// mapped, remapping it never needs to allocate page tables.
+func (dbg *allocDebugger) mapScratch(frame mm.Frame) uintptr {
+	_ = remapFn(dbg.scratchPage, frame, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute)
+	return dbg.scratchPage.Address()
+}
+
+// poison fills a freed frame with the poison pattern and flags its descriptor
+// so that the pattern gets verified when the frame is allocated again.
+func (dbg *allocDebugger) poison(frame mm.Frame) {
+	desc := frame.Descriptor()
+	if desc == nil {
+		return
+	}
+
+	for addr, endAddr := dbg.mapScratch(frame), dbg.scratchPage.Address()+mm.PageSize; addr < endAddr; addr += 8 {
+		*(*uint64)(unsafe.Pointer(addr)) = debugPoisonPattern
+	}
+
+	desc.Flags |= mm.FrameFlagPoisoned
+}
+
+// checkPoison verifies that a previously poisoned frame that is about to be
+// allocated has not been modified since it was freed. If a modification is
+// detected, the debugger reports the last owner of the frame and panics.
+func (dbg *allocDebugger) checkPoison(frame mm.Frame) {
+	desc := frame.Descriptor()
+	if desc == nil || !desc.HasFlags(mm.FrameFlagPoisoned) {
+		return
+	}
+
+	startAddr := dbg.mapScratch(frame)
+	for addr, endAddr := startAddr, startAddr+mm.PageSize; addr < endAddr; addr += 8 {
+		if value := *(*uint64)(unsafe.Pointer(addr)); value != debugPoisonPattern {
+			kfmt.Printf("[pmm] frame 0x%x modified after being freed: offset: 0x%x, value: 0x%16x\n", frame.Address(), addr-startAddr, value)
+			dbg.printOwner(frame)
+			kfmt.Panic(errBitmapAllocUseAfterFree)
+		}
+	}
+}
+
+// recordAlloc adds a block allocation together with the PC of the code that
+// requested it to the recent allocation ring buffer.
+func (dbg *allocDebugger) recordAlloc(frame mm.Frame, order uint8) {
+	dbg.recentAllocs[dbg.nextRecentAlloc] = allocRecord{frame: frame, order: order, pc: callerPC()}
+	dbg.nextRecentAlloc = (dbg.nextRecentAlloc + 1) % debugAllocHistorySize
+	if dbg.recentAllocCount < debugAllocHistorySize {
+		dbg.recentAllocCount++
+	}
+}
+
+// recentAlloc returns the n-th most recent allocation record where n = 0
+// corresponds to the latest allocation.
+func (dbg *allocDebugger) recentAlloc(n int) *allocRecord {
+	return &dbg.recentAllocs[(dbg.nextRecentAlloc-1-n+debugAllocHistorySize)%debugAllocHistorySize]
+}
+
+// printOwner outputs the code location that last allocated the supplied frame
+// if the allocation is still tracked by the recent allocation ring buffer.
+func (dbg *allocDebugger) printOwner(frame mm.Frame) {
+	for i := 0; i < dbg.recentAllocCount; i++ {
+		if rec := dbg.recentAlloc(i); frame >= rec.frame && frame < rec.frame+mm.Frame(1)<<rec.order {
+			kfmt.Printf("[pmm] frame 0x%x: last allocated by %s (pc: 0x%x)\n", frame.Address(), funcNameForPC(rec.pc), rec.pc)
+			return
+		}
+	}
+
+	kfmt.Printf("[pmm] frame 0x%x: owner unknown\n", frame.Address())
+}
+
+// dumpRecentAllocs outputs up to debugRecentAllocCount of the most recent
+// allocations starting from the latest one.
+func (dbg *allocDebugger) dumpRecentAllocs() {
+	kfmt.Printf("[pmm] most recent allocations:\n")
+	for i := 0; i < dbg.recentAllocCount && i < debugRecentAllocCount; i++ {
+		rec := dbg.recentAlloc(i)
+		kfmt.Printf("\t[0x%16x - 0x%16x] order: %d, allocated by %s (pc: 0x%x)\n",
+			rec.frame.Address(),
+			(rec.frame+mm.Frame(1)<<rec.order).Address()-1,
+			rec.order,
+			funcNameForPC(rec.pc),
+			rec.pc,
+		)
+	}
+}
+
+// callerPC returns the PC of the first caller outside of the memory management
+// packages.
+func callerPC() uintptr {
+	var pcs [8]uintptr
+
+	pcCount := runtime.Callers(2, pcs[:])
+	for i := 0; i < pcCount; i++ {
+		if name := funcNameForPC(pcs[i]); !hasPrefix(name, "goose/kernel/mm.") && !hasPrefix(name, "goose/kernel/mm/pmm.") {
+			return pcs[i]
+		}
+	}
+
+	return 0
+}
+
+// funcNameForPC returns the name of the function that contains pc.
+func funcNameForPC(pc uintptr) string {
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		return fn.Name()
+	}
+
+	return "unknown"
+}
+
+// hasPrefix is an allocation-free equivalent of strings.HasPrefix.
+func hasPrefix(s, prefix string) bool {
+	return len(s) >= len(prefix) && s[:len(prefix)] == prefix
+}
@@ -0,0 +1,94 @@
+package pmm
+
+import (
+	"goose/kernel"
+	"goose/kernel/kfmt"
+	"goose/kernel/mm"
+	"goose/kernel/mm/vmm"
+	"goose/multiboot"
+)
+
+// setupFrameDescriptors uses the early allocator to allocate and map the
+// frame descriptor table for all frames that belong to a usable memory region
+// reported by the bootloader. Holes between the usable regions (e.g. MMIO
+// regions) are not covered by the table. All descriptors are initially flagged
+// as reserved and pinned; the bitmap allocator will update the descriptors for
+// the frames that it manages when it gets initialized.
+func setupFrameDescriptors() *kernel.Error {
+	var (
+		pageSizeMinus1 = mm.PageSize - 1
+		usable         memRangeList
+		maxFrame       mm.Frame
+		descCount      uintptr
+	)
+
+	multiboot.VisitMemRegions(func(region *multiboot.MemoryMapEntry) bool {
+		if region.Type == multiboot.MemAvailable || region.Type == multiboot.MemAcpiReclaimable {
+			usable.add(region.PhysAddress, region.PhysAddress+region.Length)
+		}
+		return true
+	})
+	usable.sortAndMerge()
+
+	for i := 0; i < usable.count; i++ {
+		startFrame := mm.Frame(usable.ranges[i].start >> mm.PageShift)
+		endFrame := mm.Frame((usable.ranges[i].end - 1) >> mm.PageShift)
+
+		// Ranges that share a frame after rounding are merged
+		if descCount != 0 && startFrame <= maxFrame {
+			if endFrame <= maxFrame {
+				continue
+			}
+			startFrame = maxFrame + 1
+		}
+
+		descCount = mm.AddFrameDescriptorRange(startFrame, endFrame)
+		maxFrame = endFrame
+	}
+
+	requiredBytes := (descCount*mm.FrameDescriptorSize() + pageSizeMinus1) & ^pageSizeMinus1
+	tableAddr, err := reserveRegionFn(requiredBytes)
+	if err != nil {
+		return err
+	}
+
+	for page, pageCount := mm.PageFromAddress(tableAddr), requiredBytes>>mm.PageShift; pageCount > 0; page, pageCount = page+1, pageCount-1 {
+		nextFrame, err := earlyAllocFrame()
+		if err != nil {
+			return err
+		}
+
+		if err = mapFn(page, nextFrame, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute); err != nil {
+			return err
+		}
+
+		kernel.Memset(page.Address(), 0, mm.PageSize)
+	}
+
+	mm.SetFrameDescriptorTable(tableAddr, descCount)
+	mm.VisitFrameDescriptorRanges(func(_ mm.Frame, descs []mm.FrameDescriptor) bool {
+		for i := range descs {
+			descs[i].Usage = mm.FrameUsageReserved
+			descs[i].Flags = mm.FrameFlagPinned
+		}
+		return true
+	})
+
+	kfmt.Printf("[pmm] frame descriptors: %d (%d Kb)\n", uint64(descCount), uint64(requiredBytes>>10))
+	return nil
+}
+
+// resetFrameDescriptor marks the descriptor for the supplied frame as free.
+func resetFrameDescriptor(frame mm.Frame) {
+	if desc := frame.Descriptor(); desc != nil {
+		*desc = mm.FrameDescriptor{Usage: mm.FrameUsageFree}
+	}
+}
+
+// claimFrameDescriptor updates the descriptor for a frame that has just been
+// handed out by an allocator.
+func claimFrameDescriptor(frame mm.Frame, usage mm.FrameUsage) {
+	if desc := frame.Descriptor(); desc != nil {
+		*desc = mm.FrameDescriptor{RefCount: 1, Usage: usage}
+	}
+}
@@ -0,0 +1,235 @@
+package pmm
+
+import (
+	"goose/kernel/kfmt"
+	"goose/kernel/mm"
+	"goose/multiboot"
+)
+
+// maxMemMapRegions defines the maximum number of entries that can be tracked
+// by the sanitized memory map.
+const maxMemMapRegions = 128
+
+// lowMemoryEnd marks the end of the low memory area that hosts the BIOS data
+// structures, the EBDA and the legacy video/ROM regions. Memory below this
+// address is never handed out by the allocators.
+const lowMemoryEnd = 0x100000
+
+var (
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	visitMemRegionsFn  = multiboot.VisitMemRegions
+	infoRegionFn       = multiboot.InfoRegion
+	visitModulesFn     = multiboot.VisitModules
+	visitElfSectionsFn = multiboot.VisitElfSections
+)
+
+// memRange describes the physical address range [start, end).
+type memRange struct {
+	start, end uint64
+}
+
+// memRangeList is a fixed-capacity list of memory ranges. A fixed array is
+// used as the memory map needs to be built before any allocator is available.
+type memRangeList struct {
+	count  int
+	ranges [maxMemMapRegions]memRange
+
+	// dropped counts the ranges that could not be stored because the list
+	// was full.
+	dropped int
+}
+
+// add appends a range to the list. Empty ranges are ignored.
+func (l *memRangeList) add(start, end uint64) {
+	if end <= start {
+		return
+	}
+
+	if l.count == maxMemMapRegions {
+		l.dropped++
+		return
+	}
+
+	l.ranges[l.count] = memRange{start, end}
+	l.count++
+}
+
+// remove deletes the range at the specified index.
+func (l *memRangeList) remove(index int) {
+	copy(l.ranges[index:l.count-1], l.ranges[index+1:l.count])
+	l.count--
+}
+
+// sortAndMerge sorts the list by start address and merges any overlapping or
+// adjacent ranges.
+func (l *memRangeList) sortAndMerge() {
+	// The list is small so insertion sort is good enough
+	for i := 1; i < l.count; i++ {
+		for j := i; j > 0 && l.ranges[j].start < l.ranges[j-1].start; j-- {
+			l.ranges[j], l.ranges[j-1] = l.ranges[j-1], l.ranges[j]
+		}
+	}
+
+	for i := 1; i < l.count; {
+		if prev := &l.ranges[i-1]; l.ranges[i].start <= prev.end {
+			if l.ranges[i].end > prev.end {
+				prev.end = l.ranges[i].end
+			}
+			l.remove(i)
+			continue
+		}
+		i++
+	}
+}
+
+// subtract removes the address range [start, end) from all list entries,
+// splitting entries that fully contain it. The list must be sorted.
+func (l *memRangeList) subtract(start, end uint64) {
+	for i := 0; i < l.count; i++ {
+		r := &l.ranges[i]
+		switch {
+		case end <= r.start || start >= r.end:
+			// no overlap
+		case start <= r.start && end >= r.end:
+			// range fully covered
+			l.remove(i)
+			i--
+		case start <= r.start:
+			// overlap at the beginning
+			r.start = end
+		case end >= r.end:
+			// overlap at the end
+			r.end = start
+		default:
+			// range contains [start, end); split it in two
+			tail := memRange{end, r.end}
+			r.end = start
+			if l.count == maxMemMapRegions {
+				l.dropped++
+				continue
+			}
+			copy(l.ranges[i+2:l.count+1], l.ranges[i+1:l.count])
+			l.ranges[i+1] = tail
+			l.count++
+			i++
+		}
+	}
+}
+
+// memoryMap contains the sanitized list of physical memory regions that the
+// allocators are allowed to manage. Its entries are sorted, do not overlap and
+// have frame granularity.
+//
+// The frames occupied by the kernel image are part of the map so that the
+// pools built by the bitmap allocator also cover them. The allocators treat
+// these frames as reserved; this allows parts of the kernel image that are
+// released after boot (e.g. the copy of the multiboot info payload in the
+// kernel .bss) to be returned to the pool that covers them.
+type memoryMap struct {
+	count   int
+	regions [maxMemMapRegions]struct {
+		startFrame, endFrame mm.Frame
+	}
+}
+
+// sanitizedMemMap is built by pmm.Init and consumed by all allocators.
+var sanitizedMemMap memoryMap
+
+// build populates the memory map using the regions reported by the bootloader.
+// Available regions are sorted and merged and then any overlapping non-available
+// region is subtracted from them; in other words, reserved regions always win.
+// The low 1M memory area, the multiboot info payload, any boot modules and any
+// ELF sections loaded outside the kernel image are also excluded from the map.
+func (m *memoryMap) build(kernelStart, kernelEnd, kernelPageOffset uintptr) {
+	var available, reserved memRangeList
+
+	visitMemRegionsFn(func(region *multiboot.MemoryMapEntry) bool {
+		switch region.Type {
+		case multiboot.MemAvailable:
+			available.add(region.PhysAddress, region.PhysAddress+region.Length)
+		default:
+			reserved.add(region.PhysAddress, region.PhysAddress+region.Length)
+		}
+		return true
+	})
+
+	// Exclude the areas that are in use by the firmware and the
+	// bootloader. The multiboot info payload only needs to be excluded if
+	// it is not part of the kernel image.
+	reserved.add(0, lowMemoryEnd)
+	if infoAddr, infoSize := infoRegionFn(); infoSize != 0 {
+		if infoAddr >= kernelPageOffset {
+			infoAddr -= kernelPageOffset
+		}
+
+		if infoAddr+infoSize <= kernelStart || infoAddr >= kernelEnd {
+			reserved.add(uint64(infoAddr), uint64(infoAddr+infoSize))
+		}
+	}
+
+	// Boot modules must be preserved so that other subsystems can access
+	// their contents
+	visitModulesFn(func(physStart, physEnd uintptr, cmdLine string) bool {
+		kfmt.Printf("[pmm] reserving boot module [0x%10x - 0x%10x]: %s\n", physStart, physEnd, cmdLine)
+		reserved.add(uint64(physStart), uint64(physEnd))
+		return true
+	})
+
+	// Sections that are not part of the loaded kernel image (e.g. the
+	// symbol and string tables) are loaded by the bootloader at arbitrary
+	// physical addresses; preserve them so they can be used for resolving
+	// kernel symbols.
+	visitElfSectionsFn(func(_ string, secFlags multiboot.ElfSectionFlag, secAddress uintptr, secSize uint64) {
+		if secFlags&multiboot.ElfSectionAllocated == 0 && secAddress != 0 && secAddress < kernelPageOffset {
+			reserved.add(uint64(secAddress), uint64(secAddress)+secSize)
+		}
+	})
+
+	available.sortAndMerge()
+	for i := 0; i < reserved.count; i++ {
+		available.subtract(reserved.ranges[i].start, reserved.ranges[i].end)
+	}
+
+	if dropped := available.dropped + reserved.dropped; dropped != 0 {
+		kfmt.Printf("[pmm] memory map too large; ignoring %d regions\n", dropped)
+	}
+
+	// Convert the remaining ranges to frames rounding the start address up
+	// and the end address down to the nearest page boundary
+	pageSizeMinus1 := uint64(mm.PageSize - 1)
+	m.count = 0
+	for i := 0; i < available.count; i++ {
+		startFrame := mm.Frame((available.ranges[i].start + pageSizeMinus1) >> mm.PageShift)
+		endFrame := mm.Frame(available.ranges[i].end >> mm.PageShift)
+		if endFrame <= startFrame {
+			continue
+		}
+
+		m.regions[m.count].startFrame = startFrame
+		m.regions[m.count].endFrame = endFrame - 1
+		m.count++
+	}
+}
+
+// visit invokes the supplied visitor with the first and last frame of each
+// region in the memory map. The visitor may return false to abort the scan.
+func (m *memoryMap) visit(visitor func(startFrame, endFrame mm.Frame) bool) {
+	for i := 0; i < m.count; i++ {
+		if !visitor(m.regions[i].startFrame, m.regions[i].endFrame) {
+			return
+		}
+	}
+}
+
+// print outputs the sanitized memory map contents.
+func (m *memoryMap) print() {
+	kfmt.Printf("[pmm] usable memory regions:\n")
+	for i := 0; i < m.count; i++ {
+		kfmt.Printf("\t[0x%10x - 0x%10x], pages: %d\n",
+			m.regions[i].startFrame.Address(),
+			m.regions[i].endFrame.Address()+mm.PageSize,
+			uint64(m.regions[i].endFrame-m.regions[i].startFrame+1),
+		)
+	}
+}
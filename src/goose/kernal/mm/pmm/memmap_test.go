@@ -0,0 +1,226 @@
+package pmm
+
+import (
+	"goose/kernel/mm"
+	"goose/multiboot"
+	"testing"
+)
+
+type testFrameRange struct {
+	startFrame, endFrame mm.Frame
+}
+
+type testModule struct {
+	physStart, physEnd uintptr
+}
+
+// mockMemMapSources replaces the multiboot accessors used by memoryMap.build
+// with mocks that report the supplied memory map entries and boot modules.
+// The returned function restores the original accessors.
+func mockMemMapSources(entries []multiboot.MemoryMapEntry, infoAddr, infoSize uintptr, modules []testModule) func() {
+	origVisitMemRegions, origInfoRegion, origVisitModules, origVisitElfSections := visitMemRegionsFn, infoRegionFn, visitModulesFn, visitElfSectionsFn
+
+	visitMemRegionsFn = func(visitor multiboot.MemRegionVisitor) {
+		for index := range entries {
+			if !visitor(&entries[index]) {
+				return
+			}
+		}
+	}
+	infoRegionFn = func() (uintptr, uintptr) {
+		return infoAddr, infoSize
+	}
+	visitModulesFn = func(visitor multiboot.ModuleVisitor) {
+		for _, mod := range modules {
+			if !visitor(mod.physStart, mod.physEnd, "module") {
+				return
+			}
+		}
+	}
+	visitElfSectionsFn = func(multiboot.ElfSectionVisitor) {}
+
+	return func() {
+		visitMemRegionsFn, infoRegionFn, visitModulesFn, visitElfSectionsFn = origVisitMemRegions, origInfoRegion, origVisitModules, origVisitElfSections
+	}
+}
+
+func TestMemoryMapBuild(t *testing.T) {
+	const (
+		kernelStart      = 0x100000
+		kernelEnd        = 0x180000
+		kernelPageOffset = 0xffff800000000000
+		mb               = 0x100000
+	)
+
+	specs := []struct {
+		descr     string
+		entries   []multiboot.MemoryMapEntry
+		infoAddr  uintptr
+		infoSize  uintptr
+		modules   []testModule
+		expRanges []testFrameRange
+	}{
+		{
+			"sorted, non-overlapping entries",
+			[]multiboot.MemoryMapEntry{
+				{PhysAddress: 0, Length: 0x9fc00, Type: multiboot.MemAvailable},
+				{PhysAddress: 0x9fc00, Length: 0x400, Type: multiboot.MemReserved},
+				{PhysAddress: 0xf0000, Length: 0x10000, Type: multiboot.MemReserved},
+				{PhysAddress: mb, Length: 127 * mb, Type: multiboot.MemAvailable},
+			},
+			0, 0, nil,
+			[]testFrameRange{{0x100, 0x7fff}},
+		},
+		{
+			"unsorted entries",
+			[]multiboot.MemoryMapEntry{
+				{PhysAddress: 64 * mb, Length: 64 * mb, Type: multiboot.MemAvailable},
+				{PhysAddress: 256 * mb, Length: 16 * mb, Type: multiboot.MemAvailable},
+				{PhysAddress: mb, Length: 32 * mb, Type: multiboot.MemAvailable},
+			},
+			0, 0, nil,
+			[]testFrameRange{{0x100, 0x20ff}, {0x4000, 0x7fff}, {0x10000, 0x10fff}},
+		},
+		{
+			"overlapping and adjacent available entries are merged",
+			[]multiboot.MemoryMapEntry{
+				{PhysAddress: mb, Length: 16 * mb, Type: multiboot.MemAvailable},
+				{PhysAddress: 8 * mb, Length: 16 * mb, Type: multiboot.MemAvailable},
+				{PhysAddress: 24 * mb, Length: 8 * mb, Type: multiboot.MemAvailable},
+			},
+			0, 0, nil,
+			[]testFrameRange{{0x100, 0x1fff}},
+		},
+		{
+			"reserved entries overlapping available entries win",
+			[]multiboot.MemoryMapEntry{
+				{PhysAddress: mb, Length: 63 * mb, Type: multiboot.MemAvailable},
+				// Splits the available region in two
+				{PhysAddress: 16 * mb, Length: mb, Type: multiboot.MemReserved},
+				// Overlaps the available region end
+				{PhysAddress: 60 * mb, Length: 8 * mb, Type: multiboot.MemNvs},
+				// Covers another available region completely
+				{PhysAddress: 128 * mb, Length: 32 * mb, Type: multiboot.MemReserved},
+				{PhysAddress: 130 * mb, Length: 8 * mb, Type: multiboot.MemAvailable},
+			},
+			0, 0, nil,
+			[]testFrameRange{{0x100, 0xfff}, {0x1100, 0x3bff}},
+		},
+		{
+			"zero-length and sub-page entries are ignored",
+			[]multiboot.MemoryMapEntry{
+				{PhysAddress: 32 * mb, Length: 0, Type: multiboot.MemAvailable},
+				{PhysAddress: 48*mb + 0x10, Length: 0x800, Type: multiboot.MemAvailable},
+				{PhysAddress: mb, Length: 15 * mb, Type: multiboot.MemAvailable},
+				{PhysAddress: 8 * mb, Length: 0, Type: multiboot.MemReserved},
+			},
+			0, 0, nil,
+			[]testFrameRange{{0x100, 0xfff}},
+		},
+		{
+			"unaligned entries are trimmed to frame boundaries",
+			[]multiboot.MemoryMapEntry{
+				{PhysAddress: 2*mb + 0x123, Length: 2*mb - 0x246, Type: multiboot.MemAvailable},
+			},
+			0, 0, nil,
+			[]testFrameRange{{0x201, 0x3fe}},
+		},
+		{
+			"memory below 1M is never used",
+			[]multiboot.MemoryMapEntry{
+				{PhysAddress: 0, Length: 0x9fc00, Type: multiboot.MemAvailable},
+				{PhysAddress: 0x80000, Length: 0x100000, Type: multiboot.MemAvailable},
+			},
+			0, 0, nil,
+			[]testFrameRange{{0x100, 0x17f}},
+		},
+		{
+			"multiboot payload and boot modules are excluded",
+			[]multiboot.MemoryMapEntry{
+				{PhysAddress: mb, Length: 31 * mb, Type: multiboot.MemAvailable},
+			},
+			kernelPageOffset + 4*mb, 0x2000,
+			[]testModule{{8 * mb, 9*mb + 0x10}},
+			[]testFrameRange{{0x100, 0x3ff}, {0x402, 0x7ff}, {0x901, 0x1fff}},
+		},
+		{
+			"multiboot payload inside the kernel image stays in the map",
+			[]multiboot.MemoryMapEntry{
+				{PhysAddress: mb, Length: 15 * mb, Type: multiboot.MemAvailable},
+			},
+			kernelPageOffset + kernelStart + 0x10000, 0x1000,
+			nil,
+			[]testFrameRange{{0x100, 0xfff}},
+		},
+		{
+			"no available memory",
+			[]multiboot.MemoryMapEntry{
+				{PhysAddress: 0, Length: 0x9fc00, Type: multiboot.MemAvailable},
+				{PhysAddress: mb, Length: 64 * mb, Type: multiboot.MemReserved},
+			},
+			0, 0, nil,
+			nil,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		restore := mockMemMapSources(spec.entries, spec.infoAddr, spec.infoSize, spec.modules)
+
+		var m memoryMap
+		m.build(kernelStart, kernelEnd, kernelPageOffset)
+		restore()
+
+		var got []testFrameRange
+		m.visit(func(startFrame, endFrame mm.Frame) bool {
+			got = append(got, testFrameRange{startFrame, endFrame})
+			return true
+		})
+
+		if len(got) != len(spec.expRanges) {
+			t.Errorf("[spec %d] %s: expected ranges %v; got %v", specIndex, spec.descr, spec.expRanges, got)
+			continue
+		}
+
+		for index := range got {
+			if got[index] != spec.expRanges[index] {
+				t.Errorf("[spec %d] %s: expected ranges %v; got %v", specIndex, spec.descr, spec.expRanges, got)
+				break
+			}
+		}
+	}
+}
+
+func TestMemRangeListSubtract(t *testing.T) {
+	var l memRangeList
+
+	l.add(0x1000, 0x5000)
+	l.add(0x8000, 0x9000)
+	l.sortAndMerge()
+
+	// Split the first range and remove the second one completely
+	l.subtract(0x2000, 0x3000)
+	l.subtract(0x7000, 0xa000)
+
+	exp := []memRange{{0x1000, 0x2000}, {0x3000, 0x5000}}
+	if l.count != len(exp) {
+		t.Fatalf("expected %d ranges; got %d: %v", len(exp), l.count, l.ranges[:l.count])
+	}
+
+	for index, r := range exp {
+		if l.ranges[index] != r {
+			t.Errorf("expected range %d to be %v; got %v", index, r, l.ranges[index])
+		}
+	}
+}
+
+func TestMemRangeListOverflow(t *testing.T) {
+	var l memRangeList
+
+	for index := uint64(0); index < maxMemMapRegions+3; index++ {
+		l.add(index*0x2000, index*0x2000+0x1000)
+	}
+
+	if l.count != maxMemMapRegions || l.dropped != 3 {
+		t.Fatalf("expected %d ranges and 3 dropped entries; got %d and %d", maxMemMapRegions, l.count, l.dropped)
+	}
+}
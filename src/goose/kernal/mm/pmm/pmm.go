@@ -2,6 +2,7 @@ package pmm
 
 import (
 	"goose/kernel"
+	"goose/kernel/kfmt"
 	"goose/kernel/mm"
 )
 
@@ -15,17 +16,45 @@ var (
 	bitmapAllocator BitmapAllocator
 )
 
-// Init sets up the kernel physical memory allocation sub-system.
-func Init(kernelStart, kernelEnd uintptr) *kernel.Error {
+// Init sets up the kernel physical memory allocation sub-system. The
+// kernelStart and kernelEnd arguments specify the physical address range
+// occupied by the kernel image while kernelPageOffset specifies the start of
+// the kernel virtual address space.
+func Init(kernelStart, kernelEnd, kernelPageOffset uintptr) *kernel.Error {
 	bootMemAllocator.init(kernelStart, kernelEnd)
 	bootMemAllocator.printMemoryMap()
+
+	// Build the memory map that is consumed by all allocators
+	sanitizedMemMap.build(kernelStart, kernelEnd, kernelPageOffset)
+	sanitizedMemMap.print()
+
 	mm.SetFrameAllocator(earlyAllocFrame)
+	mm.SetFramesAllocator(earlyAllocFrames)
+	mm.SetFrameFreer(earlyFreeFrame)
+	mm.SetFramesFreer(earlyFreeFrames)
+	activeAllocator = AllocatorBootMem
+
+	// Allocate the frame descriptor table before bootstrapping the bitmap
+	// allocator so that the frames used by the table are also accounted for
+	err := setupFrameDescriptors()
+	if err != nil {
+		return err
+	}
+
+	// Enable the allocator debug mode if requested via the boot command line
+	if err = allocDebug.init(); err != nil {
+		return err
+	}
 
 	// Using the bootMemAllocator bootstrap the bitmap allocator
-	if err := bitmapAllocator.init(); err != nil {
+	if err = bitmapAllocator.init(); err != nil {
 		return err
 	}
 	mm.SetFrameAllocator(bitmapAllocFrame)
+	mm.SetFramesAllocator(bitmapAllocFrames)
+	mm.SetFrameFreer(bitmapFreeFrame)
+	mm.SetFramesFreer(bitmapFreeFrames)
+	activeAllocator = AllocatorBitmap
 
 	return nil
 }
@@ -37,3 +66,64 @@ func earlyAllocFrame() (mm.Frame, *kernel.Error) {
 func bitmapAllocFrame() (mm.Frame, *kernel.Error) {
 	return bitmapAllocator.AllocFrame()
 }
+
+func earlyFreeFrame(_ mm.Frame) *kernel.Error {
+	return errBootAllocFreeNotSupported
+}
+
+func bitmapFreeFrame(frame mm.Frame) *kernel.Error {
+	return bitmapAllocator.FreeFrame(frame)
+}
+
+func earlyAllocFrames(order uint8) (mm.Frame, *kernel.Error) {
+	if order != 0 {
+		return mm.InvalidFrame, errBootAllocUnsupportedOrder
+	}
+
+	return bootMemAllocator.AllocFrame()
+}
+
+func bitmapAllocFrames(order uint8) (mm.Frame, *kernel.Error) {
+	return bitmapAllocator.AllocFrames(order)
+}
+
+func earlyFreeFrames(_ mm.Frame, _ uint8) *kernel.Error {
+	return errBootAllocFreeNotSupported
+}
+
+func bitmapFreeFrames(frame mm.Frame, order uint8) *kernel.Error {
+	return bitmapAllocator.FreeFrames(frame, order)
+}
+
+// AllocFrameInZone reserves a physical frame from the requested memory zone
+// or, if the zone is exhausted, from one of the zones below it. This function
+// can only be used after the bitmap allocator has been initialized.
+func AllocFrameInZone(zone Zone) (mm.Frame, *kernel.Error) {
+	return bitmapAllocator.AllocFrameInZone(zone)
+}
+
+// AllocFramesInZone reserves a block of 2^order physically contiguous frames
+// from the requested memory zone or, if the zone is exhausted, from one of the
+// zones below it. This function can only be used after the bitmap allocator
+// has been initialized.
+func AllocFramesInZone(zone Zone, order uint8) (mm.Frame, *kernel.Error) {
+	return bitmapAllocator.AllocFramesInZone(zone, order)
+}
+
+// ReclaimRegion hands the physical memory region [physAddr, physAddr+size)
+// back to the physical frame allocator and logs the amount of memory that was
+// gained. The caller must ensure that the region contents are no longer
+// needed and that no mappings to it remain. This function can only be used
+// after the bitmap allocator has been initialized.
+func ReclaimRegion(physAddr, size uintptr) *kernel.Error {
+	addedFrames, err := bitmapAllocator.AddRegion(physAddr, size)
+	if addedFrames != 0 {
+		kfmt.Printf("[pmm] reclaimed %dKb from region [0x%x - 0x%x]\n",
+			uint64(addedFrames)*uint64(mm.PageSize)/1024,
+			physAddr,
+			physAddr+size,
+		)
+	}
+
+	return err
+}
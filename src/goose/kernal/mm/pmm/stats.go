@@ -0,0 +1,215 @@
+package pmm
+
+import (
+	"goose/kernel/kfmt"
+	"goose/kernel/mm"
+	"io"
+	"math"
+)
+
+// MaxStatsPools defines the maximum number of pools that can be reported by
+// Stats. Pools beyond this limit are still accounted for in the totals.
+const MaxStatsPools = 32
+
+// AllocatorType describes the physical frame allocator that is currently
+// servicing allocation requests.
+type AllocatorType uint8
+
+const (
+	// AllocatorNone indicates that pmm.Init has not been invoked yet.
+	AllocatorNone AllocatorType = iota
+
+	// AllocatorBootMem indicates that the boot memory allocator is active.
+	AllocatorBootMem
+
+	// AllocatorBitmap indicates that the bitmap allocator is active.
+	AllocatorBitmap
+)
+
+// String implements fmt.Stringer for AllocatorType.
+func (t AllocatorType) String() string {
+	switch t {
+	case AllocatorBootMem:
+		return "bootmem"
+	case AllocatorBitmap:
+		return "bitmap"
+	default:
+		return "none"
+	}
+}
+
+// PoolStats contains the frame statistics for a single memory pool.
+type PoolStats struct {
+	// The first and last frame managed by the pool.
+	StartFrame, EndFrame mm.Frame
+
+	// Zone is the memory zone that the pool belongs to.
+	Zone Zone
+
+	TotalFrames    uint32
+	FreeFrames     uint32
+	ReservedFrames uint32
+
+	// LargestFreeRun is the length of the longest run of physically
+	// contiguous free frames in the pool.
+	LargestFreeRun uint32
+}
+
+// MemStats contains a snapshot of the physical memory statistics.
+type MemStats struct {
+	// Allocator is the currently active physical frame allocator.
+	Allocator AllocatorType
+
+	TotalFrames    uint32
+	FreeFrames     uint32
+	ReservedFrames uint32
+
+	// LargestFreeRun is the length of the longest run of physically
+	// contiguous free frames across all pools.
+	LargestFreeRun uint32
+
+	// PoolCount is the number of valid entries in Pools. Per-pool
+	// statistics are only available while the bitmap allocator is active.
+	PoolCount int
+	Pools     [MaxStatsPools]PoolStats
+}
+
+// activeAllocator tracks the allocator that is currently registered with mm.
+var activeAllocator AllocatorType
+
+// Stats returns a snapshot of the physical memory statistics. Stats does not
+// allocate any memory so it can be safely invoked at any point after pmm.Init.
+func Stats() MemStats {
+	var stats MemStats
+	stats.Allocator = activeAllocator
+
+	switch activeAllocator {
+	case AllocatorBootMem:
+		bootMemAllocator.fillStats(&stats)
+	case AllocatorBitmap:
+		bitmapAllocator.fillStats(&stats)
+	}
+
+	return stats
+}
+
+// DumpTo outputs the memory statistics to the supplied writer.
+func (stats *MemStats) DumpTo(w io.Writer) {
+	kfmt.Fprintf(w, "[pmm] active allocator: %s\n", stats.Allocator.String())
+	kfmt.Fprintf(w, "[pmm] frames: total: %d, free: %d, reserved: %d, largest free run: %d\n",
+		stats.TotalFrames,
+		stats.FreeFrames,
+		stats.ReservedFrames,
+		stats.LargestFreeRun,
+	)
+
+	for poolIndex := 0; poolIndex < stats.PoolCount; poolIndex++ {
+		pool := &stats.Pools[poolIndex]
+		kfmt.Fprintf(w, "[pmm] pool %2d [0x%16x - 0x%16x] zone %6s: total: %d, free: %d, reserved: %d, largest free run: %d\n",
+			poolIndex,
+			pool.StartFrame.Address(),
+			pool.EndFrame.Address()+mm.PageSize-1,
+			pool.Zone.String(),
+			pool.TotalFrames,
+			pool.FreeFrames,
+			pool.ReservedFrames,
+			pool.LargestFreeRun,
+		)
+	}
+}
+
+// PrintStats outputs the current memory statistics to the active kfmt output
+// sink.
+func PrintStats() {
+	stats := Stats()
+	stats.DumpTo(kfmt.GetOutputSink())
+}
+
+// fillStats populates stats using the boot memory allocator state. As the
+// boot memory allocator does not track individual frames, only the totals are
+// reported.
+func (alloc *BootMemAllocator) fillStats(stats *MemStats) {
+	visitPoolRegions(func(startFrame, endFrame mm.Frame) bool {
+		stats.TotalFrames += uint32(endFrame - startFrame + 1)
+		return true
+	})
+
+	stats.ReservedFrames = uint32(alloc.allocCount) + alloc.kernelFramesInMap()
+	stats.FreeFrames = stats.TotalFrames - stats.ReservedFrames
+}
+
+// fillStats populates stats using the bitmap allocator state.
+func (alloc *BitmapAllocator) fillStats(stats *MemStats) {
+	alloc.mutex.Acquire()
+
+	for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+		pool := &alloc.pools[poolIndex]
+		poolStats := PoolStats{
+			StartFrame:     pool.startFrame,
+			EndFrame:       pool.endFrame,
+			Zone:           pool.zone,
+			TotalFrames:    uint32(pool.endFrame - pool.startFrame + 1),
+			FreeFrames:     pool.freeCount,
+			LargestFreeRun: pool.largestFreeRun(),
+		}
+		poolStats.ReservedFrames = poolStats.TotalFrames - poolStats.FreeFrames
+
+		stats.TotalFrames += poolStats.TotalFrames
+		stats.FreeFrames += poolStats.FreeFrames
+		stats.ReservedFrames += poolStats.ReservedFrames
+		if poolStats.LargestFreeRun > stats.LargestFreeRun {
+			stats.LargestFreeRun = poolStats.LargestFreeRun
+		}
+
+		if stats.PoolCount < MaxStatsPools {
+			stats.Pools[stats.PoolCount] = poolStats
+			stats.PoolCount++
+		}
+	}
+
+	alloc.mutex.Release()
+}
+
+// largestFreeRun scans the pool free bitmap and returns the length of the
+// longest run of contiguous free frames.
+func (pool *framePool) largestFreeRun() uint32 {
+	var (
+		frameCount  = uint32(pool.endFrame - pool.startFrame + 1)
+		longestRun  uint32
+		curRun      uint32
+		updateRunFn = func() {
+			if curRun > longestRun {
+				longestRun = curRun
+			}
+			curRun = 0
+		}
+	)
+
+	for index := uint32(0); index < frameCount; {
+		block := pool.freeBitmap[index>>6]
+
+		// Skip over fully free or fully reserved blocks
+		if index&63 == 0 && index+64 <= frameCount {
+			switch block {
+			case 0:
+				curRun += 64
+				index += 64
+				continue
+			case math.MaxUint64:
+				updateRunFn()
+				index += 64
+				continue
+			}
+		}
+
+		if block&(1<<(63-(index&63))) == 0 {
+			curRun++
+		} else {
+			updateRunFn()
+		}
+		index++
+	}
+	updateRunFn()
+
+	return longestRun
+}
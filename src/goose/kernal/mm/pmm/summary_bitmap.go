@@ -0,0 +1,125 @@
+package pmm
+
+import (
+	"math/bits"
+	"reflect"
+	"unsafe"
+)
+
+// maxSummaryLevels defines the maximum number of levels for a summaryBitmap.
+// Six levels are enough for tracking 2^36 entries.
+const maxSummaryLevels = 6
+
+// summaryBitmap implements a multi-level bitmap that supports locating set
+// bits in O(log n) time. The first level contains one bit per tracked entry.
+// Each bit in level n+1 is set if the corresponding uint64 word in level n has
+// at least one bit set. The top level always fits in a single word.
+//
+// Like the pool free bitmaps, each word uses a big-endian bit representation
+// where the bit for index i is stored at position 63 - (i % 64). This allows
+// the search code to locate the first set bit using bits.LeadingZeros64.
+type summaryBitmap struct {
+	levels     [maxSummaryLevels][]uint64
+	levelCount int
+}
+
+// summaryBitmapWords returns the total number of uint64 words required for
+// storing all levels of a summaryBitmap that tracks the requested number of
+// bits.
+func summaryBitmapWords(bitCount uintptr) uintptr {
+	var totalWords uintptr
+	for levelWords := bitmapWords(bitCount); ; levelWords = bitmapWords(levelWords) {
+		totalWords += levelWords
+		if levelWords <= 1 {
+			return totalWords
+		}
+	}
+}
+
+// init sets up the bitmap levels for tracking bitCount entries using the
+// zeroed memory starting at dataAddr. It returns the address right after the
+// last word used by the bitmap.
+func (b *summaryBitmap) init(bitCount uintptr, dataAddr uintptr) uintptr {
+	var hdr reflect.SliceHeader
+
+	b.levelCount = 0
+	for levelWords := bitmapWords(bitCount); ; levelWords = bitmapWords(levelWords) {
+		hdr.Data = dataAddr
+		hdr.Len = int(levelWords)
+		hdr.Cap = hdr.Len
+		b.levels[b.levelCount] = *(*[]uint64)(unsafe.Pointer(&hdr))
+		b.levelCount++
+		dataAddr += levelWords << 3
+
+		if levelWords <= 1 {
+			return dataAddr
+		}
+	}
+}
+
+// test returns true if the bit at the specified index is set.
+func (b *summaryBitmap) test(index uintptr) bool {
+	return b.levels[0][index>>6]&(1<<(63-(index&63))) != 0
+}
+
+// set sets the bit at the specified index and updates the summary levels.
+func (b *summaryBitmap) set(index uintptr) {
+	for level := 0; level < b.levelCount; level++ {
+		wasEmpty := b.levels[level][index>>6] == 0
+		b.levels[level][index>>6] |= 1 << (63 - (index & 63))
+
+		// The summary levels only need updating if the word was empty
+		if !wasEmpty {
+			return
+		}
+		index >>= 6
+	}
+}
+
+// clear clears the bit at the specified index and updates the summary levels.
+func (b *summaryBitmap) clear(index uintptr) {
+	for level := 0; level < b.levelCount; level++ {
+		b.levels[level][index>>6] &^= 1 << (63 - (index & 63))
+
+		// The summary levels only need updating if the word became empty
+		if b.levels[level][index>>6] != 0 {
+			return
+		}
+		index >>= 6
+	}
+}
+
+// find returns the index of the first set bit that is greater than or equal
+// to start. The second return value is false if no such bit exists.
+func (b *summaryBitmap) find(start uintptr) (uintptr, bool) {
+	var (
+		level = 0
+		index = start
+	)
+
+	// Walk up the levels until we find a word with a set bit at or after
+	// the current index
+	for {
+		if index>>6 >= uintptr(len(b.levels[level])) {
+			return 0, false
+		}
+
+		if word := b.levels[level][index>>6] & (^uint64(0) >> (index & 63)); word != 0 {
+			index = index&^63 + uintptr(bits.LeadingZeros64(word))
+			break
+		}
+
+		// Continue searching from the next word at the level above
+		if level++; level == b.levelCount {
+			return 0, false
+		}
+		index = index>>6 + 1
+	}
+
+	// Walk back down selecting the first set bit in each child word
+	for ; level > 0; level-- {
+		index = index<<6 + uintptr(bits.LeadingZeros64(b.levels[level-1][index]))
+	}
+
+	return index, true
+}
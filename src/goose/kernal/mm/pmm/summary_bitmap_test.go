@@ -0,0 +1,177 @@
+package pmm
+
+import (
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+// newTestSummaryBitmap returns a summaryBitmap that tracks bitCount entries
+// together with the slice that backs its levels.
+func newTestSummaryBitmap(bitCount uintptr) (*summaryBitmap, []uint64) {
+	var (
+		b       summaryBitmap
+		backing = make([]uint64, summaryBitmapWords(bitCount))
+	)
+
+	b.init(bitCount, uintptr(unsafe.Pointer(&backing[0])))
+	return &b, backing
+}
+
+// linearFirstFree implements the linear bitmap scan used by the allocator
+// before the introduction of the summary bitmaps.
+func linearFirstFree(bitmap []uint64) (uintptr, bool) {
+	for block, mask := range bitmap {
+		if mask == 0 {
+			continue
+		}
+
+		for bitIndex := uintptr(0); bitIndex < 64; bitIndex++ {
+			if mask&(1<<(63-bitIndex)) != 0 {
+				return uintptr(block)<<6 + bitIndex, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func TestSummaryBitmapWords(t *testing.T) {
+	specs := []struct {
+		bitCount uintptr
+		expWords uintptr
+	}{
+		{1, 1},
+		{64, 1},
+		{65, 2 + 1},
+		{64 * 64, 64 + 1},
+		{64*64 + 1, 65 + 2 + 1},
+	}
+
+	for specIndex, spec := range specs {
+		if got := summaryBitmapWords(spec.bitCount); got != spec.expWords {
+			t.Errorf("[spec %d] expected %d words; got %d", specIndex, spec.expWords, got)
+		}
+	}
+}
+
+func TestSummaryBitmapFind(t *testing.T) {
+	const bitCount = 64*64*64 + 123
+
+	var (
+		b, _ = newTestSummaryBitmap(bitCount)
+		ref  = make([]bool, bitCount)
+		rng  = rand.New(rand.NewSource(42))
+	)
+
+	if _, ok := b.find(0); ok {
+		t.Fatal("expected find on an empty bitmap to fail")
+	}
+
+	for op := 0; op < 20000; op++ {
+		index := uintptr(rng.Intn(bitCount))
+		if rng.Intn(3) == 0 {
+			b.clear(index)
+			ref[index] = false
+		} else {
+			b.set(index)
+			ref[index] = true
+		}
+
+		if b.test(index) != ref[index] {
+			t.Fatalf("[op %d] test(%d) returned %t", op, index, !ref[index])
+		}
+
+		start := uintptr(rng.Intn(bitCount))
+		expIndex, expOK := uintptr(0), false
+		for i := start; i < bitCount; i++ {
+			if ref[i] {
+				expIndex, expOK = i, true
+				break
+			}
+		}
+
+		if gotIndex, gotOK := b.find(start); gotOK != expOK || gotIndex != expIndex {
+			t.Fatalf("[op %d] find(%d): expected (%d, %t); got (%d, %t)", op, start, expIndex, expOK, gotIndex, gotOK)
+		}
+	}
+}
+
+func TestSummaryBitmapClearUpdatesSummary(t *testing.T) {
+	b, _ := newTestSummaryBitmap(64 * 64 * 4)
+
+	b.set(64*64*3 + 5)
+	b.set(7)
+	b.clear(7)
+
+	if index, ok := b.find(0); !ok || index != 64*64*3+5 {
+		t.Fatalf("expected find to skip the cleared word and return %d; got (%d, %t)", 64*64*3+5, index, ok)
+	}
+
+	b.clear(64*64*3 + 5)
+	for level := 0; level < b.levelCount; level++ {
+		for wordIndex, word := range b.levels[level] {
+			if word != 0 {
+				t.Fatalf("expected level %d word %d to be empty; got 0x%x", level, wordIndex, word)
+			}
+		}
+	}
+}
+
+// benchmarkMemSizes lists the simulated memory sizes (in Gb) that are used by
+// the allocation benchmarks.
+var benchmarkMemSizes = []struct {
+	name  string
+	bytes uint64
+}{
+	{"1Gb", 1 << 30},
+	{"4Gb", 4 << 30},
+	{"16Gb", 16 << 30},
+	{"64Gb", 64 << 30},
+}
+
+// setupBenchmarkBitmaps simulates a free frame bitmap for a system with the
+// supplied memory size where the low 90% of the frames are in use. It returns
+// a flat bitmap with the same contents as the returned summary bitmap.
+func setupBenchmarkBitmaps(memBytes uint64) ([]uint64, *summaryBitmap, []uint64) {
+	var (
+		frameCount = uintptr(memBytes >> 12)
+		firstFree  = frameCount / 10 * 9
+		flat       = make([]uint64, bitmapWords(frameCount))
+	)
+
+	b, backing := newTestSummaryBitmap(frameCount)
+	for index := firstFree; index < frameCount; index++ {
+		flat[index>>6] |= 1 << (63 - (index & 63))
+		b.set(index)
+	}
+
+	return flat, b, backing
+}
+
+func BenchmarkFirstFreeLinearScan(b *testing.B) {
+	for _, size := range benchmarkMemSizes {
+		flat, _, _ := setupBenchmarkBitmaps(size.bytes)
+		b.Run(size.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, ok := linearFirstFree(flat); !ok {
+					b.Fatal("expected to find a free frame")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFirstFreeSummaryBitmap(b *testing.B) {
+	for _, size := range benchmarkMemSizes {
+		_, summary, backing := setupBenchmarkBitmaps(size.bytes)
+		b.Run(size.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, ok := summary.find(0); !ok {
+					b.Fatal("expected to find a free frame")
+				}
+			}
+		})
+		_ = backing[0]
+	}
+}
@@ -0,0 +1,69 @@
+package pmm
+
+import "goose/kernel/mm"
+
+// Zone describes a range of physical memory with particular addressing
+// constraints. Frame pools never span more than one zone.
+type Zone uint8
+
+const (
+	// ZoneDMA contains the frames below 16M that can be used for legacy
+	// ISA DMA transfers.
+	ZoneDMA Zone = iota
+
+	// ZoneDMA32 contains the frames between 16M and 4G that can be
+	// accessed by devices which only support 32-bit addressing.
+	ZoneDMA32
+
+	// ZoneNormal contains all frames above 4G.
+	ZoneNormal
+
+	// zoneCount is the number of supported zones.
+	zoneCount
+)
+
+const (
+	// zoneDMAEndFrame is the first frame that does not belong to ZoneDMA.
+	zoneDMAEndFrame = mm.Frame((16 << 20) >> mm.PageShift)
+
+	// zoneDMA32EndFrame is the first frame that does not belong to ZoneDMA32.
+	zoneDMA32EndFrame = mm.Frame((4 << 30) >> mm.PageShift)
+)
+
+// String implements fmt.Stringer for Zone.
+func (z Zone) String() string {
+	switch z {
+	case ZoneDMA:
+		return "DMA"
+	case ZoneDMA32:
+		return "DMA32"
+	case ZoneNormal:
+		return "Normal"
+	default:
+		return "unknown"
+	}
+}
+
+// zoneForFrame returns the zone that contains the supplied frame.
+func zoneForFrame(frame mm.Frame) Zone {
+	switch {
+	case frame < zoneDMAEndFrame:
+		return ZoneDMA
+	case frame < zoneDMA32EndFrame:
+		return ZoneDMA32
+	default:
+		return ZoneNormal
+	}
+}
+
+// zoneLastFrame returns the last frame that belongs to the supplied zone.
+func zoneLastFrame(zone Zone) mm.Frame {
+	switch zone {
+	case ZoneDMA:
+		return zoneDMAEndFrame - 1
+	case ZoneDMA32:
+		return zoneDMA32EndFrame - 1
+	default:
+		return mm.InvalidFrame - 1
+	}
+}
@@ -1,8 +1,8 @@
 package vmm
 
 import (
-	"gopheros/kernel"
-	"gopheros/kernel/mm"
+	"goose/kernel"
+	"goose/kernel/mm"
 )
 
 var (
@@ -22,11 +22,18 @@ var (
 //
 // This function allocates regions starting at the end of the kernel address
 // space. It should only be used during the early stages of kernel initialization.
+// Once the vmm package is initialized, calls to EarlyReserveRegion are
+// forwarded to ReserveRegion.
 func EarlyReserveRegion(size uintptr) (uintptr, *kernel.Error) {
+	if kernelVA.ready {
+		return ReserveRegion(size)
+	}
+
 	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
 
-	// reserving a region of the requested size will cause an underflow
-	if size > earlyReserveLastUsed {
+	// reserving a region of the requested size will overflow into the
+	// address space below the region managed by the kernel VA allocator
+	if size > earlyReserveLastUsed-kernelVASpaceStart {
 		return 0, errEarlyReserveNoSpace
 	}
 
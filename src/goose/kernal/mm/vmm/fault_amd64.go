@@ -1,20 +1,79 @@
 package vmm
 
 import (
-	"gopheros/kernel"
-	"gopheros/kernel/gate"
-	"gopheros/kernel/kfmt"
-	"gopheros/kernel/mm"
+	"goose/kernel"
+	"goose/kernel/gate"
+	"goose/kernel/kfmt"
+	"goose/kernel/mm"
+	"io"
 )
 
+const (
+	// doubleFaultIST is the interrupt stack table slot used by the double
+	// fault handler. Running the handler on a dedicated stack allows
+	// double faults caused by kernel stack overflows to be reported.
+	doubleFaultIST = 1
+
+	// doubleFaultStackSize is the size of the double fault handler stack.
+	doubleFaultStackSize = 4 * mm.PageSize
+)
+
+// The bits of the error code that the CPU pushes to the stack when a page
+// fault occurs.
+const (
+	// pfErrPresent is set if the fault was caused by a page protection
+	// violation and cleared if it was caused by a non-present page.
+	pfErrPresent = 1 << iota
+
+	// pfErrWrite is set if the fault was caused by a write access.
+	pfErrWrite
+
+	// pfErrUser is set if the fault occurred while running in user-mode.
+	pfErrUser
+
+	// pfErrReserved is set if a page table entry has a reserved bit set.
+	pfErrReserved
+
+	// pfErrInstrFetch is set if the fault was caused by an instruction
+	// fetch.
+	pfErrInstrFetch
+
+	// pfErrProtectionKey is set if the fault was caused by a protection
+	// key violation.
+	pfErrProtectionKey
+)
+
+// BacktracePrinterFn is a function that outputs a call chain starting at the
+// supplied instruction and frame pointers.
+type BacktracePrinterFn func(w io.Writer, pc, fp uintptr)
+
+// backtracePrinter points to the function registered via SetBacktracePrinter.
+var backtracePrinter BacktracePrinterFn
+
 var (
 	// handleInterruptFn is used by tests.
 	handleInterruptFn = gate.HandleInterrupt
+
+	// setInterruptStackFn is used by tests.
+	setInterruptStackFn = gate.SetInterruptStack
 )
 
-func installFaultHandlers() {
+// SetBacktracePrinter registers a function that will be used by the fault
+// handlers for displaying the call chain that led to a non-recoverable fault.
+func SetBacktracePrinter(printFn BacktracePrinterFn) { backtracePrinter = printFn }
+
+func installFaultHandlers() *kernel.Error {
 	handleInterruptFn(gate.PageFaultException, 0, pageFaultHandler)
 	handleInterruptFn(gate.GPFException, 0, generalProtectionFaultHandler)
+
+	dfStack, err := AllocKernelStack(doubleFaultStackSize, "double fault handler")
+	if err != nil {
+		return err
+	}
+
+	setInterruptStackFn(doubleFaultIST, dfStack.Top)
+	handleInterruptFn(gate.DoubleFault, doubleFaultIST, doubleFaultHandler)
+	return nil
 }
 
 // pageFaultHandler is invoked when a PDT or PDT-entry is not present or when a
@@ -41,11 +100,21 @@ func pageFaultHandler(regs *gate.Registers) {
 	// CoW is supported for RO pages with the CoW flag set
 	if pageEntry != nil && !pageEntry.HasFlags(FlagRW) && pageEntry.HasFlags(FlagCopyOnWrite) {
 		var (
-			copy    mm.Frame
-			tmpPage mm.Page
-			err     *kernel.Error
+			origFrame = pageEntry.Frame()
+			copy      mm.Frame
+			tmpPage   mm.Page
+			err       *kernel.Error
 		)
 
+		// If the faulting mapping is the only user of the frame there is
+		// no need to copy it; just upgrade the mapping to RW in place.
+		if desc := origFrame.Descriptor(); desc != nil && desc.RefCount == 1 && !desc.HasFlags(mm.FrameFlagPinned) {
+			pageEntry.ClearFlags(FlagCopyOnWrite)
+			pageEntry.SetFlags(FlagPresent | FlagRW)
+			flushTLBEntryFn(faultPage.Address())
+			return
+		}
+
 		if copy, err = mm.AllocFrame(); err != nil {
 			nonRecoverablePageFault(faultAddress, regs, err)
 		} else if tmpPage, err = mapTemporaryFn(copy); err != nil {
@@ -62,6 +131,27 @@ func pageFaultHandler(regs *gate.Registers) {
 			pageEntry.SetFrame(copy)
 			flushTLBEntryFn(faultPage.Address())
 
+			// The mapping no longer references the original frame
+			_ = freeFrameFn(origFrame)
+
+			// Fault recovered; retry the instruction that caused the fault
+			return
+		}
+	}
+
+	// Accessing the guard page of a kernel stack indicates a stack overflow
+	if stackEntry := kernelStackForGuard(faultAddress); stackEntry != nil {
+		reportStackOverflow(stackEntry, faultAddress)
+		nonRecoverablePageFault(faultAddress, regs, errKernelStackOverflow)
+	}
+
+	// Pages inside lazy regions are allocated on their first access
+	if pageEntry == nil && regs.Info&pfErrPresent == 0 {
+		if flags, isLazy := lazyRegionFlags(faultAddress); isLazy {
+			if err := mapLazyPage(faultPage, flags); err != nil {
+				nonRecoverablePageFault(faultAddress, regs, err)
+			}
+
 			// Fault recovered; retry the instruction that caused the fault
 			return
 		}
@@ -78,35 +168,100 @@ func generalProtectionFaultHandler(regs *gate.Registers) {
 	kfmt.Printf("\nGeneral protection fault while accessing address: 0x%x\n", readCR2Fn())
 	kfmt.Printf("Registers:\n")
 	regs.DumpTo(kfmt.GetOutputSink())
+	printBacktrace(regs)
 
 	// TODO: Revisit this when user-mode tasks are implemented
 	panic(errUnrecoverableFault)
 }
 
+// doubleFaultHandler is invoked when an exception occurs while the CPU is
+// trying to invoke the handler for a prior exception. The most common cause
+// for double faults is a kernel stack overflow: the CPU is unable to push the
+// page fault exception frame to the overflowed stack. The handler runs on a
+// dedicated interrupt stack so that it can still report the error.
+func doubleFaultHandler(regs *gate.Registers) {
+	var (
+		faultAddress = uintptr(readCR2Fn())
+		err          = errUnrecoverableFault
+	)
+
+	// The faulting address of the page fault that caused the double fault
+	// is still stored in CR2; the stack pointer is checked as well in case
+	// the stack pointer itself has moved into the guard page.
+	stackEntry := kernelStackForGuard(faultAddress)
+	if stackEntry == nil {
+		stackEntry = kernelStackForGuard(uintptr(regs.RSP))
+	}
+
+	if stackEntry != nil {
+		reportStackOverflow(stackEntry, faultAddress)
+		err = errKernelStackOverflow
+	} else {
+		kfmt.Printf("\nDouble fault; last page fault address: 0x%16x\n", faultAddress)
+	}
+
+	kfmt.Printf("Registers:\n")
+	regs.DumpTo(kfmt.GetOutputSink())
+	printBacktrace(regs)
+
+	// TODO: Revisit this when user-mode tasks are implemented
+	panic(err)
+}
+
 func nonRecoverablePageFault(faultAddress uintptr, regs *gate.Registers, err *kernel.Error) {
 	kfmt.Printf("\nPage fault while accessing address: 0x%16x\nReason: ", faultAddress)
-	switch {
-	case regs.Info == 0:
-		kfmt.Printf("read from non-present page")
-	case regs.Info == 1:
-		kfmt.Printf("page protection violation (read)")
-	case regs.Info == 2:
-		kfmt.Printf("write to non-present page")
-	case regs.Info == 3:
-		kfmt.Printf("page protection violation (write)")
-	case regs.Info == 4:
-		kfmt.Printf("page-fault in user-mode")
-	case regs.Info == 8:
-		kfmt.Printf("page table has reserved bit set")
-	case regs.Info == 16:
-		kfmt.Printf("instruction fetch")
-	default:
-		kfmt.Printf("unknown")
-	}
+	printPageFaultReason(regs.Info)
 
 	kfmt.Printf("\n\nRegisters:\n")
 	regs.DumpTo(kfmt.GetOutputSink())
+	printBacktrace(regs)
 
 	// TODO: Revisit this when user-mode tasks are implemented
 	panic(err)
 }
+
+// printPageFaultReason decodes and prints the page fault error code. Each bit
+// of the error code is decoded separately as the CPU may set several of them
+// for a single fault (e.g. 0x7 for a user-mode write to a read-only page).
+func printPageFaultReason(errCode uint64) {
+	access := "read from"
+	switch {
+	case errCode&pfErrInstrFetch != 0:
+		access = "instruction fetch from"
+	case errCode&pfErrWrite != 0:
+		access = "write to"
+	}
+
+	cause := "non-present page"
+	if errCode&pfErrPresent != 0 {
+		cause = "page (protection violation)"
+	}
+
+	mode := "kernel"
+	if errCode&pfErrUser != 0 {
+		mode = "user"
+	}
+
+	kfmt.Printf("%s %s in %s-mode", access, cause, mode)
+
+	if errCode&pfErrReserved != 0 {
+		kfmt.Printf("; page table entry has a reserved bit set")
+	}
+
+	if errCode&pfErrProtectionKey != 0 {
+		kfmt.Printf("; protection key violation")
+	}
+
+	kfmt.Printf(" [error code: 0x%x]", errCode)
+}
+
+// printBacktrace outputs the call chain for the code that was interrupted by
+// a fault using the function registered via SetBacktracePrinter.
+func printBacktrace(regs *gate.Registers) {
+	if backtracePrinter == nil {
+		return
+	}
+
+	kfmt.Printf("\nBacktrace:\n")
+	backtracePrinter(kfmt.GetOutputSink(), uintptr(regs.RIP), uintptr(regs.RBP))
+}
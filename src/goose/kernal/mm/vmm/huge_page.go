@@ -0,0 +1,146 @@
+package vmm
+
+import (
+	"goose/kernel"
+	"goose/kernel/cpu"
+	"goose/kernel/mm"
+)
+
+// HugePageSize describes the size of a huge page mapping.
+type HugePageSize uint8
+
+const (
+	// HugePage2M selects 2Mb pages which are mapped by a P2 entry.
+	HugePage2M HugePageSize = iota
+
+	// HugePage1G selects 1Gb pages which are mapped by a P3 entry. Support
+	// for 1Gb pages depends on the CPU model.
+	HugePage1G
+)
+
+var (
+	// has1GPagesFn is used by tests and is automatically inlined by the
+	// compiler.
+	has1GPagesFn = cpu.Has1GPages
+
+	errMisalignedHugePage = &kernel.Error{Module: "vmm", Message: "huge page mappings require page and frame addresses aligned to the huge page size"}
+	errHugePageMapped     = &kernel.Error{Module: "vmm", Message: "virtual address is covered by a huge page mapping"}
+	errPageTableInUse     = &kernel.Error{Module: "vmm", Message: "huge page mapping would replace a page table that is still in use"}
+)
+
+// level returns the page table level whose entries map pages of this size.
+func (size HugePageSize) level() uint8 {
+	return pageLevels - 2 - uint8(size)
+}
+
+// Bytes returns the number of bytes covered by a huge page of this size.
+func (size HugePageSize) Bytes() uintptr {
+	return 1 << pageLevelShifts[size.level()]
+}
+
+// pageCount returns the number of regular pages covered by a huge page of
+// this size.
+func (size HugePageSize) pageCount() uintptr {
+	return size.Bytes() >> mm.PageShift
+}
+
+// supported returns true if the CPU can map huge pages of this size.
+func (size HugePageSize) supported() bool {
+	return size == HugePage2M || has1GPagesFn()
+}
+
+// MapHugePage establishes a mapping between a huge virtual page and a block of
+// contiguous physical frames using the currently active page directory table.
+// Both page and frame must be aligned to the requested huge page size. Like
+// Map, any missing page tables above the level that hosts the huge page entry
+// are allocated using the active physical frame allocator.
+//
+// MapHugePage will refuse to overwrite an entry that points to a page table as
+// this would leak the table and any mappings it contains. Like Map, attempts to
+// establish a RW mapping to a block that contains ReservedZeroedFrame will
+// result in an error.
+func MapHugePage(page mm.Page, frame mm.Frame, size HugePageSize, flags PageTableEntryFlag) *kernel.Error {
+	if !size.supported() {
+		return errNoHugePageSupport
+	}
+
+	alignMask := size.pageCount() - 1
+	if uintptr(page)&alignMask != 0 || uintptr(frame)&alignMask != 0 {
+		return errMisalignedHugePage
+	}
+
+	if protectReservedZeroedPage && (flags&FlagRW) != 0 &&
+		ReservedZeroedFrame >= frame && uintptr(ReservedZeroedFrame-frame) <= alignMask {
+		return errAttemptToRWMapReservedFrame
+	}
+
+	return mapAtLevel(page, frame, flags, size.level())
+}
+
+// UnmapHugePage removes a mapping previously installed via a call to
+// MapHugePage. The physical frames backing the huge page are not released.
+func UnmapHugePage(page mm.Page, size HugePageSize) *kernel.Error {
+	var (
+		err       *kernel.Error
+		leafLevel = size.level()
+	)
+
+	if uintptr(page)&(size.pageCount()-1) != 0 {
+		return errMisalignedHugePage
+	}
+
+	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		if !pte.HasFlags(FlagPresent) {
+			err = ErrInvalidMapping
+			return false
+		}
+
+		isHuge := pte.HasFlags(FlagHugePage)
+		switch {
+		case pteLevel == leafLevel && !isHuge:
+			err = ErrInvalidMapping
+		case pteLevel == leafLevel:
+			pte.ClearFlags(FlagPresent)
+			invalidatePage(page.Address(), size.Bytes())
+		case isHuge:
+			// The address is covered by a huge page of a different size
+			err = errHugePageMapped
+		default:
+			return true
+		}
+
+		return false
+	})
+
+	return err
+}
+
+// hugePageSizeFor returns the largest huge page size that can be used for
+// mapping the region of pageCount pages that starts at page to the frames
+// starting at frame.
+func hugePageSizeFor(page mm.Page, frame mm.Frame, pageCount uintptr) (HugePageSize, bool) {
+	for size := HugePage1G; ; size-- {
+		alignMask := size.pageCount() - 1
+		if pageCount > alignMask && uintptr(page)&alignMask == 0 && uintptr(frame)&alignMask == 0 && size.supported() {
+			return size, true
+		}
+
+		if size == HugePage2M {
+			return 0, false
+		}
+	}
+}
+
+// regionAlignment returns the virtual address alignment that allows a region
+// of the specified size to be mapped using the largest possible huge pages.
+func regionAlignment(size uintptr) uintptr {
+	if size1G := HugePage1G.Bytes(); size >= size1G && has1GPagesFn() {
+		return size1G
+	}
+
+	if size2M := HugePage2M.Bytes(); size >= size2M {
+		return size2M
+	}
+
+	return mm.PageSize
+}
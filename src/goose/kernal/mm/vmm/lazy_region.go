@@ -0,0 +1,160 @@
+package vmm
+
+import (
+	"goose/kernel"
+	"goose/kernel/mm"
+	"goose/kernel/sync"
+)
+
+// maxLazyRegions defines the maximum number of lazy regions that can be
+// registered at the same time.
+const maxLazyRegions = 64
+
+var (
+	errLazyRegionNoSlots  = &kernel.Error{Module: "vmm", Message: "no free slots for registering lazy region"}
+	errLazyRegionNotFound = &kernel.Error{Module: "vmm", Message: "address does not correspond to the start of a lazy region"}
+)
+
+// lazyRegion describes a reserved virtual memory region whose pages are
+// allocated on demand by the page fault handler.
+type lazyRegion struct {
+	start, end uintptr
+	flags      PageTableEntryFlag
+}
+
+// lazyRegionList tracks the currently registered lazy regions. As regions are
+// looked up by the page fault handler, the list uses a fixed-size array.
+type lazyRegionList struct {
+	mutex   sync.Spinlock
+	count   int
+	regions [maxLazyRegions]lazyRegion
+}
+
+// lazyRegions contains the set of registered lazy regions.
+var lazyRegions lazyRegionList
+
+// ReserveLazyRegion reserves a region with the requested size in the kernel
+// address space without establishing any mappings for it. The first access to
+// each page in the region triggers a page fault which is handled by
+// allocating a zeroed physical frame and mapping it using the supplied flags.
+// If size is not a multiple of mm.PageSize it will be automatically rounded
+// up.
+//
+// Lazy regions must not be accessed while holding locks that are also
+// acquired by the physical frame allocator or the page fault handler.
+func ReserveLazyRegion(size uintptr, flags PageTableEntryFlag) (uintptr, *kernel.Error) {
+	// Reject W+X regions now rather than when their pages get accessed
+	if flags&FlagRW != 0 && flags&(FlagNoExecute|FlagAllowWriteExecute) == 0 {
+		return 0, errWriteExecuteMapping
+	}
+
+	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+	regionAddr, err := ReserveRegion(size)
+	if err != nil {
+		return 0, err
+	}
+
+	lazyRegions.mutex.Acquire()
+	if lazyRegions.count == maxLazyRegions {
+		lazyRegions.mutex.Release()
+		_ = ReleaseRegion(regionAddr, size)
+		return 0, errLazyRegionNoSlots
+	}
+
+	lazyRegions.regions[lazyRegions.count] = lazyRegion{
+		start: regionAddr,
+		end:   regionAddr + size,
+		flags: flags | FlagPresent,
+	}
+	lazyRegions.count++
+	lazyRegions.mutex.Release()
+
+	return regionAddr, nil
+}
+
+// ReleaseLazyRegion unregisters the lazy region that starts at regionAddr,
+// releases any physical frames that were allocated for it and returns the
+// region back to the kernel address space.
+func ReleaseLazyRegion(regionAddr uintptr) *kernel.Error {
+	var region lazyRegion
+
+	lazyRegions.mutex.Acquire()
+	index := 0
+	for ; index < lazyRegions.count && lazyRegions.regions[index].start != regionAddr; index++ {
+	}
+
+	if index == lazyRegions.count {
+		lazyRegions.mutex.Release()
+		return errLazyRegionNotFound
+	}
+
+	region = lazyRegions.regions[index]
+	copy(lazyRegions.regions[index:lazyRegions.count-1], lazyRegions.regions[index+1:lazyRegions.count])
+	lazyRegions.count--
+	lazyRegions.mutex.Release()
+
+	// Only pages that have been accessed are backed by a physical frame
+	BeginMapTransaction()
+	for page, lastPage := mm.PageFromAddress(region.start), mm.PageFromAddress(region.end); page < lastPage; page++ {
+		if _, err := translateFn(page.Address()); err != nil {
+			continue
+		}
+
+		if err := UnmapAndFree(page); err != nil {
+			_ = CommitMapTransaction()
+			return err
+		}
+	}
+
+	if err := CommitMapTransaction(); err != nil {
+		return err
+	}
+
+	return ReleaseRegion(region.start, region.end-region.start)
+}
+
+// lazyRegionFlags checks whether the supplied address belongs to a lazy region
+// and returns the page table entry flags for the region.
+func lazyRegionFlags(virtAddr uintptr) (PageTableEntryFlag, bool) {
+	lazyRegions.mutex.Acquire()
+
+	for index := 0; index < lazyRegions.count; index++ {
+		if region := &lazyRegions.regions[index]; virtAddr >= region.start && virtAddr < region.end {
+			flags := region.flags
+			lazyRegions.mutex.Release()
+			return flags, true
+		}
+	}
+
+	lazyRegions.mutex.Release()
+	return 0, false
+}
+
+// mapLazyPage allocates a physical frame, clears its contents and maps it to
+// the supplied page using the specified flags. The frame is cleared through
+// a writable mapping of the page itself which is then switched to the region
+// flags. This supports lazy regions without the RW flag and, unlike the
+// temporary mapping slot, is safe to use while the page fault handler
+// interrupts code that holds a temporary mapping.
+func mapLazyPage(page mm.Page, flags PageTableEntryFlag) *kernel.Error {
+	frame, err := mm.AllocFrame()
+	if err != nil {
+		return err
+	}
+
+	if err = mapFn(page, frame, FlagPresent|FlagRW|FlagNoExecute); err != nil {
+		_ = freeFrameFn(frame)
+		return err
+	}
+
+	kernel.Memset(page.Address(), 0, mm.PageSize)
+
+	// Remap never needs to allocate page tables as the page is now mapped
+	if err = Remap(page, frame, flags); err != nil {
+		_ = unmapFn(page)
+		_ = freeFrameFn(frame)
+		return err
+	}
+
+	return nil
+}
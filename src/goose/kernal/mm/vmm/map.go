@@ -4,6 +4,7 @@ import (
 	"goose/kernel"
 	"goose/kernel/cpu"
 	"goose/kernel/mm"
+	"reflect"
 	"unsafe"
 )
 
@@ -28,8 +29,12 @@ var (
 
 	earlyReserveRegionFn = EarlyReserveRegion
 
-	errNoHugePageSupport           = &kernel.Error{Module: "vmm", Message: "huge pages are not supported"}
+	// freeFrameFn is used by tests to override calls to mm.FreeFrame.
+	freeFrameFn = mm.FreeFrame
+
+	errNoHugePageSupport           = &kernel.Error{Module: "vmm", Message: "huge page size is not supported by the CPU"}
 	errAttemptToRWMapReservedFrame = &kernel.Error{Module: "vmm", Message: "reserved blank frame cannot be mapped with a RW flag"}
+	errWriteExecuteMapping         = &kernel.Error{Module: "vmm", Message: "writable mappings must be non-executable unless FlagAllowWriteExecute is specified"}
 )
 
 // Map establishes a mapping between a virtual page and a physical mmory frame
@@ -38,26 +43,68 @@ var (
 // paging level supported by the MMU.
 //
 // Attempts to map ReservedZeroedFrame with a RW flag will result in an error.
+// Writable mappings must also specify FlagNoExecute unless the
+// FlagAllowWriteExecute override flag is set.
 func Map(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
 	if protectReservedZeroedPage && frame == ReservedZeroedFrame && (flags&FlagRW) != 0 {
 		return errAttemptToRWMapReservedFrame
 	}
 
+	return mapAtLevel(page, frame, flags, pageLevels-1)
+}
+
+// mapAtLevel implements the mapping logic for Map and MapHugePage. It walks
+// the page tables for the supplied page allocating any missing tables until it
+// reaches leafLevel and then installs the frame mapping in the entry at that
+// level. Entries above the last page level are flagged as huge pages.
+func mapAtLevel(page mm.Page, frame mm.Frame, flags PageTableEntryFlag, leafLevel uint8) *kernel.Error {
 	var err *kernel.Error
 
+	// Enforce W^X; CoW mappings become writable once they are accessed
+	if flags&(FlagRW|FlagCopyOnWrite) != 0 && flags&(FlagNoExecute|FlagAllowWriteExecute) == 0 {
+		return errWriteExecuteMapping
+	}
+
+	flags = memTypeFlags(flags, leafLevel)
+	if leafLevel < pageLevels-1 {
+		flags |= FlagHugePage
+	}
+
+	// The kernel half of the address space is shared by all PDTs; mapping
+	// it using global pages preserves its TLB entries when switching PDTs
+	if globalPagesEnabled && isGlobalAddress(page.Address()) {
+		flags |= FlagGlobal
+	}
+
 	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
-		// If we reached the last level all we need to do is to map the
+		// If we reached the leaf level all we need to do is to map the
 		// frame in place and flag it as present and flush its TLB entry
-		if pteLevel == pageLevels-1 {
+		if pteLevel == leafLevel {
+			// Entries above the last level that are not flagged as
+			// huge pages point to page tables that must be preserved
+			wasPresent := pte.HasFlags(FlagPresent)
+			if pteLevel < pageLevels-1 && wasPresent && !pte.HasFlags(FlagHugePage) {
+				err = errPageTableInUse
+				return false
+			}
+
 			*pte = 0
 			pte.SetFrame(frame)
 			pte.SetFlags(flags)
-			flushTLBEntryFn(page.Address())
-			return true
+
+			// The TLB does not cache entries for non-present pages;
+			// only previous mappings whose invalidation has been
+			// deferred by a mapping transaction need to be flushed
+			if wasPresent {
+				flushTLBEntryFn(page.Address())
+			} else {
+				flushIfPending(page.Address(), leafPageSize(leafLevel))
+			}
+			return false
 		}
 
 		if pte.HasFlags(FlagHugePage) {
-			err = errNoHugePageSupport
+			err = errHugePageMapped
 			return false
 		}
 
@@ -70,6 +117,8 @@ func Map(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
 				return false
 			}
 
+			newTableFrame.SetUsage(mm.FrameUsagePageTable)
+
 			*pte = 0
 			pte.SetFrame(newTableFrame)
 			pte.SetFlags(FlagPresent | FlagRW)
@@ -91,22 +140,74 @@ func Map(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
 // always rounded up to the nearest page boundary. MapRegion reserves the next
 // available region in the active virtual address space, establishes the
 // mapping and returns back the Page that corresponds to the region start.
+//
+// For regions that are large enough, MapRegion aligns the start of the
+// reserved virtual region so that it shares the same offset within a huge
+// page as the physical region. This allows the parts of the region that are
+// suitably sized and aligned to be mapped using huge pages.
+//
+// If the mapping cannot be established, any pages that were already mapped are
+// unmapped and the reserved region is returned to the kernel address space.
 func MapRegion(frame mm.Frame, size uintptr, flags PageTableEntryFlag) (mm.Page, *kernel.Error) {
 	// Reserve next free block in the address space
 	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
-	startPage, err := earlyReserveRegionFn(size)
+	regionAddr, err := reserveAlignedRegion(size, regionAlignment(size), frame.Address())
 	if err != nil {
 		return 0, err
 	}
 
-	pageCount := size >> mm.PageShift
-	for page := mm.PageFromAddress(startPage); pageCount > 0; pageCount, page, frame = pageCount-1, page+1, frame+1 {
-		if err := mapFn(page, frame, flags); err != nil {
-			return 0, err
+	BeginMapTransaction()
+
+	startPage := mm.PageFromAddress(regionAddr)
+	page, pageCount := startPage, size>>mm.PageShift
+	for pageCount > 0 {
+		mappedPages := uintptr(1)
+		if hugeSize, ok := hugePageSizeFor(page, frame, pageCount); ok {
+			if err = MapHugePage(page, frame, hugeSize, flags); err != nil {
+				break
+			}
+			mappedPages = hugeSize.pageCount()
+		} else if err = mapFn(page, frame, flags); err != nil {
+			break
 		}
+
+		page, frame, pageCount = page+mm.Page(mappedPages), frame+mm.Frame(mappedPages), pageCount-mappedPages
 	}
 
-	return mm.PageFromAddress(startPage), nil
+	if commitErr := CommitMapTransaction(); err == nil {
+		err = commitErr
+	}
+
+	if err != nil {
+		_ = unmapPages(startPage, page.Address()-regionAddr)
+		_ = ReleaseRegion(regionAddr, size)
+		return 0, err
+	}
+
+	return startPage, nil
+}
+
+// MapReadOnlyRegion establishes a read-only, non-executable mapping to the
+// physical memory region [physAddr, physAddr+size) in the kernel address space
+// and returns a byte slice for accessing its contents. The physical address
+// does not need to be page-aligned. This function is typically used for
+// accessing the contents of boot modules (e.g. an initrd).
+func MapReadOnlyRegion(physAddr, size uintptr) ([]byte, *kernel.Error) {
+	if size == 0 {
+		return nil, nil
+	}
+
+	startFrame := mm.FrameFromAddress(physAddr)
+	startPage, err := MapRegion(startFrame, size+PageOffset(physAddr), FlagPresent|FlagNoExecute)
+	if err != nil {
+		return nil, err
+	}
+
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Data: startPage.Address() + PageOffset(physAddr),
+		Len:  int(size),
+		Cap:  int(size),
+	})), nil
 }
 
 // IdentityMapRegion establishes an identity mapping to the physical mmory
@@ -118,12 +219,18 @@ func IdentityMapRegion(startFrame mm.Frame, size uintptr, flags PageTableEntryFl
 	startPage := mm.Page(startFrame)
 	pageCount := mm.Page(((size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)) >> mm.PageShift)
 
+	BeginMapTransaction()
 	for curPage := startPage; curPage < startPage+pageCount; curPage++ {
 		if err := mapFn(curPage, mm.Frame(curPage), flags); err != nil {
+			_ = CommitMapTransaction()
 			return 0, err
 		}
 	}
 
+	if err := CommitMapTransaction(); err != nil {
+		return 0, err
+	}
+
 	return startPage, nil
 }
 
@@ -138,13 +245,50 @@ func MapTemporary(frame mm.Frame) (mm.Page, *kernel.Error) {
 		return 0, errAttemptToRWMapReservedFrame
 	}
 
-	if err := Map(mm.PageFromAddress(tempMappingAddr), frame, FlagPresent|FlagRW); err != nil {
+	if err := Map(mm.PageFromAddress(tempMappingAddr), frame, FlagPresent|FlagRW|FlagNoExecute); err != nil {
 		return 0, err
 	}
 
 	return mm.PageFromAddress(tempMappingAddr), nil
 }
 
+// Remap replaces the frame and flags of a page that is already mapped by a
+// 4K page table entry. Unlike Map, Remap never allocates page tables so it can
+// be safely invoked while holding the physical frame allocator lock. Calls to
+// Remap for pages that are not mapped return ErrInvalidMapping.
+//
+// Remap enforces the same ReservedZeroedFrame and W^X checks as Map.
+func Remap(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+	if protectReservedZeroedPage && frame == ReservedZeroedFrame && (flags&FlagRW) != 0 {
+		return errAttemptToRWMapReservedFrame
+	}
+
+	if flags&(FlagRW|FlagCopyOnWrite) != 0 && flags&(FlagNoExecute|FlagAllowWriteExecute) == 0 {
+		return errWriteExecuteMapping
+	}
+
+	pte, pteLevel, err := pteForAddress(page.Address())
+	if err != nil {
+		return err
+	}
+
+	if pteLevel != pageLevels-1 {
+		return errHugePageMapped
+	}
+
+	flags = memTypeFlags(flags, pteLevel)
+	if globalPagesEnabled && isGlobalAddress(page.Address()) {
+		flags |= FlagGlobal
+	}
+
+	*pte = 0
+	pte.SetFrame(frame)
+	pte.SetFlags(flags)
+	flushTLBEntryFn(page.Address())
+
+	return nil
+}
+
 // Unmap removes a mapping previously installed via a call to Map or MapTemporary.
 func Unmap(page mm.Page) *kernel.Error {
 	var err *kernel.Error
@@ -154,7 +298,7 @@ func Unmap(page mm.Page) *kernel.Error {
 		// page as non-present and flush its TLB entry
 		if pteLevel == pageLevels-1 {
 			pte.ClearFlags(FlagPresent)
-			flushTLBEntryFn(page.Address())
+			invalidatePage(page.Address(), mm.PageSize)
 			return true
 		}
 
@@ -165,7 +309,7 @@ func Unmap(page mm.Page) *kernel.Error {
 		}
 
 		if pte.HasFlags(FlagHugePage) {
-			err = errNoHugePageSupport
+			err = errHugePageMapped
 			return false
 		}
 
@@ -175,18 +319,107 @@ func Unmap(page mm.Page) *kernel.Error {
 	return err
 }
 
+// UnmapAndFree removes a mapping previously installed via a call to Map and
+// returns the physical frame that backed it to the active frame allocator.
+// Any page tables below the top-level table that become empty as a result of
+// the unmap operation are also released. Top-level entries are never cleared
+// as the tables they point to are shared between all kernel page directory
+// tables.
+//
+// The ReservedZeroedFrame is never released; calls to UnmapAndFree for pages
+// mapped to it only remove the mapping. If a mapping transaction is in
+// progress, the frame is released when the transaction is committed.
+func UnmapAndFree(page mm.Page) *kernel.Error {
+	var (
+		err        *kernel.Error
+		pteEntries [pageLevels]*pageTableEntry
+	)
+
+	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		pteEntries[pteLevel] = pte
+
+		if !pte.HasFlags(FlagPresent) {
+			err = ErrInvalidMapping
+			return false
+		}
+
+		if pteLevel < pageLevels-1 && pte.HasFlags(FlagHugePage) {
+			err = errHugePageMapped
+			return false
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Clear the last level entry and release the frame that backed it
+	leafPte := pteEntries[pageLevels-1]
+	frame := leafPte.Frame()
+	*leafPte = 0
+	invalidatePage(page.Address(), mm.PageSize)
+
+	if frame != ReservedZeroedFrame {
+		if err = releaseUnmappedFrame(frame); err != nil {
+			return err
+		}
+	}
+
+	// Walk back towards the top-level table releasing any empty tables.
+	// When we release a table at level N we also need to flush the TLB
+	// entry for the address that the table is recursively mapped to.
+	for pteLevel := pageLevels - 1; pteLevel > 1; pteLevel-- {
+		tableAddr := uintptr(unsafe.Pointer(pteEntries[pteLevel])) &^ (mm.PageSize - 1)
+		if !tableIsEmpty(tableAddr) {
+			break
+		}
+
+		parentPte := pteEntries[pteLevel-1]
+		tableFrame := parentPte.Frame()
+		*parentPte = 0
+		flushTLBEntryFn(tableAddr)
+
+		// The paging-structure caches for the page may still point to
+		// the released table so its invalidation cannot be deferred
+		flushTLBEntryFn(page.Address())
+
+		if err = freeFrameFn(tableFrame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tableIsEmpty returns true if none of the entries in the page table located
+// at the supplied virtual address are flagged as present.
+func tableIsEmpty(tableAddr uintptr) bool {
+	for entryAddr, lastEntryAddr := tableAddr, tableAddr+mm.PageSize; entryAddr < lastEntryAddr; entryAddr += 1 << mm.PointerShift {
+		if (*pageTableEntry)(ptePtrFn(entryAddr)).HasFlags(FlagPresent) {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Translate returns the physical address that corresponds to the supplied
 // virtual address or ErrInvalidMapping if the virtual address does not
-// correspond to a mapped physical address.
+// correspond to a mapped physical address. Addresses covered by huge page
+// mappings are also supported.
 func Translate(virtAddr uintptr) (uintptr, *kernel.Error) {
-	pte, err := pteForAddress(virtAddr)
+	pte, pteLevel, err := pteForAddress(virtAddr)
 	if err != nil {
 		return 0, err
 	}
 
 	// Calculate the physical address by taking the physical frame address and
-	// appending the offset from the virtual address
-	physAddr := pte.Frame().Address() + PageOffset(virtAddr)
+	// appending the offset from the virtual address. For huge pages, the
+	// offset includes all address bits below the entry's page level.
+	offsetMask := uintptr(1)<<pageLevelShifts[pteLevel] - 1
+	physAddr := (pte.Frame().Address() &^ offsetMask) + (virtAddr & offsetMask)
 	return physAddr, nil
 }
 
@@ -0,0 +1,197 @@
+package vmm
+
+import (
+	"goose/kernel"
+	"goose/kernel/kfmt"
+	"goose/kernel/mm"
+	"io"
+)
+
+// MappingVisitor is a function that gets invoked by VisitMappings for each
+// range of mapped pages. The visitor receives the virtual and physical start
+// address of the range, its size in bytes, the flags of the page table entries
+// that map it and whether the range is mapped using huge pages. As bit 7 is
+// the PAT bit for 4K entries, FlagHugePage must not be used for identifying
+// huge page ranges. If the visitor returns false, the walk is aborted.
+type MappingVisitor func(virtAddr, physAddr, size uintptr, flags PageTableEntryFlag, isHuge bool) bool
+
+// mappingWalker merges the leaf entries visited while walking the page tables
+// into ranges of pages that are contiguous in both the virtual and the
+// physical address space and share the same flags.
+type mappingWalker struct {
+	visitor MappingVisitor
+	aborted bool
+
+	inRange              bool
+	rangeVirt, rangePhys uintptr
+	rangeSize            uintptr
+	rangeFlags           PageTableEntryFlag
+	rangeIsHuge          bool
+}
+
+// VisitMappings walks all page table levels of the supplied page directory
+// table and invokes visitor for each range of mapped pages. Adjacent pages
+// are merged into a single range if they map physically contiguous frames
+// using identical flags. The accessed and dirty flags are not reported. The
+// region used for the recursive page table mapping is skipped.
+//
+// The PDT does not need to be active. The visitor is invoked while holding
+// the lock that protects the page table access windows; it must not call
+// VisitMappings, PageDirectoryTable.Clone or PageDirectoryTable.Destroy.
+func VisitMappings(pdt PageDirectoryTable, visitor MappingVisitor) *kernel.Error {
+	walker := mappingWalker{visitor: visitor}
+
+	pdtWindows.mutex.Acquire()
+	err := walker.walkTable(0, pdt.pdtFrame, 0)
+	if err == nil {
+		walker.flush()
+	}
+	unmapTableWindows()
+	pdtWindows.mutex.Release()
+
+	return err
+}
+
+// walkTable visits the entries of the page table stored in tableFrame. The
+// baseAddr argument specifies the virtual address that corresponds to the
+// first table entry.
+func (w *mappingWalker) walkTable(level uint8, tableFrame mm.Frame, baseAddr uintptr) *kernel.Error {
+	table, err := mapTableWindow(level, tableFrame)
+	if err != nil {
+		return err
+	}
+
+	for index := 0; index < pageTableEntries && !w.aborted; index++ {
+		// Skip the recursive mapping entry
+		if level == 0 && index == pageTableEntries-1 {
+			continue
+		}
+
+		entry := table[index]
+		if !entry.HasFlags(FlagPresent) {
+			continue
+		}
+
+		virtAddr := baseAddr + (uintptr(index) << pageLevelShifts[level])
+		if level == 0 && index >= userHalfEntries {
+			// Sign-extend addresses in the kernel half
+			virtAddr |= kernelHalfStart
+		}
+
+		isHuge := level < pageLevels-1 && entry.HasFlags(FlagHugePage)
+		if level < pageLevels-1 && !isHuge {
+			if err = w.walkTable(level+1, entry.Frame(), virtAddr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// For huge pages the low frame address bits include the PAT bit
+		size := leafPageSize(level)
+		flags := PageTableEntryFlag(uintptr(entry)&^ptePhysPageMask) &^ (FlagAccessed | FlagDirty)
+		if isHuge {
+			flags |= PageTableEntryFlag(entry) & flagHugePAT
+		}
+
+		w.add(virtAddr, entry.Frame().Address()&^(size-1), size, flags, isHuge)
+	}
+
+	return nil
+}
+
+// add merges a mapped page with the current range or reports the current
+// range to the visitor and starts a new one.
+func (w *mappingWalker) add(virtAddr, physAddr, size uintptr, flags PageTableEntryFlag, isHuge bool) {
+	if w.inRange &&
+		virtAddr == w.rangeVirt+w.rangeSize &&
+		physAddr == w.rangePhys+w.rangeSize &&
+		flags == w.rangeFlags &&
+		isHuge == w.rangeIsHuge {
+		w.rangeSize += size
+		return
+	}
+
+	w.flush()
+	w.inRange = true
+	w.rangeVirt, w.rangePhys, w.rangeSize, w.rangeFlags, w.rangeIsHuge = virtAddr, physAddr, size, flags, isHuge
+}
+
+// flush reports the current range to the visitor.
+func (w *mappingWalker) flush() {
+	if !w.inRange || w.aborted {
+		return
+	}
+
+	w.inRange = false
+	w.aborted = !w.visitor(w.rangeVirt, w.rangePhys, w.rangeSize, w.rangeFlags, w.rangeIsHuge)
+}
+
+// DumpMappings outputs the mapped ranges of the supplied page directory table
+// to w. Each line contains the virtual address range, the physical start
+// address, the range size and a summary of its flags:
+//  - r: the range is present (always set)
+//  - w, c or -: the range is writable, copy-on-write or read-only
+//  - x or -: the range is executable or not
+//  - u or k: the range is accessible from user-mode or only by the kernel
+//  - g or -: the range is mapped using global pages or not
+//  - H or -: the range is mapped using huge pages or 4K pages
+// followed by the memory type (WB, WT, UC-, UC or WC).
+func DumpMappings(w io.Writer, pdt PageDirectoryTable) *kernel.Error {
+	var rangeCount int
+
+	err := VisitMappings(pdt, func(virtAddr, physAddr, size uintptr, flags PageTableEntryFlag, isHuge bool) bool {
+		kfmt.Fprintf(w, "0x%16x-0x%16x 0x%16x %8dK r%s%s%s%s%s %s\n",
+			virtAddr, virtAddr+size,
+			physAddr,
+			size>>10,
+			flagChar(flags, FlagRW, "w", flagChar(flags, FlagCopyOnWrite, "c", "-")),
+			flagChar(flags, FlagNoExecute, "-", "x"),
+			flagChar(flags, FlagUserAccessible, "u", "k"),
+			flagChar(flags, FlagGlobal, "g", "-"),
+			boolChar(isHuge, "H", "-"),
+			memTypeName(flags, isHuge),
+		)
+		rangeCount++
+		return true
+	})
+
+	kfmt.Fprintf(w, "%d mapped range(s)\n", rangeCount)
+	return err
+}
+
+// flagChar returns setStr if flags contains flag or unsetStr otherwise.
+func flagChar(flags, flag PageTableEntryFlag, setStr, unsetStr string) string {
+	if flags&flag != 0 {
+		return setStr
+	}
+
+	return unsetStr
+}
+
+// boolChar returns setStr if value is true or unsetStr otherwise.
+func boolChar(value bool, setStr, unsetStr string) string {
+	if value {
+		return setStr
+	}
+
+	return unsetStr
+}
+
+// memTypeName returns the name of the memory type selected by the supplied
+// page table entry flags for a 4K or a huge page entry.
+func memTypeName(flags PageTableEntryFlag, isHuge bool) string {
+	patIndex := 0
+	if flags&FlagWriteThroughCaching != 0 {
+		patIndex |= 1
+	}
+	if flags&FlagDoNotCache != 0 {
+		patIndex |= 2
+	}
+
+	// For 4K pages bit 7 is the PAT bit; for huge pages it is flagHugePAT
+	if (isHuge && flags&flagHugePAT != 0) || (!isHuge && flags&flagPAT != 0) {
+		patIndex |= 4
+	}
+
+	return [...]string{"WB", "WT", "UC-", "UC", "WC", "WT", "UC-", "UC"}[patIndex]
+}
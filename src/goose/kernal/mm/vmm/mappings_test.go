@@ -0,0 +1,180 @@
+package vmm
+
+import (
+	"bytes"
+	"goose/kernel"
+	"goose/kernel/mm"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// mockPageTables redirects the page table access windows used by
+// VisitMappings to the supplied tables which are indexed by their frame
+// number. The returned function restores the original state.
+func mockPageTables(tables map[mm.Frame]*pageTable) func() {
+	const fakeWindowBase = uintptr(0xffffff0000000000)
+
+	var (
+		origBase       = pdtWindows.base
+		origMap        = mapFn
+		origPtePtr     = ptePtrFn
+		origTranslate  = translateFn
+		windowFrames   [pdtWindowSlots]mm.Frame
+		windowBasePage = mm.PageFromAddress(fakeWindowBase)
+	)
+
+	pdtWindows.base = fakeWindowBase
+	mapFn = func(page mm.Page, frame mm.Frame, _ PageTableEntryFlag) *kernel.Error {
+		windowFrames[page-windowBasePage] = frame
+		return nil
+	}
+	ptePtrFn = func(entryAddr uintptr) unsafe.Pointer {
+		slot := mm.PageFromAddress(entryAddr) - windowBasePage
+		return unsafe.Pointer(tables[windowFrames[slot]])
+	}
+	translateFn = func(uintptr) (uintptr, *kernel.Error) {
+		return 0, ErrInvalidMapping
+	}
+
+	return func() {
+		pdtWindows.base, mapFn, ptePtrFn, translateFn = origBase, origMap, origPtePtr, origTranslate
+	}
+}
+
+// mapTestEntry populates a page table entry with the supplied frame and flags.
+func mapTestEntry(entry *pageTableEntry, frame mm.Frame, flags PageTableEntryFlag) {
+	*entry = 0
+	entry.SetFrame(frame)
+	entry.SetFlags(flags)
+}
+
+type visitedMapping struct {
+	virtAddr, physAddr, size uintptr
+	flags                    PageTableEntryFlag
+	isHuge                   bool
+}
+
+// setupTestMappings builds a page table hierarchy rooted at frame 1 with the
+// following mappings:
+//  - 0x0-0x2000: two 4K RW pages backed by contiguous frames
+//  - 0x2000-0x3000: a 4K write-combining page (PAT bit set)
+//  - 0x200000-0x400000: a 2M read-only huge page
+//  - 0x400000-0x600000: a 2M write-combining huge page
+// The recursive mapping entry of the top-level table is also populated.
+func setupTestMappings() map[mm.Frame]*pageTable {
+	var (
+		pdt, pdpt, pd, pt pageTable
+		tables            = map[mm.Frame]*pageTable{1: &pdt, 2: &pdpt, 3: &pd, 4: &pt}
+	)
+
+	mapTestEntry(&pdt[0], 2, FlagPresent|FlagRW)
+	mapTestEntry(&pdt[pageTableEntries-1], 1, FlagPresent|FlagRW)
+	mapTestEntry(&pdpt[0], 3, FlagPresent|FlagRW)
+	mapTestEntry(&pd[0], 4, FlagPresent|FlagRW)
+	mapTestEntry(&pt[0], 0x100, FlagPresent|FlagRW|FlagNoExecute|FlagAccessed)
+	mapTestEntry(&pt[1], 0x101, FlagPresent|FlagRW|FlagNoExecute|FlagDirty)
+	mapTestEntry(&pt[2], 0x200, FlagPresent|FlagRW|FlagNoExecute|flagPAT)
+	mapTestEntry(&pd[1], 0x400, FlagPresent|FlagHugePage)
+	mapTestEntry(&pd[2], 0x600, FlagPresent|FlagRW|FlagNoExecute|FlagHugePage)
+	pd[2] |= pageTableEntry(flagHugePAT)
+
+	return tables
+}
+
+func TestVisitMappings(t *testing.T) {
+	defer mockPageTables(setupTestMappings())()
+
+	var visited []visitedMapping
+	err := VisitMappings(PageDirectoryTable{pdtFrame: 1}, func(virtAddr, physAddr, size uintptr, flags PageTableEntryFlag, isHuge bool) bool {
+		visited = append(visited, visitedMapping{virtAddr, physAddr, size, flags, isHuge})
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []visitedMapping{
+		{0x0, 0x100000, 0x2000, FlagPresent | FlagRW | FlagNoExecute, false},
+		{0x2000, 0x200000, 0x1000, FlagPresent | FlagRW | FlagNoExecute | flagPAT, false},
+		{0x200000, 0x400000, 0x200000, FlagPresent | FlagHugePage, true},
+		{0x400000, 0x600000, 0x200000, FlagPresent | FlagRW | FlagNoExecute | FlagHugePage | flagHugePAT, true},
+	}
+
+	if len(visited) != len(exp) {
+		t.Fatalf("expected %d mapped ranges; got %d: %+v", len(exp), len(visited), visited)
+	}
+
+	for index, expMapping := range exp {
+		if visited[index] != expMapping {
+			t.Errorf("[range %d] expected %+v; got %+v", index, expMapping, visited[index])
+		}
+	}
+}
+
+func TestVisitMappingsAbort(t *testing.T) {
+	defer mockPageTables(setupTestMappings())()
+
+	var visitCount int
+	err := VisitMappings(PageDirectoryTable{pdtFrame: 1}, func(_, _, _ uintptr, _ PageTableEntryFlag, _ bool) bool {
+		visitCount++
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if visitCount != 1 {
+		t.Fatalf("expected the visitor to be invoked once; got %d", visitCount)
+	}
+}
+
+func TestDumpMappings(t *testing.T) {
+	defer mockPageTables(setupTestMappings())()
+
+	var buf bytes.Buffer
+	if err := DumpMappings(&buf, PageDirectoryTable{pdtFrame: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	exp := []string{
+		"rw-k-- WB",
+		"rw-k-- WC",
+		"r-xk-H WB",
+		"rw-k-H WC",
+		"4 mapped range(s)",
+	}
+
+	if len(lines) != len(exp) {
+		t.Fatalf("expected %d lines; got %d:\n%s", len(exp), len(lines), buf.String())
+	}
+
+	for index, expSuffix := range exp {
+		if !strings.HasSuffix(lines[index], expSuffix) {
+			t.Errorf("[line %d] expected suffix %q; got %q", index, expSuffix, lines[index])
+		}
+	}
+}
+
+func TestMemTypeName(t *testing.T) {
+	specs := []struct {
+		flags   PageTableEntryFlag
+		isHuge  bool
+		expName string
+	}{
+		{0, false, "WB"},
+		{FlagWriteThroughCaching, false, "WT"},
+		{FlagDoNotCache | FlagWriteThroughCaching, true, "UC"},
+		{flagPAT, false, "WC"},
+		// Bit 7 is FlagHugePage for huge pages and not the PAT bit
+		{FlagHugePage, true, "WB"},
+		{FlagHugePage | flagHugePAT, true, "WC"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := memTypeName(spec.flags, spec.isHuge); got != spec.expName {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.expName, got)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package vmm
+
+import "goose/kernel/cpu"
+
+const (
+	// msrPAT is the index of the IA32_PAT model-specific register.
+	msrPAT = 0x277
+
+	// patValue contains the page attribute table entries programmed by
+	// setupPAT. The first four entries (PA0-PA3) retain their power-on
+	// values (WB, WT, UC-, UC) so that the PWT and PCD bits keep their
+	// traditional meaning. PA4 is changed from WB to WC and selected by
+	// FlagMemWriteCombining; PA5-PA7 retain their power-on values.
+	//
+	// Memory type encodings: UC = 0, WC = 1, WT = 4, WB = 6, UC- = 7.
+	patValue = uint64(0x0007040100070406)
+)
+
+var (
+	// patEnabled is set to true by setupPAT if the CPU supports the page
+	// attribute table.
+	patEnabled bool
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	hasPATFn   = cpu.HasPAT
+	writeMSRFn = cpu.WriteMSR
+)
+
+// setupPAT programs the page attribute table so that write-combining mappings
+// can be established via FlagMemWriteCombining. As no existing mapping uses
+// the modified PA4 entry, there is no need to flush the caches or the TLB.
+func setupPAT() {
+	if !hasPATFn() {
+		return
+	}
+
+	writeMSRFn(msrPAT, patValue)
+	patEnabled = true
+}
+
+// memTypeFlags translates the memory type flags in the supplied flags to the
+// page table entry bits for an entry at the specified page level. The
+// FlagMemWriteCombining selector is replaced by the PAT bit at the location
+// expected by the CPU for the entry's page size. If the page attribute table
+// is not supported, write-combining mappings fall back to uncached mappings.
+func memTypeFlags(flags PageTableEntryFlag, level uint8) PageTableEntryFlag {
+	if flags&FlagMemWriteCombining == 0 {
+		return flags
+	}
+
+	if !patEnabled {
+		return flags&^flagMemTypeMask | FlagMemUncached
+	}
+
+	if level < pageLevels-1 {
+		return flags&^FlagMemWriteCombining | flagHugePAT
+	}
+
+	return flags&^FlagMemWriteCombining | flagPAT
+}
@@ -39,6 +39,11 @@ var (
 // PageDirectoryTable describes the top-most table in a multi-level paging scheme.
 type PageDirectoryTable struct {
 	pdtFrame mm.Frame
+
+	// pcid is the process context identifier that tags the TLB entries
+	// for this PDT. A zero value indicates that the PDT is not tagged and
+	// its TLB entries are flushed each time it is activated.
+	pcid uint16
 }
 
 // Init sets up the page table directory starting at the supplied physical
@@ -50,6 +55,7 @@ type PageDirectoryTable struct {
 //  - setup a recursive mapping for the last table entry to the page itself.
 func (pdt *PageDirectoryTable) Init(pdtFrame mm.Frame) *kernel.Error {
 	pdt.pdtFrame = pdtFrame
+	pdtFrame.SetUsage(mm.FrameUsagePageTable)
 
 	// Check active PDT physical address. If it matches the input pdt then
 	// nothing more needs to be done
@@ -74,6 +80,7 @@ func (pdt *PageDirectoryTable) Init(pdtFrame mm.Frame) *kernel.Error {
 	// Remove temporary mapping
 	_ = unmapFn(pdtPage)
 
+	pdt.pcid = pcids.alloc()
 	return nil
 }
 
@@ -83,6 +90,13 @@ func (pdt *PageDirectoryTable) Init(pdtFrame mm.Frame) *kernel.Error {
 // establishing a temporary mapping so that Map() can access the inactive PDT
 // entries.
 func (pdt PageDirectoryTable) Map(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+	return pdt.mapAtLevel(page, frame, flags, pageLevels-1)
+}
+
+// mapAtLevel behaves like Map but installs the mapping in an entry at the
+// specified page table level. Levels above the last page level establish huge
+// page mappings.
+func (pdt PageDirectoryTable) mapAtLevel(page mm.Page, frame mm.Frame, flags PageTableEntryFlag, leafLevel uint8) *kernel.Error {
 	var (
 		activePdtFrame   = mm.Frame(activePDTFn() >> mm.PageShift)
 		lastPdtEntryAddr uintptr
@@ -98,11 +112,17 @@ func (pdt PageDirectoryTable) Map(page mm.Page, frame mm.Frame, flags PageTableE
 		flushTLBEntryFn(lastPdtEntryAddr)
 	}
 
-	err := mapFn(page, frame, flags)
+	var err *kernel.Error
+	if leafLevel == pageLevels-1 {
+		err = mapFn(page, frame, flags)
+	} else {
+		err = mapAtLevel(page, frame, flags, leafLevel)
+	}
 
 	if activePdtFrame != pdt.pdtFrame {
 		lastPdtEntry.SetFrame(activePdtFrame)
 		flushTLBEntryFn(lastPdtEntryAddr)
+		pcids.markStale(pdt.pcid)
 	}
 
 	return err
@@ -133,14 +153,26 @@ func (pdt PageDirectoryTable) Unmap(page mm.Page) *kernel.Error {
 	if activePdtFrame != pdt.pdtFrame {
 		lastPdtEntry.SetFrame(activePdtFrame)
 		flushTLBEntryFn(lastPdtEntryAddr)
+		pcids.markStale(pdt.pcid)
 	}
 
 	return err
 }
 
-// Activate enables this page directory table and flushes the TLB
+// Activate enables this page directory table. If the PDT is tagged with a
+// process context identifier, the TLB entries that are tagged with it are
+// preserved unless the PDT has been modified while inactive. Otherwise, all
+// non-global TLB entries are flushed.
 func (pdt PageDirectoryTable) Activate() {
-	switchPDTFn(pdt.pdtFrame.Address())
+	cr3 := pdt.pdtFrame.Address()
+	if pdt.pcid != 0 {
+		cr3 |= uintptr(pdt.pcid)
+		if !pcids.takeStale(pdt.pcid) {
+			cr3 |= cr3NoFlush
+		}
+	}
+
+	switchPDTFn(cr3)
 }
 
 // setupPDTForKernel queries the multiboot package for the ELF sections that
@@ -204,18 +236,31 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 	}
 
 	// Ensure that any pages mapped by the mmory allocator using
-	// EarlyReserveRegion are copied to the new page directory.
-	for rsvAddr := earlyReserveLastUsed; rsvAddr < tempMappingAddr; rsvAddr += mm.PageSize {
-		page := mm.PageFromAddress(rsvAddr)
-
-		frameAddr, err := translateFn(rsvAddr)
+	// EarlyReserveRegion are copied to the new page directory. The reserved
+	// regions may contain unmapped pages (e.g. the padding added by
+	// reserveAlignedRegion) which are skipped. The mappings are copied with
+	// their original page size and flags (including their memory type).
+	for rsvAddr := earlyReserveLastUsed; rsvAddr < tempMappingAddr; {
+		pte, pteLevel, err := pteForAddress(rsvAddr)
 		if err != nil {
-			return err
+			rsvAddr += mm.PageSize
+			continue
+		}
+
+		pageSize := leafPageSize(pteLevel)
+		frameMask := ptePhysPageMask
+		if pteLevel < pageLevels-1 {
+			frameMask &^= uintptr(flagHugePAT)
 		}
 
-		if err = kernelPDT.Map(page, mm.Frame(frameAddr>>mm.PageShift), FlagPresent|FlagRW); err != nil {
+		pageAddr := rsvAddr &^ (pageSize - 1)
+		frame := mm.Frame((uintptr(*pte) & frameMask) >> mm.PageShift)
+		flags := PageTableEntryFlag(uintptr(*pte) &^ frameMask)
+		if err = kernelPDT.mapAtLevel(mm.PageFromAddress(pageAddr), frame, flags, pteLevel); err != nil {
 			return err
 		}
+
+		rsvAddr = pageAddr + pageSize
 	}
 
 	// Activate the new PDT. After this point, the identify mapping for the
@@ -277,13 +322,14 @@ func (pte *pageTableEntry) SetFrame(frame mm.Frame) {
 }
 
 // pteForAddress returns the final page table entry that correspond to a
-// particular virtual address. The function performs a page table walk till it
-// reaches the final page table entry returning ErrInvalidMapping if the page
-// is not present.
-func pteForAddress(virtAddr uintptr) (*pageTableEntry, *kernel.Error) {
+// particular virtual address together with its page level. The function
+// performs a page table walk till it reaches the final page table entry or a
+// huge page entry returning ErrInvalidMapping if the page is not present.
+func pteForAddress(virtAddr uintptr) (*pageTableEntry, uint8, *kernel.Error) {
 	var (
-		err   *kernel.Error
-		entry *pageTableEntry
+		err        *kernel.Error
+		entry      *pageTableEntry
+		entryLevel uint8
 	)
 
 	walk(virtAddr, func(pteLevel uint8, pte *pageTableEntry) bool {
@@ -293,11 +339,11 @@ func pteForAddress(virtAddr uintptr) (*pageTableEntry, *kernel.Error) {
 			return false
 		}
 
-		entry = pte
+		entry, entryLevel = pte, pteLevel
 		return true
 	})
 
-	return entry, err
+	return entry, entryLevel, err
 }
 
 var (
@@ -318,7 +364,9 @@ type pageTableWalker func(pteLevel uint8, pte *pageTableEntry) bool
 // walk performs a page table walk for the given virtual address. It calls the
 // suppplied walkFn with the page table entry that corresponds to each page
 // table level. If walkFn returns an error then the walk is aborted and the
-// error is returned to the caller.
+// error is returned to the caller. The walk also stops after visiting a
+// present entry that maps a huge page as there are no further levels to
+// descend into.
 func walk(virtAddr uintptr, walkFn pageTableWalker) {
 	var (
 		level                            uint8
@@ -339,7 +387,12 @@ func walk(virtAddr uintptr, walkFn pageTableWalker) {
 		// the table pointed to by the page entry
 		entryAddr = tableAddr + (entryIndex << mm.PointerShift)
 
-		if ok = walkFn(level, (*pageTableEntry)(ptePtrFn(entryAddr))); !ok {
+		pte := (*pageTableEntry)(ptePtrFn(entryAddr))
+		if ok = walkFn(level, pte); !ok {
+			return
+		}
+
+		if level < pageLevels-1 && pte.HasFlags(FlagPresent|FlagHugePage) {
 			return
 		}
 
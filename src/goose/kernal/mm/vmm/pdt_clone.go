@@ -0,0 +1,292 @@
+package vmm
+
+import (
+	"goose/kernel"
+	"goose/kernel/mm"
+	"goose/kernel/sync"
+	"unsafe"
+)
+
+var (
+	errDestroyActivePDT = &kernel.Error{Module: "vmm", Message: "cannot destroy the active or the kernel page directory table"}
+	errHugePageCoW      = &kernel.Error{Module: "vmm", Message: "copy-on-write is not supported for writable huge pages"}
+)
+
+// pageTable describes the entries of a single page table.
+type pageTable [pageTableEntries]pageTableEntry
+
+// pdtWindows provides access to the page tables of arbitrary (not necessarily
+// active) page directory tables. Clone and Destroy need to access tables from
+// several page levels at the same time so a single temporary mapping does
+// not suffice. Instead, a small region with one page per page level for the
+// source and one for the destination tables is reserved on first use. As the
+// region lives in the kernel half of the address space, its mappings are
+// shared by all page directory tables.
+var pdtWindows struct {
+	mutex sync.Spinlock
+	base  uintptr
+}
+
+// pdtWindowSlots is the number of pages in the pdtWindows region.
+const pdtWindowSlots = 2 * pageLevels
+
+// mapTableWindow maps the page table stored in the supplied frame to the
+// requested window slot and returns a pointer to its entries. Callers must
+// hold the pdtWindows mutex.
+func mapTableWindow(slot uint8, tableFrame mm.Frame) (*pageTable, *kernel.Error) {
+	if pdtWindows.base == 0 {
+		base, err := ReserveRegion(pdtWindowSlots * mm.PageSize)
+		if err != nil {
+			return nil, err
+		}
+		pdtWindows.base = base
+	}
+
+	page := mm.PageFromAddress(pdtWindows.base) + mm.Page(slot)
+	if err := mapFn(page, tableFrame, FlagPresent|FlagRW|FlagNoExecute); err != nil {
+		return nil, err
+	}
+
+	return (*pageTable)(ptePtrFn(page.Address())), nil
+}
+
+// unmapTableWindows removes any mappings established by mapTableWindow so
+// that no stale mappings to released table frames are left behind. Callers
+// must hold the pdtWindows mutex.
+func unmapTableWindows() {
+	if pdtWindows.base == 0 {
+		return
+	}
+
+	for page, slot := mm.PageFromAddress(pdtWindows.base), mm.Page(0); slot < pdtWindowSlots; slot++ {
+		if _, err := translateFn((page + slot).Address()); err == nil {
+			_ = unmapFn(page + slot)
+		}
+	}
+}
+
+// Clone creates a new page directory table that is a copy of this PDT. The
+// kernel half of the address space is shared by pointing the new PDT entries
+// to the same tables used by this PDT. The user half of the address space is
+// copied table by table; the mapped frames are shared between the two PDTs
+// with any writable pages being marked as read-only with the FlagCopyOnWrite
+// flag set in both PDTs. The first write to such a page by either address
+// space triggers a page fault which is handled by copying the page contents.
+//
+// Pages in the user half that are not flagged with FlagUserAccessible (e.g. the
+// kernel identity mappings of the low physical memory) belong to the kernel and
+// are shared as-is without copy-on-write or reference counting.
+//
+// Huge pages in the user half are shared as-is if they are read-only;
+// writable huge pages cannot be shared using copy-on-write and cause Clone to
+// fail.
+//
+// Mappings for the kernel half that require new top-level entries after the
+// PDT has been cloned are not propagated to the clone.
+func (pdt *PageDirectoryTable) Clone() (PageDirectoryTable, *kernel.Error) {
+	var clone PageDirectoryTable
+
+	cloneFrame, err := mm.AllocFrame()
+	if err != nil {
+		return clone, err
+	}
+
+	if err = clone.Init(cloneFrame); err != nil {
+		_ = freeFrameFn(cloneFrame)
+		return clone, err
+	}
+
+	pdtWindows.mutex.Acquire()
+	err = cloneTable(0, pdt.pdtFrame, clone.pdtFrame)
+	if err != nil {
+		// The partially populated clone only holds references to the
+		// frames that have been shared so far; release them.
+		_ = releaseTable(0, clone.pdtFrame, userHalfEntries)
+	}
+	unmapTableWindows()
+	pdtWindows.mutex.Release()
+
+	// Entries in this PDT may have been downgraded to read-only; flush any
+	// stale TLB entries for the user half of the address space
+	if pdt.pdtFrame.Address() == activePDTFn() {
+		flushTLBFn()
+	} else {
+		pcids.markStale(pdt.pcid)
+	}
+
+	if err != nil {
+		_ = freeFrameFn(cloneFrame)
+		pcids.release(clone.pcid)
+		return PageDirectoryTable{}, err
+	}
+
+	return clone, nil
+}
+
+// cloneTable copies the entries of the srcFrame table at the specified page
+// level to the dstFrame table. For the top-most level, only the user half of
+// the entries is deep-copied while the kernel half entries (excluding the
+// recursive mapping entry) are copied verbatim.
+func cloneTable(level uint8, srcFrame, dstFrame mm.Frame) *kernel.Error {
+	srcTable, err := mapTableWindow(level, srcFrame)
+	if err != nil {
+		return err
+	}
+
+	dstTable, err := mapTableWindow(pageLevels+level, dstFrame)
+	if err != nil {
+		return err
+	}
+
+	entryCount := pageTableEntries
+	if level == 0 {
+		entryCount = userHalfEntries
+		for index := userHalfEntries; index < pageTableEntries-1; index++ {
+			dstTable[index] = srcTable[index]
+		}
+	}
+
+	for index := 0; index < entryCount; index++ {
+		srcEntry := &srcTable[index]
+		if !srcEntry.HasFlags(FlagPresent) {
+			continue
+		}
+
+		// Bit 7 of last level entries is the PAT bit and not FlagHugePage
+		isHuge := level < pageLevels-1 && srcEntry.HasFlags(FlagHugePage)
+		if level == pageLevels-1 || isHuge {
+			if err = shareLeafEntry(srcEntry, isHuge); err != nil {
+				return err
+			}
+
+			dstTable[index] = *srcEntry
+			continue
+		}
+
+		tableFrame, err := mm.AllocFrame()
+		if err != nil {
+			return err
+		}
+		tableFrame.SetUsage(mm.FrameUsagePageTable)
+
+		// Clear the new table before linking it so that releaseTable can
+		// safely walk a partially copied hierarchy.
+		tablePage, err := mapTableWindow(pageLevels+level+1, tableFrame)
+		if err != nil {
+			_ = freeFrameFn(tableFrame)
+			return err
+		}
+		kernel.Memset(uintptr(unsafe.Pointer(tablePage)), 0, mm.PageSize)
+
+		dstTable[index] = *srcEntry
+		dstTable[index].SetFrame(tableFrame)
+
+		if err = cloneTable(level+1, srcEntry.Frame(), tableFrame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shareLeafEntry prepares a page table entry that maps a page or a huge page
+// so that it can be shared by two PDTs. Writable user pages are downgraded to
+// read-only and flagged as copy-on-write and the reference count of the
+// mapped frame is incremented. Kernel pages are shared unmodified.
+func shareLeafEntry(entry *pageTableEntry, isHuge bool) *kernel.Error {
+	if !entry.HasFlags(FlagUserAccessible) {
+		return nil
+	}
+
+	if isHuge {
+		if entry.HasAnyFlag(FlagRW | FlagCopyOnWrite) {
+			return errHugePageCoW
+		}
+
+		return nil
+	}
+
+	if entry.HasFlags(FlagRW) {
+		entry.ClearFlags(FlagRW)
+		entry.SetFlags(FlagCopyOnWrite)
+	}
+
+	// Pinned frames are never released so there is no need to track
+	// their references.
+	frame := entry.Frame()
+	if desc := frame.Descriptor(); desc != nil && !desc.HasFlags(mm.FrameFlagPinned) {
+		frame.AddRef()
+	}
+
+	return nil
+}
+
+// Destroy releases the page tables for the user half of the address space
+// described by this PDT as well as the PDT frame itself. The references to
+// the frames mapped by the user half are dropped; frames that are no longer
+// referenced by any other PDT are returned to the physical frame allocator.
+// The kernel half of the address space is shared by all PDTs and is left
+// intact. Destroy fails if the PDT is currently active or if it is the
+// kernel PDT.
+func (pdt *PageDirectoryTable) Destroy() *kernel.Error {
+	if pdt.pdtFrame.Address() == activePDTFn() || pdt.pdtFrame == kernelPDT.pdtFrame {
+		return errDestroyActivePDT
+	}
+
+	pdtWindows.mutex.Acquire()
+	err := releaseTable(0, pdt.pdtFrame, userHalfEntries)
+	unmapTableWindows()
+	pdtWindows.mutex.Release()
+
+	if err != nil {
+		return err
+	}
+
+	if err = freeFrameFn(pdt.pdtFrame); err != nil {
+		return err
+	}
+
+	pcids.release(pdt.pcid)
+	pdt.pdtFrame, pdt.pcid = mm.InvalidFrame, 0
+	return nil
+}
+
+// releaseTable walks the first entryCount entries of the table stored in
+// tableFrame at the specified page level. The frames mapped by leaf entries
+// are released and any lower level tables are recursively released and
+// freed. The table frame itself is not freed.
+func releaseTable(level uint8, tableFrame mm.Frame, entryCount int) *kernel.Error {
+	table, err := mapTableWindow(level, tableFrame)
+	if err != nil {
+		return err
+	}
+
+	for index := 0; index < entryCount; index++ {
+		entry := table[index]
+		if !entry.HasFlags(FlagPresent) {
+			continue
+		}
+
+		isHuge := level < pageLevels-1 && entry.HasFlags(FlagHugePage)
+		if level == pageLevels-1 || isHuge {
+			// Huge pages and kernel pages are shared without
+			// reference counting (see shareLeafEntry) and frames
+			// without a descriptor are not managed by the frame
+			// allocator.
+			if !isHuge && entry.HasFlags(FlagUserAccessible) && entry.Frame().Descriptor() != nil {
+				_ = freeFrameFn(entry.Frame())
+			}
+			continue
+		}
+
+		if err = releaseTable(level+1, entry.Frame(), pageTableEntries); err != nil {
+			return err
+		}
+
+		if err = freeFrameFn(entry.Frame()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
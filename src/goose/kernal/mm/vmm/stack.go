@@ -0,0 +1,216 @@
+package vmm
+
+import (
+	"goose/kernel"
+	"goose/kernel/kfmt"
+	"goose/kernel/mm"
+	"goose/kernel/sync"
+)
+
+// maxKernelStacks defines the maximum number of kernel stacks whose guard
+// pages can be tracked at the same time. Goroutine stacks are allocated via
+// AllocGuardedStack and are not tracked.
+const maxKernelStacks = 64
+
+var (
+	errKernelStackNoSlots   = &kernel.Error{Module: "vmm", Message: "no free slots for registering kernel stack"}
+	errKernelStackNotFound  = &kernel.Error{Module: "vmm", Message: "unknown kernel stack"}
+	errKernelStackOverflow  = &kernel.Error{Module: "vmm", Message: "kernel stack overflow"}
+	errInvalidKernelStack   = &kernel.Error{Module: "vmm", Message: "kernel stack bounds must be page-aligned"}
+	errKernelStackGuardUsed = &kernel.Error{Module: "vmm", Message: "page below the kernel stack is already registered as a guard page"}
+)
+
+// KernelStack describes the usable address range [Bottom, Top) of a kernel
+// stack. The page right below Bottom is a guard page that is never mapped so
+// that stack overflows trigger a page fault instead of silently corrupting
+// the memory below the stack.
+type KernelStack struct {
+	Bottom, Top uintptr
+}
+
+// guardPage returns the address of the guard page for this stack.
+func (s KernelStack) guardPage() uintptr {
+	return s.Bottom - mm.PageSize
+}
+
+// kernelStackEntry associates a kernel stack with a description of its owner.
+type kernelStackEntry struct {
+	stack KernelStack
+	owner string
+}
+
+// kernelStackList tracks the kernel stacks with guard pages. Lookups are
+// performed by the fault handlers without acquiring the list lock as the
+// fault may have been triggered while the lock was held.
+type kernelStackList struct {
+	mutex   sync.Spinlock
+	count   int
+	entries [maxKernelStacks]kernelStackEntry
+}
+
+// kernelStacks contains the set of registered kernel stacks.
+var kernelStacks kernelStackList
+
+// AllocKernelStack reserves a region in the kernel address space that can fit
+// a stack with the requested size plus a guard page and maps the stack pages
+// to newly allocated physical frames. The guard page is left unmapped. The
+// owner argument describes the stack user and is included in the report that
+// is generated when the stack overflows. If size is not a multiple of
+// mm.PageSize it will be automatically rounded up.
+func AllocKernelStack(size uintptr, owner string) (KernelStack, *kernel.Error) {
+	stack, err := AllocGuardedStack(size)
+	if err != nil {
+		return KernelStack{}, err
+	}
+
+	if err = registerKernelStack(stack, owner); err != nil {
+		_ = freeKernelStackPages(stack)
+		return KernelStack{}, err
+	}
+
+	return stack, nil
+}
+
+// AllocGuardedStack allocates a stack with a guard page like AllocKernelStack
+// but does not register it with the fault handlers. As a result, the number
+// of such stacks is only limited by the available memory but an overflow is
+// reported as a generic page fault. This function is used for allocating the
+// goroutine stacks; the Go runtime checks for stack overflows on its own.
+//
+// Stacks allocated via AllocGuardedStack must be released via FreeGuardedStack.
+func AllocGuardedStack(size uintptr) (KernelStack, *kernel.Error) {
+	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+	regionAddr, err := ReserveRegion(size + mm.PageSize)
+	if err != nil {
+		return KernelStack{}, err
+	}
+
+	stack := KernelStack{
+		Bottom: regionAddr + mm.PageSize,
+		Top:    regionAddr + mm.PageSize + size,
+	}
+
+	var frame mm.Frame
+	for page, lastPage := mm.PageFromAddress(stack.Bottom), mm.PageFromAddress(stack.Top); page < lastPage; page++ {
+		if frame, err = mm.AllocFrame(); err == nil {
+			if err = mapFn(page, frame, FlagPresent|FlagRW|FlagNoExecute); err != nil {
+				_ = freeFrameFn(frame)
+			}
+		}
+
+		if err != nil {
+			for curPage := mm.PageFromAddress(stack.Bottom); curPage < page; curPage++ {
+				_ = UnmapAndFree(curPage)
+			}
+			_ = ReleaseRegion(regionAddr, size+mm.PageSize)
+			return KernelStack{}, err
+		}
+	}
+
+	return stack, nil
+}
+
+// FreeGuardedStack releases a stack that was allocated via AllocGuardedStack.
+func FreeGuardedStack(stack KernelStack) *kernel.Error {
+	return freeKernelStackPages(stack)
+}
+
+// FreeKernelStack releases a stack that was allocated via AllocKernelStack.
+func FreeKernelStack(stack KernelStack) *kernel.Error {
+	kernelStacks.mutex.Acquire()
+	index := 0
+	for ; index < kernelStacks.count && kernelStacks.entries[index].stack != stack; index++ {
+	}
+
+	if index == kernelStacks.count {
+		kernelStacks.mutex.Release()
+		return errKernelStackNotFound
+	}
+
+	copy(kernelStacks.entries[index:kernelStacks.count-1], kernelStacks.entries[index+1:kernelStacks.count])
+	kernelStacks.count--
+	kernelStacks.mutex.Release()
+
+	return freeKernelStackPages(stack)
+}
+
+// freeKernelStackPages unmaps the stack pages, releases their frames and
+// returns the stack region (including its guard page) back to the kernel
+// address space.
+func freeKernelStackPages(stack KernelStack) *kernel.Error {
+	BeginMapTransaction()
+	for page, lastPage := mm.PageFromAddress(stack.Bottom), mm.PageFromAddress(stack.Top); page < lastPage; page++ {
+		if err := UnmapAndFree(page); err != nil {
+			_ = CommitMapTransaction()
+			return err
+		}
+	}
+
+	if err := CommitMapTransaction(); err != nil {
+		return err
+	}
+
+	return ReleaseRegion(stack.guardPage(), stack.Top-stack.guardPage())
+}
+
+// ProtectKernelStack installs a guard page for a stack that was not allocated
+// via AllocKernelStack (e.g. the stack set up by the rt0 code). The page right
+// below the stack bottom is unmapped from the active page directory table and
+// the stack is registered so that overflows can be reported. The caller must
+// ensure that nothing else is stored in the page below the stack.
+func ProtectKernelStack(stack KernelStack, owner string) *kernel.Error {
+	if stack.Bottom&(mm.PageSize-1) != 0 || stack.Top&(mm.PageSize-1) != 0 {
+		return errInvalidKernelStack
+	}
+
+	if kernelStackForGuard(stack.guardPage()) != nil {
+		return errKernelStackGuardUsed
+	}
+
+	if err := unmapFn(mm.PageFromAddress(stack.guardPage())); err != nil {
+		return err
+	}
+
+	return registerKernelStack(stack, owner)
+}
+
+// registerKernelStack adds a stack to the list of tracked kernel stacks. It is
+// invoked by vmm.Init before the runtime supports defer.
+func registerKernelStack(stack KernelStack, owner string) *kernel.Error {
+	kernelStacks.mutex.Acquire()
+
+	if kernelStacks.count == maxKernelStacks {
+		kernelStacks.mutex.Release()
+		return errKernelStackNoSlots
+	}
+
+	kernelStacks.entries[kernelStacks.count] = kernelStackEntry{stack: stack, owner: owner}
+	kernelStacks.count++
+	kernelStacks.mutex.Release()
+	return nil
+}
+
+// kernelStackForGuard returns the registered kernel stack whose guard page
+// contains the supplied address or nil if the address does not belong to any
+// guard page.
+func kernelStackForGuard(addr uintptr) *kernelStackEntry {
+	for index := 0; index < kernelStacks.count; index++ {
+		entry := &kernelStacks.entries[index]
+		if guardAddr := entry.stack.guardPage(); addr >= guardAddr && addr < entry.stack.Bottom {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// reportStackOverflow outputs information about a kernel stack whose guard
+// page has been accessed.
+func reportStackOverflow(entry *kernelStackEntry, faultAddress uintptr) {
+	kfmt.Printf("\nkernel stack overflow: stack [0x%16x - 0x%16x] owned by %s; fault address: 0x%16x\n",
+		entry.stack.Bottom,
+		entry.stack.Top,
+		entry.owner,
+		faultAddress,
+	)
+}
@@ -0,0 +1,339 @@
+package vmm
+
+import (
+	"goose/kernel"
+	"goose/kernel/cpu"
+	"goose/kernel/mm"
+	"goose/kernel/sync"
+)
+
+const (
+	// cr4PGE enables support for global pages.
+	cr4PGE = 1 << 7
+
+	// cr4PCIDE enables support for process context identifiers.
+	cr4PCIDE = 1 << 17
+
+	// cr3NoFlush is set when loading CR3 to preserve the TLB entries that
+	// are tagged with the loaded process context identifier.
+	cr3NoFlush = 1 << 63
+
+	// pcidCount is the number of process context identifiers supported
+	// by the CPU. PCID 0 is used for untagged page directory tables.
+	pcidCount = 4096
+
+	// tlbFlushThreshold is the number of pending page invalidations above
+	// which a mapping transaction flushes the entire TLB instead of
+	// invalidating each page separately.
+	tlbFlushThreshold = 32
+)
+
+var (
+	// pcidEnabled is set to true when page directory tables are tagged
+	// with process context identifiers.
+	pcidEnabled bool
+
+	// globalPagesEnabled is set to true when the kernel half of the
+	// address space is mapped using global pages.
+	globalPagesEnabled bool
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	readCR4Fn        = cpu.ReadCR4
+	writeCR4Fn       = cpu.WriteCR4
+	flushTLBFn       = cpu.FlushTLB
+	hasPCIDFn        = cpu.HasPCID
+	hasGlobalPagesFn = cpu.HasGlobalPages
+)
+
+// setupTLBFeatures enables the global page and PCID features if they are
+// supported by the CPU. Global pages are used for the kernel half of the
+// address space so that its TLB entries survive address space switches.
+// It must be invoked before any page directory table is tagged with a PCID.
+func setupTLBFeatures() {
+	cr4 := readCR4Fn()
+
+	if hasGlobalPagesFn() {
+		cr4 |= cr4PGE
+		globalPagesEnabled = true
+	}
+
+	if hasPCIDFn() {
+		cr4 |= cr4PCIDE
+		pcidEnabled = true
+	}
+
+	writeCR4Fn(cr4)
+}
+
+// flushAllTLB invalidates all TLB entries including the ones for global pages
+// and the ones tagged with any process context identifier.
+func flushAllTLB() {
+	if !globalPagesEnabled {
+		flushTLBFn()
+		return
+	}
+
+	// Toggling CR4.PGE invalidates all TLB entries
+	cr4 := readCR4Fn()
+	writeCR4Fn(cr4 &^ cr4PGE)
+	writeCR4Fn(cr4)
+}
+
+// pcidAllocator tracks the process context identifiers that are assigned to
+// page directory tables. A PCID is considered stale if the TLB may contain
+// entries tagged with it that do not match the contents of the page tables.
+// This happens when a PCID gets recycled or when an inactive PDT is modified.
+type pcidAllocator struct {
+	mutex sync.Spinlock
+	used  [pcidCount / 64]uint64
+	stale [pcidCount / 64]uint64
+}
+
+// pcids contains the state of all process context identifiers.
+var pcids pcidAllocator
+
+// alloc reserves a process context identifier and flags it as stale. If PCIDs
+// are not supported or all of them are in use, alloc returns 0.
+func (a *pcidAllocator) alloc() uint16 {
+	if !pcidEnabled {
+		return 0
+	}
+
+	a.mutex.Acquire()
+
+	for pcid := uint16(1); pcid < pcidCount; pcid++ {
+		if block, mask := pcid>>6, uint64(1)<<(pcid&63); a.used[block]&mask == 0 {
+			a.used[block] |= mask
+			a.stale[block] |= mask
+			a.mutex.Release()
+			return pcid
+		}
+	}
+
+	a.mutex.Release()
+	return 0
+}
+
+// release returns a process context identifier to the allocator.
+func (a *pcidAllocator) release(pcid uint16) {
+	if pcid == 0 {
+		return
+	}
+
+	a.mutex.Acquire()
+	a.used[pcid>>6] &^= uint64(1) << (pcid & 63)
+	a.mutex.Release()
+}
+
+// markStale flags a process context identifier as stale.
+func (a *pcidAllocator) markStale(pcid uint16) {
+	if pcid == 0 {
+		return
+	}
+
+	a.mutex.Acquire()
+	a.stale[pcid>>6] |= uint64(1) << (pcid & 63)
+	a.mutex.Release()
+}
+
+// takeStale returns true if the process context identifier is stale and
+// clears its stale flag.
+func (a *pcidAllocator) takeStale(pcid uint16) bool {
+	a.mutex.Acquire()
+	block, mask := pcid>>6, uint64(1)<<(pcid&63)
+	isStale := a.stale[block]&mask != 0
+	a.stale[block] &^= mask
+	a.mutex.Release()
+
+	return isStale
+}
+
+// pendingInvalidation describes a range of virtual addresses whose TLB
+// entries have not been invalidated yet.
+type pendingInvalidation struct {
+	addr, size uintptr
+}
+
+// mapTransaction collects the TLB invalidations that are requested while a
+// mapping transaction is in progress as well as the frames that can only be
+// released once these invalidations have been applied.
+//
+// The lock is held for the entire duration of the outermost transaction. As
+// holding a spinlock disables preemption, the goroutine that owns the
+// transaction cannot be descheduled and nested transactions can only be
+// started by the owner or by an interrupt handler that runs on its behalf.
+type mapTransaction struct {
+	lock  sync.Spinlock
+	depth int
+
+	// fullFlush is set when the number of pending invalidations exceeds
+	// tlbFlushThreshold. In this case the individual invalidations are no
+	// longer tracked and the entire TLB is flushed on commit.
+	fullFlush bool
+
+	count   int
+	pending [tlbFlushThreshold]pendingInvalidation
+
+	// The frames of the pages unmapped by the transaction. Once the list
+	// is full, the pending invalidations are applied early so that the
+	// listed frames can be released.
+	frameCount int
+	frames     [tlbFlushThreshold]mm.Frame
+}
+
+// activeMapTx contains the state of the current mapping transaction.
+var activeMapTx mapTransaction
+
+// BeginMapTransaction starts a mapping transaction. While a transaction is in
+// progress, the TLB invalidations for pages that are unmapped are deferred
+// until the transaction is committed via a call to CommitMapTransaction. If
+// the number of deferred invalidations exceeds a threshold, the commit flushes
+// the entire TLB instead of invalidating each page separately.
+//
+// Pages that are mapped while a transaction is in progress become accessible
+// immediately. However, pages unmapped while a transaction is in progress may
+// remain accessible until the transaction is committed.
+//
+// Transactions can be nested; the deferred invalidations are applied when the
+// outermost transaction is committed. The calling goroutine cannot be
+// preempted while a transaction is in progress.
+func BeginMapTransaction() {
+	if activeMapTx.depth == 0 {
+		activeMapTx.lock.Acquire()
+	}
+	activeMapTx.depth++
+}
+
+// CommitMapTransaction completes a mapping transaction started by a call to
+// BeginMapTransaction, applies any deferred TLB invalidations and releases the
+// frames of the pages that were unmapped by UnmapAndFree. It returns the first
+// error reported while releasing the frames.
+func CommitMapTransaction() *kernel.Error {
+	if activeMapTx.depth == 0 {
+		return nil
+	}
+
+	if activeMapTx.depth--; activeMapTx.depth != 0 {
+		return nil
+	}
+
+	err := applyMapTransaction()
+	activeMapTx.lock.Release()
+
+	return err
+}
+
+// applyMapTransaction applies the TLB invalidations that were deferred by the
+// current mapping transaction and then releases the frames that backed the
+// unmapped pages.
+func applyMapTransaction() *kernel.Error {
+	if activeMapTx.fullFlush {
+		flushAllTLB()
+	} else {
+		for index := 0; index < activeMapTx.count; index++ {
+			flushTLBEntryFn(activeMapTx.pending[index].addr)
+		}
+	}
+
+	activeMapTx.count = 0
+	activeMapTx.fullFlush = false
+
+	var err *kernel.Error
+	for index := 0; index < activeMapTx.frameCount; index++ {
+		if freeErr := freeFrameFn(activeMapTx.frames[index]); freeErr != nil && err == nil {
+			err = freeErr
+		}
+	}
+	activeMapTx.frameCount = 0
+
+	return err
+}
+
+// releaseUnmappedFrame returns the frame that backed an unmapped page to the
+// physical frame allocator once the TLB entries for the page have been
+// invalidated. The caller must request the invalidation via invalidatePage
+// before invoking releaseUnmappedFrame. If a mapping transaction is in
+// progress, the frame is released when the transaction is committed as the
+// TLB may still contain a writable entry for it until then.
+func releaseUnmappedFrame(frame mm.Frame) *kernel.Error {
+	if activeMapTx.depth == 0 {
+		return freeFrameFn(frame)
+	}
+
+	var err *kernel.Error
+	if activeMapTx.frameCount == len(activeMapTx.frames) {
+		err = applyMapTransaction()
+	}
+
+	activeMapTx.frames[activeMapTx.frameCount] = frame
+	activeMapTx.frameCount++
+
+	return err
+}
+
+// invalidatePage requests the invalidation of the TLB entries for the page or
+// huge page with the specified size that contains virtAddr. If a mapping
+// transaction is in progress the invalidation is deferred.
+func invalidatePage(virtAddr, size uintptr) {
+	if activeMapTx.depth == 0 {
+		flushTLBEntryFn(virtAddr)
+		return
+	}
+
+	if activeMapTx.fullFlush {
+		return
+	}
+
+	if activeMapTx.count == tlbFlushThreshold {
+		activeMapTx.fullFlush = true
+		return
+	}
+
+	activeMapTx.pending[activeMapTx.count] = pendingInvalidation{
+		addr: virtAddr &^ (size - 1),
+		size: size,
+	}
+	activeMapTx.count++
+}
+
+// flushIfPending invalidates any stale TLB entries for the page or huge page
+// with the specified size that starts at virtAddr if an invalidation that
+// overlaps it has been deferred by the current mapping transaction. It is
+// invoked when a new mapping is established for a page that is not present as
+// the TLB may still contain entries for a previous mapping of the page.
+func flushIfPending(virtAddr, size uintptr) {
+	if activeMapTx.depth == 0 {
+		return
+	}
+
+	overlaps := activeMapTx.fullFlush
+	for index := 0; !overlaps && index < activeMapTx.count; index++ {
+		entry := &activeMapTx.pending[index]
+		overlaps = virtAddr < entry.addr+entry.size && entry.addr < virtAddr+size
+	}
+
+	switch {
+	case !overlaps:
+	case size == mm.PageSize:
+		flushTLBEntryFn(virtAddr)
+	default:
+		// The stale entries may belong to any of the pages covered by
+		// the huge page
+		flushAllTLB()
+	}
+}
+
+// leafPageSize returns the size of the memory region mapped by an entry at the
+// specified page level.
+func leafPageSize(level uint8) uintptr {
+	return uintptr(1) << pageLevelShifts[level]
+}
+
+// isGlobalAddress returns true if virtAddr belongs to the part of the kernel
+// half of the address space that is shared by all page directory tables. The
+// region used for the recursive page table mapping is excluded as its contents
+// depend on the active page directory table.
+func isGlobalAddress(virtAddr uintptr) bool {
+	return virtAddr >= kernelHalfStart && virtAddr < recursiveMappingStart
+}
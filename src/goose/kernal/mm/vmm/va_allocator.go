@@ -0,0 +1,340 @@
+package vmm
+
+import (
+	"goose/kernel"
+	"goose/kernel/mm"
+	"goose/kernel/sync"
+)
+
+// maxKernelVARanges defines the maximum number of disjoint free ranges that
+// can be tracked by the kernel virtual address space allocator.
+const maxKernelVARanges = 512
+
+var (
+	errKernelVANoSpace        = &kernel.Error{Module: "kernel_va", Message: "no free virtual address range large enough to satisfy reservation request"}
+	errKernelVAInvalidRegion  = &kernel.Error{Module: "kernel_va", Message: "region is not part of the kernel virtual address space"}
+	errKernelVADoubleRelease  = &kernel.Error{Module: "kernel_va", Message: "region overlaps an already released region"}
+	errKernelVATooFragmented  = &kernel.Error{Module: "kernel_va", Message: "too many free ranges; region cannot be released"}
+	errKernelVANotInitialized = &kernel.Error{Module: "kernel_va", Message: "kernel virtual address space allocator is not initialized"}
+)
+
+// vaRange describes the virtual address range [start, end).
+type vaRange struct {
+	start, end uintptr
+}
+
+// kernelVAAllocator manages the kernel virtual address space that is located
+// between kernelVASpaceStart and tempMappingAddr. It keeps a list of free
+// ranges sorted by address. Reservations are satisfied by carving space from
+// the end of the highest free range that fits the request, which matches the
+// top-down allocation order used by EarlyReserveRegion. Released ranges are
+// merged with their free neighbors.
+//
+// The free range list uses a fixed-size array as the allocator is also used
+// by the Go runtime hooks for reserving address space for the Go allocator.
+type kernelVAAllocator struct {
+	mutex sync.Spinlock
+
+	// ready is set to true once the allocator has been seeded.
+	ready bool
+
+	count int
+	free  [maxKernelVARanges]vaRange
+}
+
+// kernelVA is the allocator instance for the kernel address space.
+var kernelVA kernelVAAllocator
+
+// init seeds the allocator with the free range [start, end).
+func (alloc *kernelVAAllocator) init(start, end uintptr) {
+	alloc.mutex.Acquire()
+	alloc.count = 0
+	if start < end {
+		alloc.free[0] = vaRange{start, end}
+		alloc.count = 1
+	}
+	alloc.ready = true
+	alloc.mutex.Release()
+}
+
+// reserve removes a region of the requested size from the free ranges and
+// returns its start address. The returned address satisfies the condition:
+// addr % alignment == offset. Both size and alignment must be page multiples
+// and alignment must be a power of 2.
+func (alloc *kernelVAAllocator) reserve(size, alignment, offset uintptr) (uintptr, *kernel.Error) {
+	if size == 0 {
+		return 0, errKernelVANoSpace
+	}
+
+	// The allocator is used before the runtime supports defer so the lock
+	// is explicitly released on each return path
+	alloc.mutex.Acquire()
+
+	for index := alloc.count - 1; index >= 0; index-- {
+		r := &alloc.free[index]
+		if r.end-r.start < size {
+			continue
+		}
+
+		// Find the highest address in the range that satisfies the
+		// alignment requirements
+		addr := (r.end-size-offset)&^(alignment-1) + offset
+		if addr > r.end-size {
+			addr -= alignment
+		}
+
+		if addr < r.start || addr > r.end-size {
+			continue
+		}
+
+		alloc.carve(index, addr, addr+size)
+		alloc.mutex.Release()
+		return addr, nil
+	}
+
+	alloc.mutex.Release()
+	return 0, errKernelVANoSpace
+}
+
+// carve removes [start, end) from the free range at the supplied index. If the
+// carved region does not touch either end of the range, the range is split in
+// two.
+func (alloc *kernelVAAllocator) carve(index int, start, end uintptr) {
+	r := &alloc.free[index]
+	switch {
+	case r.start == start && r.end == end:
+		copy(alloc.free[index:alloc.count-1], alloc.free[index+1:alloc.count])
+		alloc.count--
+	case r.start == start:
+		r.start = end
+	case r.end == end:
+		r.end = start
+	default:
+		tail := vaRange{end, r.end}
+		r.end = start
+
+		// If the list is full, leak the smaller part instead of failing
+		// the reservation
+		if alloc.count == maxKernelVARanges {
+			if tail.end-tail.start > r.end-r.start {
+				*r = tail
+			}
+			return
+		}
+
+		copy(alloc.free[index+2:alloc.count+1], alloc.free[index+1:alloc.count])
+		alloc.free[index+1] = tail
+		alloc.count++
+	}
+}
+
+// release returns the region [addr, addr+size) to the free ranges merging it
+// with any adjacent free range.
+func (alloc *kernelVAAllocator) release(addr, size uintptr) *kernel.Error {
+	end := addr + size
+	if addr < kernelVASpaceStart || end > tempMappingAddr || end <= addr {
+		return errKernelVAInvalidRegion
+	}
+
+	alloc.mutex.Acquire()
+
+	// Find the first free range that starts after addr
+	index := 0
+	for ; index < alloc.count && alloc.free[index].start < addr; index++ {
+	}
+
+	var (
+		mergePrev = index > 0 && alloc.free[index-1].end == addr
+		mergeNext = index < alloc.count && alloc.free[index].start == end
+	)
+
+	if (index > 0 && alloc.free[index-1].end > addr) || (index < alloc.count && alloc.free[index].start < end) {
+		alloc.mutex.Release()
+		return errKernelVADoubleRelease
+	}
+
+	switch {
+	case mergePrev && mergeNext:
+		alloc.free[index-1].end = alloc.free[index].end
+		copy(alloc.free[index:alloc.count-1], alloc.free[index+1:alloc.count])
+		alloc.count--
+	case mergePrev:
+		alloc.free[index-1].end = end
+	case mergeNext:
+		alloc.free[index].start = addr
+	default:
+		if alloc.count == maxKernelVARanges {
+			alloc.mutex.Release()
+			return errKernelVATooFragmented
+		}
+
+		copy(alloc.free[index+1:alloc.count+1], alloc.free[index:alloc.count])
+		alloc.free[index] = vaRange{addr, end}
+		alloc.count++
+	}
+
+	alloc.mutex.Release()
+	return nil
+}
+
+// initKernelVA seeds the kernel virtual address space allocator. Any regions
+// that have already been handed out by EarlyReserveRegion are treated as
+// reserved. After this call, EarlyReserveRegion forwards all requests to the
+// kernel virtual address space allocator.
+func initKernelVA() {
+	kernelVA.init(kernelVASpaceStart, earlyReserveLastUsed)
+}
+
+// ReserveRegion reserves a page-aligned contiguous virtual memory region with
+// the requested size in the kernel address space and returns its virtual
+// address. If size is not a multiple of mm.PageSize it will be automatically
+// rounded up. Regions reserved via ReserveRegion can be returned back to the
+// kernel address space via ReleaseRegion.
+//
+// Before the vmm package is initialized, ReserveRegion falls back to using
+// EarlyReserveRegion.
+func ReserveRegion(size uintptr) (uintptr, *kernel.Error) {
+	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+	if !kernelVA.ready {
+		return EarlyReserveRegion(size)
+	}
+
+	return kernelVA.reserve(size, mm.PageSize, 0)
+}
+
+// ReleaseRegion returns a region previously reserved via ReserveRegion or
+// EarlyReserveRegion back to the kernel address space. The caller must ensure
+// that no mappings to the region remain. If size is not a multiple of
+// mm.PageSize it will be automatically rounded up.
+func ReleaseRegion(addr, size uintptr) *kernel.Error {
+	if !kernelVA.ready {
+		return errKernelVANotInitialized
+	}
+
+	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+	return kernelVA.release(addr&^(mm.PageSize-1), size)
+}
+
+// reserveAlignedRegion reserves a region of the requested size whose start
+// address shares the same offset within an alignment-sized block as physAddr.
+// Before the kernel virtual address space allocator is initialized, the
+// region is obtained via EarlyReserveRegion by padding the request with
+// enough space to satisfy the alignment requirement.
+func reserveAlignedRegion(size, alignment, physAddr uintptr) (uintptr, *kernel.Error) {
+	offset := physAddr & (alignment - 1) &^ (mm.PageSize - 1)
+	if kernelVA.ready {
+		return kernelVA.reserve(size, alignment, offset)
+	}
+
+	regionAddr, err := earlyReserveRegionFn(size + alignment - mm.PageSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return regionAddr + ((offset - regionAddr) & (alignment - 1)), nil
+}
+
+// VAlloc reserves a region with the requested size in the kernel address
+// space, backs it with newly allocated physical frames and returns its
+// virtual address. The region is mapped as RW and non-executable and its
+// contents are cleared. If size is not a multiple of mm.PageSize it will be
+// automatically rounded up.
+//
+// Memory allocated via VAlloc must be released with a call to VFree.
+func VAlloc(size uintptr) (uintptr, *kernel.Error) {
+	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+	regionAddr, err := ReserveRegion(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var frame mm.Frame
+	for page, lastPage := mm.PageFromAddress(regionAddr), mm.PageFromAddress(regionAddr+size); page < lastPage; page++ {
+		if frame, err = mm.AllocFrame(); err == nil {
+			if err = mapFn(page, frame, FlagPresent|FlagRW|FlagNoExecute); err != nil {
+				_ = freeFrameFn(frame)
+			}
+		}
+
+		if err != nil {
+			// Undo any mappings that have already been established
+			for curPage := mm.PageFromAddress(regionAddr); curPage < page; curPage++ {
+				_ = UnmapAndFree(curPage)
+			}
+			_ = ReleaseRegion(regionAddr, size)
+			return 0, err
+		}
+
+		kernel.Memset(page.Address(), 0, mm.PageSize)
+	}
+
+	return regionAddr, nil
+}
+
+// VFree unmaps a region previously allocated via VAlloc, releases the physical
+// frames that back it and returns the region back to the kernel address space.
+func VFree(addr, size uintptr) *kernel.Error {
+	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+
+	BeginMapTransaction()
+	for page, lastPage := mm.PageFromAddress(addr), mm.PageFromAddress(addr+size); page < lastPage; page++ {
+		if err := UnmapAndFree(page); err != nil {
+			_ = CommitMapTransaction()
+			return err
+		}
+	}
+
+	if err := CommitMapTransaction(); err != nil {
+		return err
+	}
+
+	return ReleaseRegion(addr, size)
+}
+
+// UnmapRegion removes a mapping previously installed via a call to MapRegion
+// and returns the virtual region back to the kernel address space. The
+// physical frames that backed the mapping are not released.
+func UnmapRegion(page mm.Page, size uintptr) *kernel.Error {
+	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+	if err := unmapPages(page, size); err != nil {
+		return err
+	}
+
+	return ReleaseRegion(page.Address(), size)
+}
+
+// unmapPages removes the 4K and huge page mappings that cover the page-aligned
+// region [page, page+size) without releasing the physical frames or the
+// virtual region.
+func unmapPages(page mm.Page, size uintptr) *kernel.Error {
+	BeginMapTransaction()
+
+	for curPage, pageCount := page, size>>mm.PageShift; pageCount > 0; {
+		_, pteLevel, err := pteForAddress(curPage.Address())
+		if err != nil {
+			_ = CommitMapTransaction()
+			return err
+		}
+
+		unmappedPages := uintptr(1)
+		if pteLevel < pageLevels-1 {
+			hugeSize := HugePageSize(pageLevels - 2 - pteLevel)
+			if unmappedPages = hugeSize.pageCount(); pageCount < unmappedPages {
+				_ = CommitMapTransaction()
+				return errHugePageMapped
+			}
+			err = UnmapHugePage(curPage, hugeSize)
+		} else {
+			err = unmapFn(curPage)
+		}
+
+		if err != nil {
+			_ = CommitMapTransaction()
+			return err
+		}
+
+		curPage, pageCount = curPage+mm.Page(unmappedPages), pageCount-unmappedPages
+	}
+
+	return CommitMapTransaction()
+}
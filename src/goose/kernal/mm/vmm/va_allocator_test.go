@@ -0,0 +1,183 @@
+package vmm
+
+import (
+	"goose/kernel"
+	"goose/kernel/mm"
+	"testing"
+)
+
+// checkFreeRanges verifies that the free range list of alloc matches exp.
+func checkFreeRanges(t *testing.T, alloc *kernelVAAllocator, exp []vaRange) {
+	t.Helper()
+
+	if alloc.count != len(exp) {
+		t.Fatalf("expected %d free ranges; got %d: %v", len(exp), alloc.count, alloc.free[:alloc.count])
+	}
+
+	for index, r := range exp {
+		if alloc.free[index] != r {
+			t.Errorf("expected free range %d to be [0x%x, 0x%x); got [0x%x, 0x%x)", index, r.start, r.end, alloc.free[index].start, alloc.free[index].end)
+		}
+	}
+}
+
+func TestKernelVAAllocatorReserve(t *testing.T) {
+	const (
+		pg    = mm.PageSize
+		start = kernelVASpaceStart
+		end   = kernelVASpaceStart + 16*pg
+	)
+
+	specs := []struct {
+		size, alignment, offset uintptr
+		expAddr                 uintptr
+		expFree                 []vaRange
+	}{
+		// reservations are carved from the end of the highest free range
+		{pg, pg, 0, end - pg, []vaRange{{start, end - pg}}},
+		{4 * pg, pg, 0, end - 4*pg, []vaRange{{start, end - 4*pg}}},
+		// aligned reservations split the free range
+		{pg, 8 * pg, 0, start + 8*pg, []vaRange{{start, start + 8*pg}, {start + 9*pg, end}}},
+		{2 * pg, 8 * pg, 3 * pg, start + 11*pg, []vaRange{{start, start + 11*pg}, {start + 13*pg, end}}},
+		// reservations that consume the entire range remove it
+		{16 * pg, pg, 0, start, nil},
+	}
+
+	for specIndex, spec := range specs {
+		var alloc kernelVAAllocator
+		alloc.init(start, end)
+
+		addr, err := alloc.reserve(spec.size, spec.alignment, spec.offset)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if addr != spec.expAddr {
+			t.Errorf("[spec %d] expected reserved address to be 0x%x; got 0x%x", specIndex, spec.expAddr, addr)
+		}
+
+		if addr%spec.alignment != spec.offset {
+			t.Errorf("[spec %d] expected reserved address 0x%x to have offset 0x%x; got 0x%x", specIndex, addr, spec.offset, addr%spec.alignment)
+		}
+
+		checkFreeRanges(t, &alloc, spec.expFree)
+	}
+}
+
+func TestKernelVAAllocatorReserveErrors(t *testing.T) {
+	const (
+		pg    = mm.PageSize
+		start = kernelVASpaceStart
+	)
+
+	var alloc kernelVAAllocator
+	alloc.init(start, start+4*pg)
+
+	if _, err := alloc.reserve(0, pg, 0); err != errKernelVANoSpace {
+		t.Errorf("expected to get errKernelVANoSpace for a zero-sized reservation; got %v", err)
+	}
+
+	if _, err := alloc.reserve(5*pg, pg, 0); err != errKernelVANoSpace {
+		t.Errorf("expected to get errKernelVANoSpace for an oversized reservation; got %v", err)
+	}
+
+	// The range is large enough but contains no address with the requested alignment
+	if _, err := alloc.reserve(2*pg, 8*pg, 5*pg); err != errKernelVANoSpace {
+		t.Errorf("expected to get errKernelVANoSpace for an unsatisfiable alignment; got %v", err)
+	}
+
+	checkFreeRanges(t, &alloc, []vaRange{{start, start + 4*pg}})
+}
+
+func TestKernelVAAllocatorRelease(t *testing.T) {
+	const (
+		pg    = mm.PageSize
+		start = kernelVASpaceStart
+		end   = kernelVASpaceStart + 8*pg
+	)
+
+	var (
+		alloc kernelVAAllocator
+		addrs [8]uintptr
+	)
+
+	alloc.init(start, end)
+	for index := range addrs {
+		addr, err := alloc.reserve(pg, pg, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[index] = addr
+	}
+	checkFreeRanges(t, &alloc, nil)
+
+	// addrs are handed out top-down; addrs[i] = end - (i+1)*pg
+	steps := []struct {
+		page    int
+		expFree []vaRange
+	}{
+		// no free neighbors
+		{5, []vaRange{{start + 2*pg, start + 3*pg}}},
+		{2, []vaRange{{start + 2*pg, start + 3*pg}, {start + 5*pg, start + 6*pg}}},
+		// merge with the next range
+		{6, []vaRange{{start + pg, start + 3*pg}, {start + 5*pg, start + 6*pg}}},
+		// merge with the previous range
+		{1, []vaRange{{start + pg, start + 3*pg}, {start + 5*pg, start + 7*pg}}},
+		// merge with both neighbors
+		{4, []vaRange{{start + pg, start + 4*pg}, {start + 5*pg, start + 7*pg}}},
+		{3, []vaRange{{start + pg, start + 7*pg}}},
+		{0, []vaRange{{start + pg, end}}},
+		{7, []vaRange{{start, end}}},
+	}
+
+	for stepIndex, step := range steps {
+		if err := alloc.release(addrs[step.page], pg); err != nil {
+			t.Fatalf("[step %d] unexpected error: %v", stepIndex, err)
+		}
+		checkFreeRanges(t, &alloc, step.expFree)
+	}
+
+	// Releasing and reserving must round-trip to the original state
+	addr, err := alloc.reserve(8*pg, pg, 0)
+	if err != nil || addr != start {
+		t.Fatalf("expected to reserve the entire range at 0x%x; got 0x%x, %v", start, addr, err)
+	}
+	if err = alloc.release(addr, 8*pg); err != nil {
+		t.Fatal(err)
+	}
+	checkFreeRanges(t, &alloc, []vaRange{{start, end}})
+}
+
+func TestKernelVAAllocatorReleaseErrors(t *testing.T) {
+	const (
+		pg    = mm.PageSize
+		start = kernelVASpaceStart
+	)
+
+	var alloc kernelVAAllocator
+	alloc.init(start, start+4*pg)
+	if _, err := alloc.reserve(2*pg, pg, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		addr, size uintptr
+		expErr     *kernel.Error
+	}{
+		{start - pg, pg, errKernelVAInvalidRegion},
+		{tempMappingAddr, pg, errKernelVAInvalidRegion},
+		{start, 0, errKernelVAInvalidRegion},
+		// overlaps the free range [start, start+2*pg)
+		{start + pg, pg, errKernelVADoubleRelease},
+		{start + pg, 2 * pg, errKernelVADoubleRelease},
+	}
+
+	for specIndex, spec := range specs {
+		if err := alloc.release(spec.addr, spec.size); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	checkFreeRanges(t, &alloc, []vaRange{{start, start + 2*pg}})
+}
@@ -18,12 +18,24 @@ var (
 // Init initializes the vmm system, creates a granular PDT for the kernel and
 // installs paging-related exception handlers.
 func Init(kernelPageOffset uintptr) *kernel.Error {
+	if err := setupPageProtection(); err != nil {
+		return err
+	}
+
+	setupPAT()
+	setupTLBFeatures()
+
 	if err := setupPDTForKernel(kernelPageOffset); err != nil {
 		return err
 	}
 
+	// Regions reserved from this point on can be released
+	initKernelVA()
+
 	// Install arch-specific handlers for vmm-related faults.
-	installFaultHandlers()
+	if err := installFaultHandlers(); err != nil {
+		return err
+	}
 
 	return reserveZeroedFrame()
 }
@@ -44,6 +56,12 @@ func reserveZeroedFrame() *kernel.Error {
 	kernel.Memset(tempPage.Address(), 0, mm.PageSize)
 	_ = unmapFn(tempPage)
 
+	// The zeroed frame is shared by all lazily allocated pages and must
+	// never be released or modified in place by the CoW fault handler
+	if desc := ReservedZeroedFrame.Descriptor(); desc != nil {
+		desc.Flags |= mm.FrameFlagPinned
+	}
+
 	// From this point on, ReservedZeroedFrame cannot be mapped with a RW flag
 	protectReservedZeroedPage = true
 	return nil
@@ -6,6 +6,15 @@ const (
 	// pageLevels indicates the number of page levels supported by the amd64 architecture.
 	pageLevels = 4
 
+	// pageTableEntries is the number of entries in each page table.
+	pageTableEntries = 512
+
+	// userHalfEntries is the number of top-level page table entries that
+	// cover the lower (user) half of the address space. The remaining
+	// entries cover the kernel half; the last entry is used for the
+	// recursive mapping of the page tables.
+	userHalfEntries = pageTableEntries / 2
+
 	// ptePhysPageMask is a mask that allows us to extract the physical memory
 	// address pointed to by a page table entry. For this particular architecture,
 	// bits 12-51 contain the physical memory address.
@@ -16,6 +25,20 @@ const (
 	// pages). For amd64 this address uses the following table indices:
 	// 510, 511, 511, 511.
 	tempMappingAddr = uintptr(0Xffffff7ffffff000)
+
+	// kernelVASpaceStart defines the start of the virtual address range
+	// that is managed by the kernel virtual address space allocator. The
+	// range ends at tempMappingAddr. For amd64 the range spans the last
+	// 512G region (P4 entry 510) before the recursively mapped page tables.
+	kernelVASpaceStart = uintptr(0xffffff0000000000)
+
+	// kernelHalfStart defines the start of the kernel (upper) half of the
+	// address space.
+	kernelHalfStart = uintptr(0xffff800000000000)
+
+	// recursiveMappingStart defines the start of the 512G region (P4 entry
+	// 511) that is used for recursively mapping the page tables.
+	recursiveMappingStart = uintptr(0xffffff8000000000)
 )
 
 var (
@@ -71,7 +94,7 @@ const (
 	// FlagDirty is set by the CPU when this page is modified.
 	FlagDirty
 
-	// FlagHugePage is set if when using 2Mb pages instead of 4K pages.
+	// FlagHugePage is set if when using 2Mb or 1Gb pages instead of 4K pages.
 	FlagHugePage
 
 	// FlagGlobal if set, prevents the TLB from flushing the cached memory address
@@ -82,6 +105,48 @@ const (
 	// flag and FlagRW are mutually exclusive.
 	FlagCopyOnWrite = 1 << 9
 
+	// FlagAllowWriteExecute must be specified when establishing a mapping
+	// that is both writable and executable. Mappings that set FlagRW or
+	// FlagCopyOnWrite without also setting FlagNoExecute are otherwise
+	// rejected. The flag is preserved in the page table entry so that the
+	// W^X audit can identify the mappings that have been explicitly allowed.
+	FlagAllowWriteExecute = 1 << 10
+
 	// FlagNoExecute if set, indicates that a page contains non-executable code.
 	FlagNoExecute = 1 << 63
+
+	// flagPAT selects one of the upper four page attribute table entries
+	// for 4K pages. For huge pages, the PAT bit is moved to flagHugePAT as
+	// bit 7 is used by FlagHugePage.
+	flagPAT PageTableEntryFlag = 1 << 7
+
+	// flagHugePAT is the location of the PAT bit for huge page entries.
+	flagHugePAT PageTableEntryFlag = 1 << 12
+)
+
+// The memory type flags select the caching policy for a mapping. Each flag is
+// a combination of the PWT, PCD and PAT bits which index the page attribute
+// table that is programmed by setupPAT. Only one memory type flag should be
+// specified for each mapping.
+const (
+	// FlagMemWriteBack selects write-back caching. This is the memory type
+	// used by mappings that do not specify a memory type flag.
+	FlagMemWriteBack PageTableEntryFlag = 0
+
+	// FlagMemWriteThrough selects write-through caching.
+	FlagMemWriteThrough = FlagWriteThroughCaching
+
+	// FlagMemUncached disables caching. It should be used for mapping
+	// MMIO registers.
+	FlagMemUncached = FlagDoNotCache | FlagWriteThroughCaching
+
+	// FlagMemWriteCombining selects write-combining which is suitable for
+	// mapping framebuffers. As the PAT bit location depends on the page
+	// size and coincides with FlagHugePage for huge pages, this flag uses a
+	// bit that is ignored by the CPU and is translated to the appropriate
+	// PAT bit when the mapping is established.
+	FlagMemWriteCombining PageTableEntryFlag = 1 << 11
+
+	// flagMemTypeMask includes all bits used by the memory type flags.
+	flagMemTypeMask = FlagWriteThroughCaching | FlagDoNotCache | FlagMemWriteCombining
 )
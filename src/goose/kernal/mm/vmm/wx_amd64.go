@@ -0,0 +1,156 @@
+package vmm
+
+import (
+	"goose/kernel"
+	"goose/kernel/cpu"
+	"goose/kernel/kfmt"
+	"goose/kernel/mm"
+	"unsafe"
+)
+
+const (
+	// cr0WP prevents kernel code from writing to read-only pages.
+	cr0WP = 1 << 16
+
+	// msrEFER is the index of the extended feature enable register.
+	msrEFER = 0xc0000080
+
+	// eferNXE enables the no-execute page protection feature.
+	eferNXE = 1 << 11
+)
+
+var (
+	errNoExecuteUnsupported = &kernel.Error{Module: "vmm", Message: "CPU does not support no-execute page protection"}
+	errWriteProtectDisabled = &kernel.Error{Module: "vmm", Message: "unable to enable kernel write protection (CR0.WP)"}
+	errNoExecuteDisabled    = &kernel.Error{Module: "vmm", Message: "unable to enable no-execute page protection (EFER.NXE)"}
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	hasNXFn    = cpu.HasNX
+	readCR0Fn  = cpu.ReadCR0
+	writeCR0Fn = cpu.WriteCR0
+	readMSRFn  = cpu.ReadMSR
+)
+
+// setupPageProtection ensures that the CPU enforces the page protection flags
+// that the W^X policy relies on: CR0.WP makes read-only pages read-only for
+// kernel code as well and EFER.NXE enables FlagNoExecute. Both features are
+// normally enabled by the rt0 code; setupPageProtection enables them if they
+// are not set and returns an error if they cannot be enabled.
+func setupPageProtection() *kernel.Error {
+	if !hasNXFn() {
+		return errNoExecuteUnsupported
+	}
+
+	if efer := readMSRFn(msrEFER); efer&eferNXE == 0 {
+		writeMSRFn(msrEFER, efer|eferNXE)
+		if readMSRFn(msrEFER)&eferNXE == 0 {
+			return errNoExecuteDisabled
+		}
+	}
+
+	if cr0 := readCR0Fn(); cr0&cr0WP == 0 {
+		writeCR0Fn(cr0 | cr0WP)
+		if readCR0Fn()&cr0WP == 0 {
+			return errWriteProtectDisabled
+		}
+	}
+
+	return nil
+}
+
+// wxAuditor collects the address ranges that are mapped as both writable and
+// executable. Adjacent pages are coalesced into a single range.
+type wxAuditor struct {
+	count int
+
+	inRange              bool
+	rangeStart, rangeEnd uintptr
+	rangeAllowed         bool
+}
+
+// Audit walks the active page directory table and reports any address ranges
+// that are mapped as both writable and executable. Mappings that were
+// explicitly allowed via FlagAllowWriteExecute are reported as such. Pages
+// mapped with FlagCopyOnWrite are treated as writable. Audit returns the
+// number of W+X ranges that were found.
+func Audit() int {
+	var auditor wxAuditor
+
+	auditor.auditTable(0, pdtVirtualAddr, 0)
+	auditor.flush()
+
+	if auditor.count == 0 {
+		kfmt.Printf("[vmm] W^X audit: no writable and executable mappings found\n")
+	} else {
+		kfmt.Printf("[vmm] W^X audit: found %d writable and executable range(s)\n", auditor.count)
+	}
+
+	return auditor.count
+}
+
+// auditTable scans the entries of the table that is recursively mapped at
+// tableAddr. The baseAddr argument specifies the virtual address that
+// corresponds to the first table entry. The subtrees of entries that are not
+// writable or are flagged as non-executable are skipped as no page below them
+// can be both writable and executable.
+func (a *wxAuditor) auditTable(level uint8, tableAddr, baseAddr uintptr) {
+	for index := uintptr(0); index < pageTableEntries; index++ {
+		// Skip the recursive mapping entry
+		if level == 0 && index == pageTableEntries-1 {
+			continue
+		}
+
+		entryAddr := tableAddr + (index << mm.PointerShift)
+		pte := *(*pageTableEntry)(unsafe.Pointer(entryAddr))
+
+		virtAddr := baseAddr + (index << pageLevelShifts[level])
+		if level == 0 && index >= userHalfEntries {
+			// Sign-extend addresses in the kernel half
+			virtAddr |= kernelHalfStart
+		}
+
+		if !pte.HasFlags(FlagPresent) || pte.HasFlags(FlagNoExecute) {
+			continue
+		}
+
+		if level == pageLevels-1 || pte.HasFlags(FlagHugePage) {
+			if pte.HasAnyFlag(FlagRW | FlagCopyOnWrite) {
+				a.add(virtAddr, leafPageSize(level), pte.HasFlags(FlagAllowWriteExecute))
+			}
+			continue
+		}
+
+		if pte.HasFlags(FlagRW) {
+			a.auditTable(level+1, entryAddr<<pageLevelBits[level], virtAddr)
+		}
+	}
+}
+
+// add records a W+X page and coalesces it with the current range if possible.
+func (a *wxAuditor) add(pageAddr, pageSize uintptr, allowed bool) {
+	if a.inRange && pageAddr == a.rangeEnd && allowed == a.rangeAllowed {
+		a.rangeEnd += pageSize
+		return
+	}
+
+	a.flush()
+	a.inRange = true
+	a.rangeStart, a.rangeEnd, a.rangeAllowed = pageAddr, pageAddr+pageSize, allowed
+}
+
+// flush reports the current range.
+func (a *wxAuditor) flush() {
+	if !a.inRange {
+		return
+	}
+
+	if a.rangeAllowed {
+		kfmt.Printf("[vmm] W+X mapping: [0x%16x - 0x%16x] (allowed)\n", a.rangeStart, a.rangeEnd)
+	} else {
+		kfmt.Printf("[vmm] W+X mapping: [0x%16x - 0x%16x]\n", a.rangeStart, a.rangeEnd)
+	}
+
+	a.count++
+	a.inRange = false
+}
@@ -0,0 +1,69 @@
+package rand
+
+const (
+	// chachaBlockSize is the size of a ChaCha20 keystream block in bytes.
+	chachaBlockSize = 64
+
+	// chachaKeyWords is the number of 32-bit words in a ChaCha20 key.
+	chachaKeyWords = 8
+)
+
+// chachaConstants are the words of the "expand 32-byte k" string that
+// initialize the first row of the ChaCha20 state.
+var chachaConstants = [4]uint32{0x61707865, 0x3320646e, 0x79622d32, 0x6b206574}
+
+// chachaBlock generates the ChaCha20 keystream block for the supplied key and
+// 64-bit block counter and stores it to out. The nonce is always zero as each
+// key is only used for a bounded number of blocks before it is replaced.
+func chachaBlock(out *[chachaBlockSize]byte, key *[chachaKeyWords]uint32, counter uint64) {
+	var state [16]uint32
+
+	copy(state[0:4], chachaConstants[:])
+	copy(state[4:12], key[:])
+	state[12], state[13] = uint32(counter), uint32(counter>>32)
+	chachaCore(out, &state)
+}
+
+// chachaCore applies the ChaCha20 block function to the supplied input state
+// and stores the serialized output state to out.
+func chachaCore(out *[chachaBlockSize]byte, state *[16]uint32) {
+	work := *state
+
+	// 20 rounds; each iteration performs a column and a diagonal round
+	for round := 0; round < 10; round++ {
+		quarterRound(&work, 0, 4, 8, 12)
+		quarterRound(&work, 1, 5, 9, 13)
+		quarterRound(&work, 2, 6, 10, 14)
+		quarterRound(&work, 3, 7, 11, 15)
+		quarterRound(&work, 0, 5, 10, 15)
+		quarterRound(&work, 1, 6, 11, 12)
+		quarterRound(&work, 2, 7, 8, 13)
+		quarterRound(&work, 3, 4, 9, 14)
+	}
+
+	for index, word := range work {
+		word += state[index]
+		out[index*4] = byte(word)
+		out[index*4+1] = byte(word >> 8)
+		out[index*4+2] = byte(word >> 16)
+		out[index*4+3] = byte(word >> 24)
+	}
+}
+
+// quarterRound applies the ChaCha quarter round to the state words a, b, c
+// and d.
+func quarterRound(s *[16]uint32, a, b, c, d int) {
+	s[a] += s[b]
+	s[d] = rotl(s[d]^s[a], 16)
+	s[c] += s[d]
+	s[b] = rotl(s[b]^s[c], 12)
+	s[a] += s[b]
+	s[d] = rotl(s[d]^s[a], 8)
+	s[c] += s[d]
+	s[b] = rotl(s[b]^s[c], 7)
+}
+
+// rotl rotates v to the left by n bits.
+func rotl(v uint32, n uint) uint32 {
+	return v<<n | v>>(32-n)
+}
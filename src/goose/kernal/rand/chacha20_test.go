@@ -0,0 +1,52 @@
+package rand
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestChachaCore(t *testing.T) {
+	// Block function test vector from RFC 8439, section 2.3.2
+	state := [16]uint32{
+		0x61707865, 0x3320646e, 0x79622d32, 0x6b206574,
+		0x03020100, 0x07060504, 0x0b0a0908, 0x0f0e0d0c,
+		0x13121110, 0x17161514, 0x1b1a1918, 0x1f1e1d1c,
+		0x00000001, 0x09000000, 0x4a000000, 0x00000000,
+	}
+	exp := "10f1e7e4d13b5915500fdd1fa32071c4c7d1f4c733c068030422aa9ac3d46c4e" +
+		"d2826446079faa0914c2d705d98b02a2b5129cd1de164eb9cbd083e8a2503c4e"
+
+	var out [chachaBlockSize]byte
+	chachaCore(&out, &state)
+	if got := hex.EncodeToString(out[:]); got != exp {
+		t.Fatalf("expected block:\n%s\ngot:\n%s", exp, got)
+	}
+}
+
+func TestChachaBlock(t *testing.T) {
+	// Keystream test vectors #1 and #2 from RFC 8439, appendix A.1
+	specs := []struct {
+		key     [chachaKeyWords]uint32
+		counter uint64
+		exp     string
+	}{
+		{
+			counter: 0,
+			exp: "76b8e0ada0f13d90405d6ae55386bd28bdd219b8a08ded1aa836efcc8b770dc7" +
+				"da41597c5157488d7724e03fb8d84a376a43b8f41518a11cc387b669b2ee6586",
+		},
+		{
+			counter: 1,
+			exp: "9f07e7be5551387a98ba977c732d080dcb0f29a048e3656912c6533e32ee7aed" +
+				"29b721769ce64e43d57133b074d839d531ed1f28510afb45ace10a1f4b794d6f",
+		},
+	}
+
+	for specIndex, spec := range specs {
+		var out [chachaBlockSize]byte
+		chachaBlock(&out, &spec.key, spec.counter)
+		if got := hex.EncodeToString(out[:]); got != spec.exp {
+			t.Errorf("[spec %d] expected block:\n%s\ngot:\n%s", specIndex, spec.exp, got)
+		}
+	}
+}
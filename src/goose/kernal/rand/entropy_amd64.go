@@ -0,0 +1,190 @@
+package rand
+
+import (
+	"goose/kernel/clock"
+	"goose/kernel/cpu"
+)
+
+const (
+	// hwRetries is the number of attempts for obtaining a value from the
+	// RDSEED or RDRAND instructions before giving up. Both instructions
+	// may transiently fail when the CPU entropy source is exhausted.
+	hwRetries = 10
+
+	// jitterSamples is the number of timing samples that are mixed into
+	// each 64-bit value collected by jitterEntropy.
+	jitterSamples = 64
+
+	// interruptSamples is the number of interrupt arrival times that are
+	// mixed into each 64-bit value collected by jitterEntropy if the
+	// clock is driven by periodic interrupts.
+	interruptSamples = 4
+
+	// tickSamples is the number of PIT interrupt intervals that are
+	// measured for each 64-bit value collected by jitterEntropy if the
+	// CPU does not provide a TSC.
+	tickSamples = 16
+
+	// jitterPort is a harmless I/O port (the PIT channel 2 control port)
+	// whose access latency varies between reads.
+	jitterPort = 0x61
+)
+
+// EntropySource describes where the seed material for the generator was
+// obtained from.
+type EntropySource uint8
+
+const (
+	// EntropyNone indicates that the generator has not been seeded yet.
+	EntropyNone EntropySource = iota
+
+	// EntropyRDSEED indicates that the seed was obtained via RDSEED.
+	EntropyRDSEED
+
+	// EntropyRDRAND indicates that the seed was obtained via RDRAND.
+	EntropyRDRAND
+
+	// EntropyJitter indicates that the seed was derived from TSC jitter
+	// and interrupt timing measurements.
+	EntropyJitter
+)
+
+// String implements fmt.Stringer for EntropySource.
+func (src EntropySource) String() string {
+	switch src {
+	case EntropyRDSEED:
+		return "RDSEED"
+	case EntropyRDRAND:
+		return "RDRAND"
+	case EntropyJitter:
+		return "TSC/interrupt jitter"
+	default:
+		return "none"
+	}
+}
+
+var (
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	hasRDSEEDFn        = cpu.HasRDSEED
+	hasRDRANDFn        = cpu.HasRDRAND
+	hasTSCFn           = cpu.HasTSC
+	readRandomSeedFn   = cpu.ReadRandomSeed
+	readRandomFn       = cpu.ReadRandom
+	readTSCFn          = cpu.ReadTSC
+	portReadByteFn     = cpu.PortReadByte
+	waitForInterruptFn = cpu.WaitForInterrupt
+	nanotimeFn         = clock.Nanotime
+	clockSourceFn      = clock.ActiveSource
+)
+
+// collectEntropy fills seed with values obtained from the best entropy source
+// that is available and returns the source that was used. Hardware sources
+// are preferred; if the CPU does not support them or they keep failing, the
+// seed is derived from timing jitter.
+func collectEntropy(seed *[chachaKeyWords]uint32) EntropySource {
+	source := EntropyJitter
+	switch {
+	case hasRDSEEDFn():
+		source = EntropyRDSEED
+	case hasRDRANDFn():
+		source = EntropyRDRAND
+	}
+
+	for index := 0; index < len(seed); index += 2 {
+		value, ok := hwEntropy(source)
+		if !ok {
+			source = EntropyJitter
+			value = jitterEntropy()
+		}
+
+		seed[index] ^= uint32(value)
+		seed[index+1] ^= uint32(value >> 32)
+	}
+
+	// Always mix in the current time so that seeds differ even if the
+	// entropy source is weak
+	if hasTSCFn() {
+		seed[0] ^= uint32(readTSCFn())
+	}
+	seed[1] ^= uint32(nanotimeFn())
+	return source
+}
+
+// hwEntropy returns a 64-bit value generated by the selected hardware entropy
+// source. It returns false if the source is not a hardware source or if it
+// failed to provide a value after hwRetries attempts.
+func hwEntropy(source EntropySource) (uint64, bool) {
+	for attempt := 0; attempt < hwRetries; attempt++ {
+		var (
+			value uint64
+			ok    bool
+		)
+
+		switch source {
+		case EntropyRDSEED:
+			value, ok = readRandomSeedFn()
+		case EntropyRDRAND:
+			value, ok = readRandomFn()
+		default:
+			return 0, false
+		}
+
+		if ok {
+			return value, true
+		}
+	}
+
+	return 0, false
+}
+
+// jitterEntropy derives a 64-bit value from the variation in the number of
+// TSC ticks that elapse while performing I/O port accesses. If the clock is
+// driven by periodic interrupts, the TSC values at which interrupts arrive
+// are mixed in as well. If the CPU does not provide a TSC, the value is derived
+// from the PIT interrupt timing via tickJitterEntropy.
+func jitterEntropy() uint64 {
+	if !hasTSCFn() {
+		return tickJitterEntropy()
+	}
+
+	var acc uint64
+
+	for sample := 0; sample < jitterSamples; sample++ {
+		start := readTSCFn()
+		portReadByteFn(jitterPort)
+		acc = (acc<<7 | acc>>57) ^ (readTSCFn() - start)
+	}
+
+	// Without periodic interrupts the CPU could halt indefinitely
+	if clockSourceFn() == clock.SourcePIT {
+		for sample := 0; sample < interruptSamples; sample++ {
+			waitForInterruptFn()
+			acc = (acc<<13 | acc>>51) ^ readTSCFn()
+		}
+	}
+
+	return acc
+}
+
+// tickJitterEntropy derives a 64-bit value from the number of I/O port
+// accesses that complete between consecutive PIT interrupts. Without a TSC the
+// clock is always driven by the PIT; if this is not the case, the current
+// clock value is returned as the interrupts might never arrive.
+func tickJitterEntropy() uint64 {
+	if clockSourceFn() != clock.SourcePIT {
+		return nanotimeFn()
+	}
+
+	var acc uint64
+	for sample := 0; sample < tickSamples; sample++ {
+		var accesses uint64
+		for start := nanotimeFn(); nanotimeFn() == start; accesses++ {
+			portReadByteFn(jitterPort)
+		}
+
+		acc = (acc<<7 | acc>>57) ^ accesses
+	}
+
+	return acc
+}
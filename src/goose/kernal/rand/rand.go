@@ -0,0 +1,110 @@
+// Package rand implements a cryptographically secure random number generator
+// for the kernel. The generator expands a key that is seeded from the CPU
+// entropy instructions (RDSEED/RDRAND) or, if these are not available, from
+// timing jitter using the ChaCha20 stream cipher.
+//
+// After each request, the key is replaced with fresh keystream output so that
+// the values returned by earlier requests cannot be reconstructed from the
+// generator state. The key is also periodically reseeded from the entropy
+// source.
+package rand
+
+import (
+	"goose/kernel"
+	"goose/kernel/kfmt"
+	"goose/kernel/sync"
+)
+
+// reseedInterval is the number of bytes generated before the key is mixed
+// with fresh seed material.
+const reseedInterval = 1 << 20
+
+// generator contains the state of the kernel random number generator.
+type generator struct {
+	mutex sync.Spinlock
+
+	source  EntropySource
+	key     [chachaKeyWords]uint32
+	counter uint64
+
+	// generated counts the bytes generated since the last reseed.
+	generated uint64
+
+	block [chachaBlockSize]byte
+}
+
+var rng generator
+
+// Init seeds the random number generator and reports the entropy source that
+// was used. The generator does not allocate any memory; Init must be invoked
+// after the clock has been initialized and before the Go runtime requests
+// random data for seeding its hash functions.
+func Init() *kernel.Error {
+	rng.mutex.Acquire()
+	rng.reseed()
+	source := rng.source
+	rng.mutex.Release()
+
+	kfmt.Printf("[rand] generator seeded using %s\n", source.String())
+	return nil
+}
+
+// Read fills p with random bytes. It never fails and always returns len(p)
+// and a nil error. If Init has not been invoked yet, the generator is seeded
+// on first use.
+func Read(p []byte) (int, error) {
+	rng.mutex.Acquire()
+	if rng.source == EntropyNone || rng.generated >= reseedInterval {
+		rng.reseed()
+	}
+
+	for offset := 0; offset < len(p); offset += chachaBlockSize {
+		rng.nextBlock()
+		copy(p[offset:], rng.block[:])
+	}
+	rng.generated += uint64(len(p))
+
+	// Replace the key so that the output cannot be reconstructed
+	rng.rekey()
+	rng.mutex.Release()
+
+	return len(p), nil
+}
+
+// Uint64 returns a random 64-bit value.
+func Uint64() uint64 {
+	var buf [8]byte
+	Read(buf[:])
+
+	return uint64(buf[0]) | uint64(buf[1])<<8 | uint64(buf[2])<<16 | uint64(buf[3])<<24 |
+		uint64(buf[4])<<32 | uint64(buf[5])<<40 | uint64(buf[6])<<48 | uint64(buf[7])<<56
+}
+
+// reseed mixes fresh seed material into the generator key. Callers must hold
+// the generator mutex.
+func (g *generator) reseed() {
+	g.source = collectEntropy(&g.key)
+	g.generated = 0
+	g.rekey()
+}
+
+// nextBlock generates the next keystream block. Callers must hold the
+// generator mutex.
+func (g *generator) nextBlock() {
+	chachaBlock(&g.block, &g.key, g.counter)
+	g.counter++
+}
+
+// rekey replaces the generator key with the first bytes of a new keystream
+// block and clears the block buffer. Callers must hold the generator mutex.
+func (g *generator) rekey() {
+	g.nextBlock()
+	for index := range g.key {
+		g.key[index] = uint32(g.block[index*4]) | uint32(g.block[index*4+1])<<8 |
+			uint32(g.block[index*4+2])<<16 | uint32(g.block[index*4+3])<<24
+	}
+
+	for index := range g.block {
+		g.block[index] = 0
+	}
+}
@@ -7,8 +7,25 @@ import "sync/atomic"
 var (
 	// TODO: replace with real yield function when context-switching is implemented.
 	yieldFn func()
+
+	// disablePreemptionFn and enablePreemptionFn are invoked when a lock
+	// is acquired and released respectively.
+	disablePreemptionFn func()
+	enablePreemptionFn  func()
 )
 
+// SetPreemptionHooks registers the functions that are invoked after a lock
+// is acquired and after a held lock is released. The hooks allow the caller
+// to prevent the Go runtime from descheduling a task while it holds a lock as
+// any other task trying to acquire the lock would spin forever.
+//
+// The hooks may be invoked while the runtime is in an inconsistent state so
+// they must be nosplit functions. SetPreemptionHooks must not be invoked while
+// a lock is held.
+func SetPreemptionHooks(disable, enable func()) {
+	disablePreemptionFn, enablePreemptionFn = disable, enable
+}
+
 // Spinlock implements a lock where each task trying to acquire it busy-waits
 // till the lock becomes available.
 type Spinlock struct {
@@ -20,18 +37,30 @@ type Spinlock struct {
 // a deadlock.
 func (l *Spinlock) Acquire() {
 	archAcquireSpinlock(&l.state, 1)
+	if disablePreemptionFn != nil {
+		disablePreemptionFn()
+	}
 }
 
 // TryToAcquire attempts to acquire the lock and returns true if the lock could
 // be acquired or false otherwise.
 func (l *Spinlock) TryToAcquire() bool {
-	return atomic.SwapUint32(&l.state, 1) == 0
+	if atomic.SwapUint32(&l.state, 1) != 0 {
+		return false
+	}
+
+	if disablePreemptionFn != nil {
+		disablePreemptionFn()
+	}
+	return true
 }
 
 // Release relinquishes a held lock allowing other tasks to acquire it. Calling
 // Release while the lock is free has no effect.
 func (l *Spinlock) Release() {
-	atomic.StoreUint32(&l.state, 0)
+	if atomic.SwapUint32(&l.state, 0) != 0 && enablePreemptionFn != nil {
+		enablePreemptionFn()
+	}
 }
 
 // archAcquireSpinlock is an arch-specific implementation for acquiring the lock.
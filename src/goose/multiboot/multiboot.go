@@ -2,15 +2,25 @@ package multiboot
 
 import (
 	"reflect"
-	"strings"
 	"unsafe"
 )
 
 var (
 	infoData  uintptr
 	cmdLineKV map[string]string
+
+	// modules contains the boot module descriptors that are copied out
+	// of the multiboot info payload by Detach.
+	modules []bootModule
 )
 
+// bootModule describes a boot module whose descriptor has been copied out of
+// the multiboot info payload.
+type bootModule struct {
+	physStart, physEnd uintptr
+	cmdLine            string
+}
+
 type tagType uint32
 
 // nolint
@@ -57,6 +67,16 @@ type mmapHeader struct {
 	entryVersion uint32
 }
 
+// moduleHeader describes the header for a boot module tag. The header is
+// followed by a C-style NULL-terminated string with the module command line.
+type moduleHeader struct {
+	// The physical address of the first byte of the module.
+	modStart uint32
+
+	// The physical address of the byte following the last module byte.
+	modEnd uint32
+}
+
 // FramebufferType defines the type of the initialized framebuffer.
 type FramebufferType uint8
 
@@ -229,6 +249,46 @@ const (
 	ElfSectionExecutable
 )
 
+// ModuleVisitor defines a visitor function that gets invoked by VisitModules
+// for each boot module loaded by the bootloader. The module occupies the
+// physical memory range [physStart, physEnd). Before Detach is invoked, the
+// cmdLine argument points to the multiboot info payload so it must be copied
+// by visitors that need to access it after the payload is released. The
+// visitor must return true to continue or false to abort the scan.
+type ModuleVisitor func(physStart, physEnd uintptr, cmdLine string) bool
+
+// VisitModules invokes visitor for each boot module (e.g. an initrd) that was
+// loaded by the bootloader. After a call to Detach, VisitModules visits the
+// module descriptors that were copied out of the payload.
+func VisitModules(visitor ModuleVisitor) {
+	if infoData == 0 {
+		for _, mod := range modules {
+			if !visitor(mod.physStart, mod.physEnd, mod.cmdLine) {
+				return
+			}
+		}
+		return
+	}
+
+	var (
+		cmdLine       string
+		cmdLineHeader = (*reflect.StringHeader)(unsafe.Pointer(&cmdLine))
+	)
+
+	visitTagsByType(tagModules, func(curPtr uintptr, size uint32) bool {
+		modHeader := (*moduleHeader)(unsafe.Pointer(curPtr))
+
+		// The command line is a C-style NULL-terminated string that
+		// follows the module header.
+		cmdLineHeader.Data = curPtr + unsafe.Sizeof(*modHeader)
+		cmdLineHeader.Len = 0
+		for maxLen := int(uintptr(size) - unsafe.Sizeof(*modHeader)); cmdLineHeader.Len < maxLen && *(*byte)(unsafe.Pointer(cmdLineHeader.Data + uintptr(cmdLineHeader.Len))) != 0; cmdLineHeader.Len++ {
+		}
+
+		return visitor(uintptr(modHeader.modStart), uintptr(modHeader.modEnd), cmdLine)
+	})
+}
+
 // ElfSectionVisitor defies a visitor function that gets invoked by VisitElfSections
 // for rach ELF section that belongs to the loaded kernel image.
 type ElfSectionVisitor func(name string, flags ElfSectionFlag, address uintptr, size uint64)
@@ -271,11 +331,51 @@ func VisitElfSections(visitor ElfSectionVisitor) {
 
 // SetInfoPtr updates the internal multiboot information pointer to the given
 // value. This function must be invoked before invoking any other function
-// exported by this package.
+// exported by this package. Passing a 0 value detaches the package from
+// the payload; from that point on, all lookups behave as if the payload
+// contained no tags.
 func SetInfoPtr(ptr uintptr) {
 	infoData = ptr
 }
 
+// Detach copies the kernel command line and the boot module descriptors out
+// of the multiboot info payload and then detaches the package from the payload
+// so that its memory can be reclaimed. After a call to Detach, GetBootCmdLine,
+// LookupBootCmdLine and VisitModules keep working using the copied data while
+// all other lookups behave as if the payload contained no tags. This function
+// must only be invoked after bootstrapping the memory allocator.
+func Detach() {
+	if infoData == 0 {
+		return
+	}
+
+	GetBootCmdLine()
+
+	modules = modules[:0]
+	VisitModules(func(physStart, physEnd uintptr, cmdLine string) bool {
+		modules = append(modules, bootModule{
+			physStart: physStart,
+			physEnd:   physEnd,
+			// Copy the command line out of the payload
+			cmdLine: string(append([]byte(nil), cmdLine...)),
+		})
+		return true
+	})
+
+	SetInfoPtr(0)
+}
+
+// InfoRegion returns the address and size of the multiboot information
+// payload. If no payload is available, InfoRegion returns (0, 0).
+func InfoRegion() (uintptr, uintptr) {
+	if infoData == 0 {
+		return 0, 0
+	}
+
+	// The payload starts with a dword containing its total size
+	return infoData, uintptr(*(*uint32)(unsafe.Pointer(infoData)))
+}
+
 // VisitMemRegions will invoke the supplied visitor for each memory region that
 // is defined by the multiboot info data that we received from the bootloader.
 func VisitMemRegions(visitor MemRegionVisitor) {
@@ -337,19 +437,127 @@ func GetBootCmdLine() map[string]string {
 			Cap:  int(size - 1),
 			Data: curPtr,
 		}))
-		pairs := strings.Fields(string(cmdLine))
-		for _, pair := range pairs {
-			kv := strings.Split(pair, "=")
-			switch len(kv) {
-			case 2: // foo=bar
-				cmdLineKV[kv[0]] = kv[1]
-			case 1: // nofoo
-				cmdLineKV[kv[0]] = kv[0]
+		// Copy the command line so the parsed values remain valid after
+		// the multiboot payload is reclaimed
+		visitBootCmdLine(string(cmdLine), func(key, value string) bool {
+			cmdLineKV[key] = value
+			return true
+		})
+	}
+
+	return cmdLineKV
+}
+
+// LookupBootCmdLine scans the kernel command line for the specified key and
+// returns its value. The command line is parsed in the same way as by
+// GetBootCmdLine.
+//
+// Unlike GetBootCmdLine, this function does not allocate any memory so it can
+// be used before the memory allocator is initialized. Once the command line
+// has been parsed by GetBootCmdLine, the value is looked up in the cached
+// key-value pairs. Otherwise, the returned string points to the multiboot info
+// payload which is released back to the physical memory allocator once the
+// kernel has finished booting. Callers must not retain the returned value;
+// it must be copied if it is needed after the call.
+func LookupBootCmdLine(key string) (string, bool) {
+	if cmdLineKV != nil {
+		value, found := cmdLineKV[key]
+		return value, found
+	}
+
+	curPtr, size := findTagByType(tagBootCmdLine)
+	if size == 0 {
+		return "", false
+	}
+
+	var (
+		// The command line is a C-style NULL-terminated string
+		cmdLine = *(*string)(unsafe.Pointer(&reflect.StringHeader{
+			Data: curPtr,
+			Len:  int(size - 1),
+		}))
+		value string
+		found bool
+	)
+
+	// The last occurrence of a key wins, matching GetBootCmdLine
+	visitBootCmdLine(cmdLine, func(pairKey, pairValue string) bool {
+		if pairKey == key {
+			value, found = pairValue, true
+		}
+		return true
+	})
+
+	return value, found
+}
+
+// visitBootCmdLine invokes visitor with the key and value of each
+// whitespace-separated key=value pair in the supplied command line. Keys
+// specified without a value (e.g. "nofoo") are reported with the key itself as
+// their value while pairs that contain more than one '=' are ignored. The
+// visitor must return true to continue or false to abort the scan.
+//
+// visitBootCmdLine does not allocate any memory; the strings passed to the
+// visitor point into cmdLine.
+func visitBootCmdLine(cmdLine string, visitor func(key, value string) bool) {
+	for start, end := 0, 0; start < len(cmdLine); start = end + 1 {
+		for end = start; end < len(cmdLine) && !isCmdLineSpace(cmdLine[end]); end++ {
+		}
+
+		if start == end {
+			continue
+		}
+
+		pair := cmdLine[start:end]
+		key, value, separators := pair, pair, 0
+		for index := 0; index < len(pair); index++ {
+			if pair[index] != '=' {
+				continue
 			}
+
+			if separators == 0 {
+				key, value = pair[:index], pair[index+1:]
+			}
+			separators++
+		}
+
+		if separators <= 1 && !visitor(key, value) {
+			return
 		}
 	}
+}
 
-	return cmdLineKV
+// isCmdLineSpace returns true if ch separates command line arguments.
+func isCmdLineSpace(ch byte) bool {
+	switch ch {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+
+	return false
+}
+
+// visitTagsByType invokes visitor with the contents start offset and content
+// length (excluding the tag header) of each tag of the specified type. Unlike
+// findTagByType, it supports tag types that may appear multiple times in the
+// multiboot info payload. The visitor must return true to continue or false to
+// abort the scan.
+func visitTagsByType(tagType tagType, visitor func(uintptr, uint32) bool) {
+	var ptrTagHeader *tagHeader
+
+	if infoData == 0 {
+		return
+	}
+
+	curPtr := infoData + 8
+	for ptrTagHeader = (*tagHeader)(unsafe.Pointer(curPtr)); ptrTagHeader.tagType != tagMbSectionEnd; ptrTagHeader = (*tagHeader)(unsafe.Pointer(curPtr)) {
+		if ptrTagHeader.tagType == tagType && !visitor(curPtr+8, ptrTagHeader.size-8) {
+			return
+		}
+
+		// Tags are aligned at 8-byte aligned addresses
+		curPtr += uintptr(int32(ptrTagHeader.size+7) & ^7)
+	}
 }
 
 // findTagByType scans the multiboot info data looking for the start of of the
@@ -361,6 +569,11 @@ func GetBootCmdLine() map[string]string {
 func findTagByType(tagType tagType) (uintptr, uint32) {
 	var ptrTagHeader *tagHeader
 
+	// The payload may have been released via a SetInfoPtr(0) call
+	if infoData == 0 {
+		return 0, 0
+	}
+
 	curPtr := infoData + 8
 	for ptrTagHeader = (*tagHeader)(unsafe.Pointer(curPtr)); ptrTagHeader.tagType != tagMbSectionEnd; ptrTagHeader = (*tagHeader)(unsafe.Pointer(curPtr)) {
 		if ptrTagHeader.tagType == tagType {